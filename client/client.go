@@ -0,0 +1,685 @@
+//Package client 提交和查询ktse任务的客户端
+//
+//客户端通过broker的HTTP接口访问任务,broker暂时不可用时自动重试;
+//配置WithStore后,重试仍然失败时直接读写redis(只能提交立即执行的任务)。
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pborman/uuid"
+	"github.com/phillihq/ktse/core"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRetries   = 3
+	DefaultRetryWait = time.Millisecond * 200
+	//直接访问redis时等待结果的轮询间隔
+	storePollInterval = time.Second
+)
+
+type Client struct {
+	addr       string
+	httpClient *http.Client
+	retries    int
+	retryWait  time.Duration
+	adminToken string
+	store      *core.Broker
+}
+
+type Option func(c *Client) error
+
+//使用自定义的http客户端,例如设置代理或TLS
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) error {
+		c.httpClient = httpClient
+		return nil
+	}
+}
+
+//broker暂时不可用时的重试次数和第一次重试的等待时间,之后每次等待时间加倍
+func WithRetry(retries int, wait time.Duration) Option {
+	return func(c *Client) error {
+		c.retries = retries
+		c.retryWait = wait
+		return nil
+	}
+}
+
+//取消,重新执行,删除任务和查看请求参数时携带的令牌,与broker配置的admin_token相同
+func WithAdminToken(token string) Option {
+	return func(c *Client) error {
+		c.adminToken = token
+		return nil
+	}
+}
+
+//broker不可用时直接访问broker使用的redis,地址格式与broker配置相同
+func WithStore(redisAddr string, cluster bool) Option {
+	return func(c *Client) error {
+		store, err := core.NewStoreBroker(redisAddr, cluster)
+		if err != nil {
+			return err
+		}
+		c.store = store
+		return nil
+	}
+}
+
+//创建客户端,addr为broker地址,例如http://127.0.0.1:9595
+func New(addr string, opts ...Option) (*Client, error) {
+	if len(addr) == 0 {
+		return nil, ErrInvalidArgument
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	c := &Client{
+		addr:       strings.TrimRight(addr, "/"),
+		httpClient: http.DefaultClient,
+		retries:    DefaultRetries,
+		retryWait:  DefaultRetryWait,
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *Client) Close() {
+	if c.store != nil {
+		c.store.Close()
+	}
+}
+
+//所有任务共用的调度参数
+type Schedule struct {
+	StartTime    time.Time     //开始执行的时间,零值表示立即执行
+	TimeInterval string        //失败后重试的时间间隔序列,空格分隔,单位为秒
+	MaxRunTime   time.Duration //最长运行时间,0表示使用worker的配置
+	CallbackUrl  string        //任务结束后回调的地址
+	Tags         []string      //任务标签,用于查询任务列表
+}
+
+func (s *Schedule) values(v url.Values) {
+	if !s.StartTime.IsZero() {
+		v.Set("start_time", strconv.FormatInt(s.StartTime.Unix(), 10))
+	}
+	if len(s.TimeInterval) != 0 {
+		v.Set("time_interval", s.TimeInterval)
+	}
+	if s.MaxRunTime > 0 {
+		v.Set("max_run_time", strconv.FormatInt(int64(s.MaxRunTime/time.Second), 10))
+	}
+	if len(s.CallbackUrl) != 0 {
+		v.Set("callback_url", s.CallbackUrl)
+	}
+	if len(s.Tags) != 0 {
+		v.Set("tags", strings.Join(s.Tags, " "))
+	}
+}
+
+func (s *Schedule) request(taskType int) *core.TaskRequest {
+	req := &core.TaskRequest{
+		Uuid:         uuid.New(),
+		TimeInterval: s.TimeInterval,
+		MaxRunTime:   int64(s.MaxRunTime / time.Second),
+		TaskType:     taskType,
+		CallbackUrl:  s.CallbackUrl,
+		Tags:         s.Tags,
+	}
+	if !s.StartTime.IsZero() {
+		req.StartTime = s.StartTime.Unix()
+	}
+	return req
+}
+
+//脚本任务
+type ScriptTask struct {
+	Schedule
+	BinName string   //bin_path下的相对路径
+	Args    []string //参数列表,不经过shell解析
+	Env     map[string]string
+	Cwd     string
+	Stdin   []byte
+	//成功策略(exit_code或stderr)和可接受的退出码(空格分隔),为空时使用worker的配置
+	SuccessPolicy string
+	SuccessCodes  string
+	Limit         *core.ResourceLimit
+}
+
+//RPC任务
+type RPCTask struct {
+	Schedule
+	Method string //GET,PUT,POST,DELETE,PATCH或HEAD
+	Url    string
+	Args   string //请求体
+	Rpc    *core.RpcOption
+}
+
+//gRPC任务
+type GRPCTask struct {
+	Schedule
+	Target string //服务地址
+	Args   string //JSON格式的请求消息
+	Grpc   core.GrpcOption
+}
+
+//处理函数任务
+type HandlerTask struct {
+	Schedule
+	Name    string
+	Payload string
+}
+
+//提交脚本任务,返回任务uuid
+func (c *Client) SubmitScript(ctx context.Context, task *ScriptTask) (string, error) {
+	v := url.Values{}
+	task.values(v)
+	v.Set("bin_name", task.BinName)
+	args := task.Args
+	if args == nil {
+		args = []string{}
+	}
+	buf, _ := json.Marshal(args)
+	v.Set("arg_list", string(buf))
+	if len(task.Env) != 0 {
+		buf, _ = json.Marshal(task.Env)
+		v.Set("env", string(buf))
+	}
+	if len(task.Cwd) != 0 {
+		v.Set("cwd", task.Cwd)
+	}
+	if len(task.Stdin) != 0 {
+		v.Set("stdin_base64", base64.StdEncoding.EncodeToString(task.Stdin))
+	}
+	if len(task.SuccessPolicy) != 0 {
+		v.Set("success_policy", task.SuccessPolicy)
+	}
+	if len(task.SuccessCodes) != 0 {
+		v.Set("success_codes", task.SuccessCodes)
+	}
+	if task.Limit != nil {
+		buf, _ = json.Marshal(task.Limit)
+		v.Set("limit", string(buf))
+	}
+	return c.submit(ctx, "/api/task/script", v, func() *core.TaskRequest {
+		req := task.request(core.ScriptTask)
+		req.BinName = task.BinName
+		req.ArgList = args
+		req.Args = core.QuoteArgs(args)
+		req.Env = task.Env
+		req.Cwd = task.Cwd
+		req.Stdin = string(task.Stdin)
+		req.SuccessPolicy = task.SuccessPolicy
+		req.SuccessCodes = task.SuccessCodes
+		req.Limit = task.Limit
+		return req
+	})
+}
+
+//提交RPC任务,返回任务uuid
+func (c *Client) SubmitRPC(ctx context.Context, task *RPCTask) (string, error) {
+	v := url.Values{}
+	task.values(v)
+	v.Set("method", task.Method)
+	v.Set("url", task.Url)
+	v.Set("args", task.Args)
+	if opt := task.Rpc; opt != nil {
+		if len(opt.Headers) != 0 {
+			buf, _ := json.Marshal(opt.Headers)
+			v.Set("headers", string(buf))
+		}
+		if len(opt.Query) != 0 {
+			buf, _ := json.Marshal(opt.Query)
+			v.Set("query", string(buf))
+		}
+		if opt.SkipVerify {
+			v.Set("skip_verify", "1")
+		}
+		for name, value := range map[string]string{
+			"auth":           opt.Auth,
+			"body_type":      opt.BodyType,
+			"content_type":   opt.ContentType,
+			"tls":            opt.Tls,
+			"success_status": opt.SuccessStatus,
+			"body_regex":     opt.BodyRegex,
+			"json_path":      opt.JsonPath,
+			"json_value":     opt.JsonValue,
+		} {
+			if len(value) != 0 {
+				v.Set(name, value)
+			}
+		}
+	}
+	return c.submit(ctx, "/api/task/rpc", v, func() *core.TaskRequest {
+		req := task.request(core.RpcTaskType(task.Method))
+		req.BinName = task.Url
+		req.Args = task.Args
+		req.Rpc = task.Rpc
+		return req
+	})
+}
+
+//提交gRPC任务,返回任务uuid
+func (c *Client) SubmitGRPC(ctx context.Context, task *GRPCTask) (string, error) {
+	v := url.Values{}
+	task.values(v)
+	v.Set("target", task.Target)
+	v.Set("method", task.Grpc.Method)
+	v.Set("args", task.Args)
+	if len(task.Grpc.Metadata) != 0 {
+		buf, _ := json.Marshal(task.Grpc.Metadata)
+		v.Set("metadata", string(buf))
+	}
+	if task.Grpc.SkipVerify {
+		v.Set("skip_verify", "1")
+	}
+	for name, value := range map[string]string{
+		"descriptor":    task.Grpc.Descriptor,
+		"tls":           task.Grpc.Tls,
+		"success_codes": task.Grpc.SuccessCodes,
+	} {
+		if len(value) != 0 {
+			v.Set(name, value)
+		}
+	}
+	return c.submit(ctx, "/api/task/grpc", v, func() *core.TaskRequest {
+		req := task.request(core.GrpcTask)
+		req.BinName = task.Target
+		req.Args = task.Args
+		opt := task.Grpc
+		req.Grpc = &opt
+		return req
+	})
+}
+
+//提交处理函数任务,返回任务uuid
+func (c *Client) SubmitHandler(ctx context.Context, task *HandlerTask) (string, error) {
+	v := url.Values{}
+	task.values(v)
+	v.Set("name", task.Name)
+	v.Set("args", task.Payload)
+	return c.submit(ctx, "/api/task/handler", v, func() *core.TaskRequest {
+		req := task.request(core.HandlerTask)
+		req.BinName = task.Name
+		req.Args = task.Payload
+		return req
+	})
+}
+
+//提交任务,broker不可用时使用request生成的请求直接写入redis
+func (c *Client) submit(ctx context.Context, path string, v url.Values, request func() *core.TaskRequest) (string, error) {
+	var taskUuid string
+	err := c.call(ctx, "POST", path, v, false, &taskUuid)
+	if c.useStore(err, false) {
+		//与broker的接口使用相同的校验
+		req := request()
+		if err = c.store.CheckTaskRequest(req); err != nil {
+			return "", err
+		}
+		req.TraceParent = core.TraceParent(ctx)
+		if err = c.store.HandleRequest(req); err != nil {
+			return "", err
+		}
+		return req.Uuid, nil
+	}
+	return taskUuid, err
+}
+
+//查询任务结果,结果不存在时返回ErrResultNotExist
+func (c *Client) Get(ctx context.Context, taskUuid string) (*core.Reply, error) {
+	return c.get(ctx, taskUuid, 0)
+}
+
+func (c *Client) get(ctx context.Context, taskUuid string, wait time.Duration) (*core.Reply, error) {
+	v := url.Values{"uuid": {taskUuid}}
+	if wait >= time.Second {
+		v.Set("wait", strconv.FormatInt(int64(wait/time.Second), 10))
+	}
+	reply := new(core.Reply)
+	err := c.call(ctx, "GET", "/api/task/result", v, true, reply)
+	if c.useStore(err, true) {
+		reply, err = c.store.HandleTaskResult(taskUuid)
+		//redis中没有等待通知,轮询结果
+		if (err == ErrResultNotExist || err == nil && reply.Retrying) && wait > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(storePollInterval):
+			}
+		}
+		return reply, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+//等待任务的最终结果,直到任务成功,不再重试的失败,或ctx结束
+//失败后还会重试的结果(Retrying为true)继续等待
+func (c *Client) Wait(ctx context.Context, taskUuid string) (*core.Reply, error) {
+	for {
+		wait := time.Second * core.MaxResultWaitTime
+		if deadline, ok := ctx.Deadline(); ok {
+			if left := time.Until(deadline); left < wait {
+				wait = left
+			}
+		}
+		reply, err := c.get(ctx, taskUuid, wait)
+		if err != ErrResultNotExist && (err != nil || !reply.Retrying) {
+			return reply, err
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		//剩余时间不足一秒时broker不等待
+		if wait < time.Second {
+			select {
+			case <-ctx.Done():
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+//查询任务状态和进度
+func (c *Client) Status(ctx context.Context, taskUuid string) (*core.TaskStatus, error) {
+	status := new(core.TaskStatus)
+	err := c.call(ctx, "GET", "/api/task/status", url.Values{"uuid": {taskUuid}}, true, status)
+	if c.useStore(err, true) {
+		return c.store.HandleTaskStatus(taskUuid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+//查询任务列表,时间条件精确到秒;NextCursor不为空时设置到Cursor查询下一页
+func (c *Client) List(ctx context.Context, q *core.TaskQuery) (*core.TaskList, error) {
+	v := url.Values{}
+	params := [][2]string{
+		{"state", q.State},
+		{"queue", q.Queue},
+		{"task_type", q.TaskType},
+		{"bin_name", q.BinName},
+		{"tags", strings.Join(q.Tags, " ")},
+		{"cursor", q.Cursor},
+	}
+	for _, p := range params {
+		if len(p[1]) != 0 {
+			v.Set(p[0], p[1])
+		}
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	times := []struct {
+		name string
+		ms   int64
+	}{
+		{"submitted_after", q.SubmittedAfter},
+		{"submitted_before", q.SubmittedBefore},
+		{"finished_after", q.FinishedAfter},
+		{"finished_before", q.FinishedBefore},
+	}
+	for _, t := range times {
+		if t.ms != 0 {
+			v.Set(t.name, strconv.FormatInt(t.ms/1000, 10))
+		}
+	}
+	list := new(core.TaskList)
+	err := c.call(ctx, "GET", "/api/tasks", v, true, list)
+	if c.useStore(err, true) {
+		return c.store.SearchTasks(q)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+//取消任务,已经成功的任务返回ErrTaskFinished
+func (c *Client) Cancel(ctx context.Context, taskUuid string) error {
+	err := c.call(ctx, "POST", "/api/task/cancel", url.Values{"uuid": {taskUuid}}, true, nil)
+	if c.useStore(err, true) {
+		return c.store.HandleTaskCancel(taskUuid)
+	}
+	return err
+}
+
+//查询任务回调的投递记录
+func (c *Client) Callback(ctx context.Context, taskUuid string) (*core.CallbackStatus, error) {
+	status := new(core.CallbackStatus)
+	err := c.call(ctx, "GET", "/api/task/callback", url.Values{"uuid": {taskUuid}}, true, status)
+	if c.useStore(err, true) {
+		return c.store.HandleTaskCallback(taskUuid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+//查询任务提交时的请求参数,密钥等敏感内容被隐藏
+func (c *Client) Request(ctx context.Context, taskUuid string) (*core.TaskRequest, error) {
+	request := new(core.TaskRequest)
+	err := c.call(ctx, "GET", "/api/task/request", url.Values{"uuid": {taskUuid}}, true, request)
+	if c.useStore(err, true) {
+		if request, err = c.store.HandleTaskRequest(taskUuid); err != nil {
+			return nil, err
+		}
+		request.Redact()
+		return request, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+//按原参数重新执行已经失败并且不再自动重试的任务,其他任务返回ErrTaskNotFailed
+func (c *Client) Retry(ctx context.Context, taskUuid string) error {
+	err := c.call(ctx, "POST", "/api/task/retry", url.Values{"uuid": {taskUuid}}, false, nil)
+	if c.useStore(err, false) {
+		return c.store.HandleTaskRetry(taskUuid)
+	}
+	return err
+}
+
+//删除任务的所有数据,执行中的任务返回ErrTaskRunning
+func (c *Client) Purge(ctx context.Context, taskUuid string) error {
+	err := c.call(ctx, "POST", "/api/task/purge", url.Values{"uuid": {taskUuid}}, true, nil)
+	if c.useStore(err, true) {
+		return c.store.HandleTaskPurge(taskUuid)
+	}
+	return err
+}
+
+//查询在线的worker
+func (c *Client) Workers(ctx context.Context) ([]*core.WorkerInfo, error) {
+	var workers []*core.WorkerInfo
+	err := c.call(ctx, "GET", "/api/workers", nil, true, &workers)
+	if c.useStore(err, true) {
+		return c.store.ListWorkers()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return workers, nil
+}
+
+//查询broker中等待加入队列的定时任务和重试任务,limit为0时使用默认数量
+//定时任务保存在broker内存中,broker不可用时不能查询
+func (c *Client) Scheduled(ctx context.Context, limit int) ([]*core.ScheduledTask, error) {
+	v := url.Values{}
+	if limit > 0 {
+		v.Set("limit", strconv.Itoa(limit))
+	}
+	var tasks []*core.ScheduledTask
+	if err := c.call(ctx, "GET", "/api/tasks/scheduled", v, true, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+//任务数量统计
+type Counts struct {
+	Undo    int64 `json:"undo"`    //等待执行的任务数
+	Success int64 `json:"success"` //当天成功的任务数
+	Failure int64 `json:"failure"` //当天失败的任务数
+}
+
+//查询等待执行的任务数,以及date当天成功和失败的任务数
+func (c *Client) Counts(ctx context.Context, date time.Time) (*Counts, error) {
+	day := date.Format(core.TimeFormat)
+	counts := new(Counts)
+	err := c.call(ctx, "GET", "/api/task/count/undo", nil, true, &counts.Undo)
+	if err == nil {
+		err = c.call(ctx, "GET", "/api/task/result/success/"+day, nil, true, &counts.Success)
+	}
+	if err == nil {
+		err = c.call(ctx, "GET", "/api/task/result/failure/"+day, nil, true, &counts.Failure)
+	}
+	if c.useStore(err, true) {
+		if counts.Undo, err = c.store.GetUndoTaskCount(); err != nil {
+			return nil, err
+		}
+		if counts.Success, err = c.store.GetSuccessTaskCount(day); err != nil {
+			return nil, err
+		}
+		if counts.Failure, err = c.store.GetFailTaskCount(day); err != nil {
+			return nil, err
+		}
+		return counts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+//查询每个队列中等待执行的任务数,处理函数任务在各自的队列中
+func (c *Client) QueueCounts(ctx context.Context) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	err := c.call(ctx, "GET", "/api/task/count/queues", nil, true, &counts)
+	if c.useStore(err, true) {
+		return c.store.GetQueueCounts()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+//调用broker接口,暂时不可用时重试
+//idempotent为false的请求只在请求没有发出时重试,避免重复提交任务
+func (c *Client) call(ctx context.Context, method string, path string, v url.Values, idempotent bool, out interface{}) error {
+	var err error
+	for i := 0; ; i++ {
+		err = c.do(ctx, method, path, v, out)
+		if i >= c.retries || !isTransient(err, idempotent) || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.retryWait << uint(i)):
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, v url.Values, out interface{}) error {
+	resp, err := c.open(ctx, method, path, v)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	if err = json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("invalid broker response: %v", err)
+	}
+	return nil
+}
+
+//发送请求,返回状态码为200的响应
+func (c *Client) open(ctx context.Context, method string, path string, v url.Values) (*http.Response, error) {
+	u := c.addr + path
+	if len(v) != 0 {
+		u += "?" + v.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	//提交的任务和调用方在同一个trace中
+	core.InjectTraceHeader(ctx, req.Header)
+	if len(c.adminToken) != 0 {
+		req.Header.Set(core.AdminTokenHeader, c.adminToken)
+	}
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		//broker的错误信息为JSON字符串
+		var message string
+		if json.Unmarshal(body, &message) != nil {
+			message = strings.TrimSpace(string(body))
+		}
+		return nil, brokerError(resp.StatusCode, message)
+	}
+	return resp, nil
+}
+
+//broker暂时不可用:连接失败,网关错误,幂等请求还包括网络错误和5xx
+func isTransient(err error, idempotent bool) bool {
+	if err == nil {
+		return false
+	}
+	var brokerErr *BrokerError
+	if errors.As(err, &brokerErr) {
+		switch brokerErr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable:
+			return true
+		}
+		return idempotent && brokerErr.StatusCode >= http.StatusInternalServerError
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var urlErr *url.Error
+	return idempotent && errors.As(err, &urlErr)
+}
+
+//重试后broker仍然不可用时是否直接访问redis
+func (c *Client) useStore(err error, idempotent bool) bool {
+	return c.store != nil && isTransient(err, idempotent)
+}
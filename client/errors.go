@@ -0,0 +1,87 @@
+package client
+
+import (
+	"fmt"
+	"github.com/phillihq/ktse/core"
+)
+
+//broker返回的错误,与core中的错误相同,可以直接比较
+var (
+	ErrInvalidArgument      = core.ErrInvalidArgument
+	ErrResultNotExist       = core.ErrResultNotExist
+	ErrTaskNotExist         = core.ErrTaskNotExist
+	ErrTaskNotRunning       = core.ErrTaskNotRunning
+	ErrTaskFinished         = core.ErrTaskFinished
+	ErrCallbackNotExist     = core.ErrCallbackNotExist
+	ErrLogNotExist          = core.ErrLogNotExist
+	ErrInvalidArgs          = core.ErrInvalidArgs
+	ErrInvalidEnv           = core.ErrInvalidEnv
+	ErrInvalidLimit         = core.ErrInvalidLimit
+	ErrInvalidSuccessPolicy = core.ErrInvalidSuccessPolicy
+	ErrInvalidCallbackUrl   = core.ErrInvalidCallbackUrl
+	ErrInvalidRpcOption     = core.ErrInvalidRpcOption
+	ErrInvalidGrpcOption    = core.ErrInvalidGrpcOption
+	ErrPathNotAllowed       = core.ErrPathNotAllowed
+	ErrBinNotAllowed        = core.ErrBinNotAllowed
+	ErrFileNotExist         = core.ErrFileNotExist
+	ErrScheduleNotSupported = core.ErrScheduleNotSupported
+	ErrTaskRunning          = core.ErrTaskRunning
+	ErrTaskNotFailed        = core.ErrTaskNotFailed
+	ErrInvalidTags          = core.ErrInvalidTags
+	ErrInvalidCursor        = core.ErrInvalidCursor
+	ErrArchiveNotEnabled    = core.ErrArchiveNotEnabled
+	ErrStatsRangeTooLarge   = core.ErrStatsRangeTooLarge
+	ErrUnauthorized         = core.ErrUnauthorized
+)
+
+var brokerErrors = make(map[string]error)
+
+func init() {
+	for _, err := range []error{
+		ErrInvalidArgument,
+		ErrResultNotExist,
+		ErrTaskNotExist,
+		ErrTaskNotRunning,
+		ErrTaskFinished,
+		ErrCallbackNotExist,
+		ErrLogNotExist,
+		ErrInvalidArgs,
+		ErrInvalidEnv,
+		ErrInvalidLimit,
+		ErrInvalidSuccessPolicy,
+		ErrInvalidCallbackUrl,
+		ErrInvalidRpcOption,
+		ErrInvalidGrpcOption,
+		ErrPathNotAllowed,
+		ErrBinNotAllowed,
+		ErrFileNotExist,
+		ErrScheduleNotSupported,
+		ErrTaskRunning,
+		ErrTaskNotFailed,
+		ErrInvalidTags,
+		ErrInvalidCursor,
+		ErrArchiveNotEnabled,
+		ErrStatsRangeTooLarge,
+		ErrUnauthorized,
+	} {
+		brokerErrors[err.Error()] = err
+	}
+}
+
+//broker返回的其他错误
+type BrokerError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *BrokerError) Error() string {
+	return fmt.Sprintf("broker error: status %d: %s", e.StatusCode, e.Message)
+}
+
+//把broker返回的错误信息转换成对应的错误
+func brokerError(statusCode int, message string) error {
+	if err, ok := brokerErrors[message]; ok {
+		return err
+	}
+	return &BrokerError{StatusCode: statusCode, Message: message}
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/phillihq/ktse/core"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+//读取脚本任务的完整输出,stream为stdout或stderr
+func (c *Client) Log(ctx context.Context, taskUuid string, stream string) (io.ReadCloser, error) {
+	v := url.Values{"uuid": {taskUuid}, "stream": {stream}}
+	resp, err := c.open(ctx, "GET", "/api/task/log", v)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+//读取脚本任务运行时序号大于after的输出行
+func (c *Client) LiveLogs(ctx context.Context, taskUuid string, after int64) ([]core.LogLine, error) {
+	var lines []core.LogLine
+	v := url.Values{"after": {strconv.FormatInt(after, 10)}}
+	err := c.call(ctx, "GET", "/api/task/"+url.PathEscape(taskUuid)+"/logs", v, true, &lines)
+	return lines, err
+}
+
+//持续读取脚本任务的输出,直到任务结束,ctx结束或fn返回错误
+func (c *Client) FollowLogs(ctx context.Context, taskUuid string, after int64, fn func(line *core.LogLine) error) error {
+	v := url.Values{"follow": {"1"}, "after": {strconv.FormatInt(after, 10)}}
+	resp, err := c.open(ctx, "GET", "/api/task/"+url.PathEscape(taskUuid)+"/logs", v)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	//解析Server-Sent Events,空行表示一个事件结束
+	var event, data string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		text := scanner.Text()
+		switch {
+		case strings.HasPrefix(text, "event: "):
+			event = strings.TrimPrefix(text, "event: ")
+		case strings.HasPrefix(text, "data: "):
+			data = strings.TrimPrefix(text, "data: ")
+		case len(text) == 0 && len(event) != 0:
+			switch event {
+			case "end":
+				return nil
+			case "error":
+				return brokerError(resp.StatusCode, data)
+			default:
+				line := new(core.LogLine)
+				if err = json.Unmarshal([]byte(data), line); err != nil {
+					return err
+				}
+				if err = fn(line); err != nil {
+					return err
+				}
+			}
+			event, data = "", ""
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return io.ErrUnexpectedEOF
+}
@@ -0,0 +1,269 @@
+package core
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/phillihq/ktse/logger"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	//管理接口的令牌请求头
+	AdminTokenHeader = "X-Ktse-Admin-Token"
+	//查看任务请求时替换敏感值
+	redactedValue = "******"
+)
+
+//名称包含这些字符串(不区分大小写)的请求头,查询参数和元数据在查看任务请求时隐藏
+var sensitiveNames = []string{"auth", "cookie", "token", "secret", "password", "passwd", "key", "signature", "credential", "session"}
+
+//校验管理接口的令牌,broker没有配置admin_token时不校验
+func (b *Broker) CheckAdminToken(token string) error {
+	if len(b.cfg.AdminToken) == 0 {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(b.cfg.AdminToken)) != 1 {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+func isSensitiveName(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range sensitiveNames {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactMap(m map[string]string, all bool) map[string]string {
+	if len(m) == 0 {
+		return m
+	}
+	vec := make(map[string]string, len(m))
+	for k, v := range m {
+		if all || isSensitiveName(k) {
+			v = redactedValue
+		}
+		vec[k] = v
+	}
+	return vec
+}
+
+//隐藏任务请求中可能包含密钥的内容:环境变量的值,标准输入,RPC的敏感请求头和查询参数,gRPC的敏感元数据
+func (r *TaskRequest) Redact() {
+	r.Env = redactMap(r.Env, true)
+	if len(r.Stdin) != 0 {
+		r.Stdin = redactedValue
+	}
+	if r.Rpc != nil {
+		rpc := *r.Rpc
+		rpc.Headers = redactMap(rpc.Headers, false)
+		rpc.Query = redactMap(rpc.Query, false)
+		r.Rpc = &rpc
+	}
+	if r.Grpc != nil {
+		grpc := *r.Grpc
+		grpc.Metadata = redactMap(grpc.Metadata, false)
+		r.Grpc = &grpc
+	}
+}
+
+//当前broker定时器中等待加入队列的任务:还没有到开始时间的定时任务和失败后等待重试的任务
+type ScheduledTask struct {
+	Uuid     string   `json:"uuid"`
+	TaskType string   `json:"task_type"`
+	BinName  string   `json:"bin_name"`
+	Tags     []string `json:"tags,omitempty"`
+	Index    int      `json:"index"`    //大于0表示等待第index次重试
+	RunTime  int64    `json:"run_time"` //加入队列的时间(毫秒时间戳)
+}
+
+//按加入队列的时间从早到晚返回,已经取消或删除的任务不返回
+func (b *Broker) ScheduledTasks(limit int) ([]*ScheduledTask, error) {
+	if b.timer == nil {
+		return nil, ErrScheduleNotSupported
+	}
+	if limit <= 0 {
+		limit = DefaultTaskListLimit
+	}
+	if limit > MaxTaskListLimit {
+		limit = MaxTaskListLimit
+	}
+	now := time.Now()
+	var tasks []*ScheduledTask
+	for _, entry := range b.timer.Entries() {
+		req, ok := entry.Arg.(*TaskRequest)
+		if !ok {
+			continue
+		}
+		tasks = append(tasks, &ScheduledTask{
+			Uuid:     req.Uuid,
+			TaskType: taskTypeName(req.TaskType),
+			BinName:  metricBinName(req),
+			Tags:     req.Tags,
+			Index:    req.Index,
+			RunTime:  now.Add(entry.Remain).UnixNano() / int64(time.Millisecond),
+		})
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].RunTime < tasks[j].RunTime
+	})
+	ret := []*ScheduledTask{}
+	for _, task := range tasks {
+		if len(ret) == limit {
+			break
+		}
+		if !b.isTaskCanceled(task.Uuid) {
+			ret = append(ret, task)
+		}
+	}
+	return ret, nil
+}
+
+//查询任务请求:已结束的任务从结果中读取,等待中的任务从队列中读取
+func (b *Broker) HandleTaskRequest(uuid string) (*TaskRequest, error) {
+	if len(uuid) == 0 {
+		return nil, ErrInvalidArgument
+	}
+	var result []interface{}
+	var err error
+	for _, key := range []string{fmt.Sprintf("r_%s", uuid), fmt.Sprintf("t_%s", uuid)} {
+		if b.IsCluster() {
+			result, err = b.redisClusterClient.HMGet(key, TaskRequestFields...).Result()
+		} else {
+			result, err = b.redisClient.HMGet(key, TaskRequestFields...).Result()
+		}
+		if err != nil {
+			logger.GetLogger().Errorln("Broker", "HandleTaskRequest", err.Error(), 0, "key", key)
+			return nil, err
+		}
+		if result[0] != nil {
+			return parseTaskRequest(result)
+		}
+	}
+	return nil, ErrTaskNotExist
+}
+
+//重新执行失败的任务,从第一次执行开始,不影响已经统计的失败数
+func (b *Broker) HandleTaskRetry(uuid string) error {
+	if len(uuid) == 0 {
+		return ErrInvalidArgument
+	}
+	reply, err := b.HandleTaskResult(uuid)
+	if err == ErrResultNotExist {
+		return ErrTaskNotFailed
+	}
+	if err != nil {
+		return err
+	}
+	if reply.IsSuccess == 1 {
+		return ErrTaskNotFailed
+	}
+	//结果还在失败队列中,由HandleFailTask决定是否自动重试
+	var waiting bool
+	if b.IsCluster() {
+		waiting, err = b.redisClusterClient.SIsMember(FailResultUuidSet, uuid).Result()
+	} else {
+		waiting, err = b.redisClient.SIsMember(FailResultUuidSet, uuid).Result()
+	}
+	if err != nil {
+		return err
+	}
+	if waiting {
+		return ErrTaskNotFailed
+	}
+
+	request, err := b.HandleTaskRequest(uuid)
+	if err != nil {
+		return err
+	}
+	//保留已经执行的次数,重新执行不算作第一次执行,也不再记录排队时间
+	request.Attempt += request.Index + 1
+	request.Index = 0
+	request.StartTime = time.Now().Unix()
+	//删除上一次执行的结果,进度,实时输出和取消标记
+	if err = b.deleteTaskKeys(fmt.Sprintf("r_%s", uuid), ProgressKey(uuid), LiveLogKey(uuid), CancelKey(uuid)); err != nil {
+		return err
+	}
+	return b.AddRequestToRedis(request)
+}
+
+//删除任务在redis中的所有数据,执行中的任务不能删除
+//定时任务和等待重试的任务保留取消标记,加入队列后不再执行
+func (b *Broker) HandleTaskPurge(uuid string) error {
+	if len(uuid) == 0 {
+		return ErrInvalidArgument
+	}
+	status, err := b.HandleTaskStatus(uuid)
+	if err != nil && err != ErrTaskNotExist {
+		return err
+	}
+	if err == nil && status.Status == TaskStatusRunning {
+		return ErrTaskRunning
+	}
+
+	sets := []string{RequestUuidSet, FailResultUuidSet}
+	if request, err := b.HandleTaskRequest(uuid); err == nil && request.Queue() != RequestUuidSet {
+		sets = append(sets, request.Queue())
+	}
+	for _, set := range sets {
+		if b.IsCluster() {
+			err = b.redisClusterClient.SRem(set, uuid).Err()
+		} else {
+			err = b.redisClient.SRem(set, uuid).Err()
+		}
+		if err != nil {
+			logger.GetLogger().Errorln("Broker", "HandleTaskPurge", err.Error(), 0, "set", set, "uuid", uuid)
+			return err
+		}
+	}
+	//未投递的回调不再投递
+	if b.IsCluster() {
+		err = b.redisClusterClient.ZRem(CallbackQueue, uuid).Err()
+	} else {
+		err = b.redisClient.ZRem(CallbackQueue, uuid).Err()
+	}
+	if err != nil {
+		logger.GetLogger().Errorln("Broker", "HandleTaskPurge", err.Error(), 0, "set", CallbackQueue, "uuid", uuid)
+		return err
+	}
+	if err = b.unindexTask(uuid); err != nil {
+		return err
+	}
+	err = b.deleteTaskKeys(fmt.Sprintf("t_%s", uuid), fmt.Sprintf("r_%s", uuid),
+		ProgressKey(uuid), LiveLogKey(uuid), CallbackKey(uuid))
+	if err != nil {
+		return err
+	}
+	if b.IsCluster() {
+		err = b.redisClusterClient.Set(CancelKey(uuid), "1", cancelKeepTime).Err()
+	} else {
+		err = b.redisClient.Set(CancelKey(uuid), "1", cancelKeepTime).Err()
+	}
+	if err != nil {
+		logger.GetLogger().Errorln("Broker", "HandleTaskPurge", err.Error(), 0, "key", CancelKey(uuid))
+	}
+	return err
+}
+
+//逐个删除,集群模式下各个key可能不在同一个slot
+func (b *Broker) deleteTaskKeys(keys ...string) error {
+	var err error
+	for _, key := range keys {
+		if b.IsCluster() {
+			err = b.redisClusterClient.Del(key).Err()
+		} else {
+			err = b.redisClient.Del(key).Err()
+		}
+		if err != nil {
+			logger.GetLogger().Errorln("Broker", "deleteTaskKeys", err.Error(), 0, "key", key)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+package core
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/phillihq/ktse/logger"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	archiveExt     = ".jsonl"
+	archiveGzipExt = ".jsonl.gz"
+	//前一天的文件超过该时间没有写入才压缩,避免与零点前后的写入冲突
+	archiveIdleTime       = time.Hour
+	DefaultArchiveLimit   = 100
+	MaxArchiveLimit       = 1000
+	archiveMaxRecordBytes = 64 * 1024 * 1024
+)
+
+//归档中的一次执行记录,包含请求参数,执行结果和时间
+type ArchiveRecord struct {
+	*TaskResult
+	Outcome     string `json:"outcome"`
+	ArchiveTime int64  `json:"archive_time"` //写入归档的时间(毫秒时间戳)
+}
+
+//归档查询条件,日期按天匹配归档目录,为零值表示不限制
+type ArchiveQuery struct {
+	Uuid    string
+	BinName string
+	Outcome string
+	Tag     string
+	From    time.Time
+	To      time.Time
+	Limit   int
+}
+
+func (q *ArchiveQuery) match(r *ArchiveRecord) bool {
+	if r.TaskResult == nil {
+		return false
+	}
+	if len(q.Uuid) != 0 && r.Uuid != q.Uuid {
+		return false
+	}
+	if len(q.BinName) != 0 && r.BinName != q.BinName {
+		return false
+	}
+	if len(q.Outcome) != 0 && r.Outcome != q.Outcome {
+		return false
+	}
+	if len(q.Tag) != 0 && !containsString(r.Tags, q.Tag) {
+		return false
+	}
+	return true
+}
+
+//任务执行记录的长期归档,与redis中结果的过期时间无关
+//按日期目录保存,每个worker写自己的文件:<dir>/<yyyymmdd>/<worker_id>.jsonl,前一天的文件压缩为.jsonl.gz
+//目录可以是多个worker和broker共享的存储
+type Archive struct {
+	dir  string
+	name string
+	lock sync.Mutex
+	date string
+	file *os.File
+}
+
+//name为写入的文件名,只查询时可以为空
+func NewArchive(dir string, name string) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	return &Archive{dir: dir, name: name}, nil
+}
+
+//追加一条执行记录,日期变化时切换到新的文件;请求参数中的密钥隐藏后再写入
+func (a *Archive) Append(result *TaskResult) error {
+	redacted := *result
+	redacted.TaskRequest.Redact()
+	record := &ArchiveRecord{
+		TaskResult:  &redacted,
+		Outcome:     taskOutcome(result),
+		ArchiveTime: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	date := time.Now().Format(logDateFormat)
+	if a.file == nil || a.date != date {
+		if a.file != nil {
+			a.file.Close()
+			a.file = nil
+		}
+		if err = os.MkdirAll(filepath.Join(a.dir, date), 0755); err != nil {
+			return err
+		}
+		path := filepath.Join(a.dir, date, a.name+archiveExt)
+		a.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		a.date = date
+	}
+	//一次写入整行,读取时跳过不完整的最后一行
+	_, err = a.file.Write(data)
+	return err
+}
+
+func (a *Archive) Close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+//归档的日期目录,从新到旧
+func (a *Archive) dates() ([]string, error) {
+	vec, err := ioutil.ReadDir(a.dir)
+	if err != nil {
+		return nil, err
+	}
+	var dates []string
+	for _, info := range vec {
+		if !info.IsDir() {
+			continue
+		}
+		if _, err := time.ParseInLocation(logDateFormat, info.Name(), time.Local); err != nil {
+			continue
+		}
+		dates = append(dates, info.Name())
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+	return dates, nil
+}
+
+//查询归档,结果按执行结束时间从新到旧排列
+func (a *Archive) Query(q *ArchiveQuery) ([]*ArchiveRecord, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultArchiveLimit
+	}
+	if limit > MaxArchiveLimit {
+		limit = MaxArchiveLimit
+	}
+	dates, err := a.dates()
+	if err != nil {
+		return nil, err
+	}
+	records := []*ArchiveRecord{}
+	for _, date := range dates {
+		if !q.From.IsZero() && date < q.From.Format(logDateFormat) {
+			break
+		}
+		if !q.To.IsZero() && date > q.To.Format(logDateFormat) {
+			continue
+		}
+		vec, err := a.queryDate(date, q)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(vec, func(i, j int) bool {
+			return vec[i].ExecEndTime > vec[j].ExecEndTime
+		})
+		records = append(records, vec...)
+		if len(records) >= limit {
+			return records[:limit], nil
+		}
+	}
+	return records, nil
+}
+
+func (a *Archive) queryDate(date string, q *ArchiveQuery) ([]*ArchiveRecord, error) {
+	vec, err := ioutil.ReadDir(filepath.Join(a.dir, date))
+	if err != nil {
+		return nil, err
+	}
+	var records []*ArchiveRecord
+	for _, info := range vec {
+		name := info.Name()
+		if info.IsDir() || !(strings.HasSuffix(name, archiveExt) || strings.HasSuffix(name, archiveGzipExt)) {
+			continue
+		}
+		err = a.scanFile(filepath.Join(a.dir, date, name), func(r *ArchiveRecord) {
+			if q.match(r) {
+				records = append(records, r)
+			}
+		})
+		//文件可能刚被压缩后删除
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+func (a *Archive) scanFile(path string, fn func(*ArchiveRecord)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var reader io.Reader = f
+	if strings.HasSuffix(path, archiveGzipExt) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), archiveMaxRecordBytes)
+	for scanner.Scan() {
+		record := new(ArchiveRecord)
+		//正在写入的行不完整,跳过
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			continue
+		}
+		fn(record)
+	}
+	err = scanner.Err()
+	if err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}
+
+//压缩前一天的文件,删除keep之前的目录,keep为0时不删除
+func (a *Archive) Clean(keep time.Duration) error {
+	dates, err := a.dates()
+	if err != nil {
+		return err
+	}
+	today := time.Now().Format(logDateFormat)
+	expire := time.Now().Add(-keep)
+	for _, name := range dates {
+		if name == today {
+			continue
+		}
+		date, _ := time.ParseInLocation(logDateFormat, name, time.Local)
+		//目录中最晚的记录在第二天零点之前写入
+		if keep > 0 && date.AddDate(0, 0, 1).Before(expire) {
+			if err = os.RemoveAll(filepath.Join(a.dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = a.compressDate(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Archive) compressDate(date string) error {
+	vec, err := ioutil.ReadDir(filepath.Join(a.dir, date))
+	if err != nil {
+		return err
+	}
+	for _, info := range vec {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), archiveExt) {
+			continue
+		}
+		if time.Since(info.ModTime()) < archiveIdleTime {
+			continue
+		}
+		if err = compressFile(filepath.Join(a.dir, date, info.Name())); err != nil {
+			logger.GetLogger().Errorln("Archive", "compressDate", err.Error(), 0, "date", date, "file", info.Name())
+		}
+	}
+	return nil
+}
+
+//压缩为<path>.gz,先写临时文件再改名,最后删除原文件
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	dst.Close()
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+//查询任务执行的归档记录
+func (b *Broker) HandleArchiveQuery(q *ArchiveQuery) ([]*ArchiveRecord, error) {
+	if b.archive == nil {
+		return nil, ErrArchiveNotEnabled
+	}
+	records, err := b.archive.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	//升级前写入的记录没有隐藏密钥
+	for _, r := range records {
+		r.TaskRequest.Redact()
+	}
+	return records, nil
+}
+
+//写入执行记录,失败只记录日志,不影响结果
+func (w *Worker) archiveResult(result *TaskResult) {
+	if w.archive == nil {
+		return
+	}
+	if err := w.archive.Append(result); err != nil {
+		logger.GetLogger().Errorln("Worker", "archiveResult", err.Error(), 0, "uuid", result.Uuid)
+	}
+}
+
+//定期压缩和删除过期的归档
+func (w *Worker) CleanArchive() {
+	keep := time.Second * time.Duration(w.cfg.ArchiveKeepTime)
+	for w.running {
+		if err := w.archive.Clean(keep); err != nil {
+			logger.GetLogger().Errorln("Worker", "CleanArchive", err.Error(), 0)
+		}
+		time.Sleep(time.Hour)
+	}
+}
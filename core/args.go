@@ -0,0 +1,124 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+//按照shell的引号规则拆分参数字符串,不经过shell执行
+//支持单引号(原样保留),双引号(支持\" \\ \$ \`转义)和引号外的反斜杠转义,
+//连续的两个单引号或双引号表示一个空参数
+func SplitArgs(s string) ([]string, error) {
+	var args []string
+	var buf bytes.Buffer
+	//当前是否已经开始一个参数(用于保留空参数)
+	inArg := false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inArg {
+				args = append(args, buf.String())
+				buf.Reset()
+				inArg = false
+			}
+		case c == '\\':
+			if i+1 >= len(s) {
+				return nil, ErrInvalidArgs
+			}
+			i++
+			//反斜杠加换行表示续行
+			if s[i] != '\n' {
+				buf.WriteByte(s[i])
+				inArg = true
+			}
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, ErrInvalidArgs
+			}
+			buf.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inArg = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					switch s[i+1] {
+					case '"', '\\', '$', '`':
+						i++
+					case '\n':
+						i++
+						continue
+					}
+				}
+				buf.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, ErrInvalidArgs
+			}
+			inArg = true
+		default:
+			buf.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, buf.String())
+	}
+	if err := ValidateArgs(args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+//把参数列表拼接成可以被SplitArgs还原的字符串
+func QuoteArgs(args []string) string {
+	vec := make([]string, 0, len(args))
+	for _, arg := range args {
+		vec = append(vec, quoteArg(arg))
+	}
+	return strings.Join(vec, " ")
+}
+
+func quoteArg(arg string) string {
+	if len(arg) == 0 {
+		return "''"
+	}
+	if strings.IndexFunc(arg, needQuote) < 0 {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+func needQuote(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		strings.ContainsRune("-_./=:,+@%", r))
+}
+
+//解析JSON数组形式的参数列表
+func ParseArgList(s string) ([]string, error) {
+	var args []string
+	if err := json.Unmarshal([]byte(s), &args); err != nil {
+		return nil, ErrInvalidArgs
+	}
+	if args == nil {
+		args = []string{}
+	}
+	if err := ValidateArgs(args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+//校验参数,参数中不能包含NUL字符
+func ValidateArgs(args []string) error {
+	for _, arg := range args {
+		if strings.IndexByte(arg, 0) >= 0 {
+			return ErrInvalidArgs
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want []string
+		err  bool
+	}{
+		{"", nil, false},
+		{" \t\n ", nil, false},
+		{"a b  c", []string{"a", "b", "c"}, false},
+		{"a\tb\nc\r", []string{"a", "b", "c"}, false},
+		//单引号原样保留
+		{`'a b' 'c\d' '$x'`, []string{"a b", `c\d`, "$x"}, false},
+		{`'it'\''s'`, []string{"it's"}, false},
+		//双引号中的转义
+		{`"a b" "c\"d" "e\\f" "\$g" "\h"`, []string{"a b", `c"d`, `e\f`, "$g", `\h`}, false},
+		{"\"a\\\nb\"", []string{"ab"}, false},
+		//引号外的反斜杠转义和续行
+		{`a\ b c\'d`, []string{"a b", "c'd"}, false},
+		{"a\\\nb", []string{"ab"}, false},
+		//引号拼接成一个参数
+		{`a'b c'"d e"f`, []string{"ab cd ef"}, false},
+		//空参数
+		{`'' ""`, []string{"", ""}, false},
+		{`a '' b`, []string{"a", "", "b"}, false},
+		//引号不匹配
+		{`'a`, nil, true},
+		{`"a`, nil, true},
+		{`"a\"`, nil, true},
+		{`a\`, nil, true},
+		//不能包含NUL字符
+		{"a\x00b", nil, true},
+	} {
+		got, err := SplitArgs(c.s)
+		if (err != nil) != c.err {
+			t.Errorf("SplitArgs(%q) error = %v", c.s, err)
+			continue
+		}
+		if err != nil && err != ErrInvalidArgs {
+			t.Errorf("SplitArgs(%q) error = %v, want ErrInvalidArgs", c.s, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("SplitArgs(%q) = %q, want %q", c.s, got, c.want)
+		}
+	}
+}
+
+func TestQuoteArgs(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"a", "-b=1", "c.txt"}, "a -b=1 c.txt"},
+		{[]string{""}, "''"},
+		{[]string{"a b"}, "'a b'"},
+		{[]string{"it's"}, `'it'\''s'`},
+		{[]string{"$HOME", "a;b"}, "'$HOME' 'a;b'"},
+	} {
+		if got := QuoteArgs(c.args); got != c.want {
+			t.Errorf("QuoteArgs(%q) = %q, want %q", c.args, got, c.want)
+		}
+	}
+}
+
+//QuoteArgs的结果经过SplitArgs还原成原来的参数
+func TestQuoteArgsRoundTrip(t *testing.T) {
+	for _, args := range [][]string{
+		{"a"},
+		{"", ""},
+		{"a b", "c"},
+		{`'`, `"`, `\`, "''", `\'`},
+		{"$x", "`cmd`", "a\nb", "\t"},
+		{"中文 参数", "-o=a b"},
+	} {
+		got, err := SplitArgs(QuoteArgs(args))
+		if err != nil {
+			t.Errorf("SplitArgs(QuoteArgs(%q)) error = %v", args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, args) {
+			t.Errorf("SplitArgs(QuoteArgs(%q)) = %q", args, got)
+		}
+	}
+}
+
+func TestParseArgList(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want []string
+		err  bool
+	}{
+		{`[]`, []string{}, false},
+		{`null`, []string{}, false},
+		{`["a b", ""]`, []string{"a b", ""}, false},
+		{`["it's", "\"x\""]`, []string{"it's", `"x"`}, false},
+		{`"a b"`, nil, true},
+		{`[1, 2]`, nil, true},
+		{`["a"`, nil, true},
+		{`["a\u0000b"]`, nil, true},
+	} {
+		got, err := ParseArgList(c.s)
+		if (err != nil) != c.err {
+			t.Errorf("ParseArgList(%q) error = %v", c.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ParseArgList(%q) = %q, want %q", c.s, got, c.want)
+		}
+	}
+}
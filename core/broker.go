@@ -1,11 +1,19 @@
 package core
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/engine/standard"
 	"github.com/phillihq/ktse/logger"
+	"go.opentelemetry.io/otel/attribute"
 	"gopkg.in/redis.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -22,6 +30,11 @@ type Broker struct {
 	redisClusterClient *redis.ClusterClient
 	timer              *Timer
 	cluster            bool
+	manifest           *BinManifest
+	logStore           LogStore
+	archive            *Archive
+	notifier           *resultNotifier
+	traceShutdown      func(context.Context) error
 }
 
 func NewBroker(cfg *BrokerConfig, cluster bool) (*Broker, error) {
@@ -45,6 +58,40 @@ func NewBroker(cfg *BrokerConfig, cluster bool) (*Broker, error) {
 		broker.redisAddr = vec[0]
 		broker.redisDB = DefaultRedisDB
 	}
+	if len(cfg.BinManifest) != 0 {
+		broker.manifest, err = LoadBinManifest(cfg.BinManifest)
+		if err != nil {
+			logger.GetLogger().Errorln("broker", "NewBroker", "load bin manifest fail", 0, "err", err.Error())
+			return nil, err
+		}
+	}
+
+	if len(cfg.LogStore) != 0 {
+		broker.logStore, err = NewLogStore(cfg.LogStore)
+		if err != nil {
+			logger.GetLogger().Errorln("broker", "NewBroker", "create log store fail", 0, "err", err.Error())
+			return nil, err
+		}
+	}
+
+	if len(cfg.ArchivePath) != 0 {
+		broker.archive, err = NewArchive(cfg.ArchivePath, "")
+		if err != nil {
+			logger.GetLogger().Errorln("broker", "NewBroker", "create archive fail", 0, "err", err.Error())
+			return nil, err
+		}
+	}
+
+	if len(cfg.TraceEndpoint) != 0 {
+		hostname, _ := os.Hostname()
+		broker.traceShutdown, err = InitTracer(cfg.TraceEndpoint, "ktse-broker", hostname+cfg.Port)
+		if err != nil {
+			logger.GetLogger().Errorln("broker", "NewBroker", "init tracer fail", 0, "err", err.Error())
+			return nil, err
+		}
+	}
+
+	broker.notifier = newResultNotifier()
 	broker.web = echo.New()
 	broker.timer = NewT(time.Millisecond * 10)
 	go broker.timer.Start()
@@ -76,19 +123,75 @@ func NewBroker(cfg *BrokerConfig, cluster bool) (*Broker, error) {
 	return broker, err
 }
 
+//只访问redis的broker,不提供web服务,也不处理定时任务和失败重试
+//用于客户端在broker不可用时直接提交立即执行的任务和查询结果
+func NewStoreBroker(redisAddr string, cluster bool) (*Broker, error) {
+	var err error
+	broker := new(Broker)
+	broker.cfg = &BrokerConfig{RedisAddr: redisAddr}
+
+	vec := strings.SplitN(redisAddr, "/", 2)
+	if len(vec) == 2 {
+		broker.redisAddr = vec[0]
+		broker.redisDB, err = strconv.Atoi(vec[1])
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		broker.redisAddr = vec[0]
+		broker.redisDB = DefaultRedisDB
+	}
+	broker.notifier = newResultNotifier()
+
+	broker.redisClient = redis.NewClient(
+		&redis.Options{
+			Addr:     broker.redisAddr,
+			Password: "",
+			DB:       int64(broker.redisDB),
+		},
+	)
+
+	broker.cluster = cluster
+	broker.redisClusterClient = redis.NewClusterClient(
+		&redis.ClusterOptions{
+			Addrs: []string{broker.redisAddr},
+		},
+	)
+
+	if broker.IsCluster() {
+		_, err = broker.redisClusterClient.Ping().Result()
+	} else {
+		_, err = broker.redisClient.Ping().Result()
+	}
+	if err != nil {
+		logger.GetLogger().Errorln("broker", "NewStoreBroker", "ping redis fail", 0, "err", err.Error())
+		return nil, err
+	}
+	return broker, nil
+}
+
 func (b *Broker) Run() {
 	b.running = true
 	b.RegisterMiddleware()
 	b.RegisterURL()
+	b.RegisterDashboard()
 	go b.HandleFailTask()
+	go b.TrimTaskIndex()
+	go b.runNotifier()
 	b.web.Run(standard.New(b.cfg.Port))
 }
 
 func (b *Broker) Close() {
 	b.running = false
+	b.notifier.Close()
 	b.redisClient.Close()
 	b.redisClusterClient.Close()
-	b.timer.Stop()
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	if b.traceShutdown != nil {
+		b.traceShutdown(context.Background())
+	}
 }
 
 //是否采用集群模式
@@ -105,17 +208,12 @@ func (b *Broker) HandleTaskResult(uuid string) (*Reply, error) {
 	var result []interface{}
 	var err error
 	if b.IsCluster() {
-		result, err = b.redisClusterClient.HMGet(key,
-			"is_success",
-			"result",
-		).Result()
+		result, err = b.redisClusterClient.HMGet(key, TaskResultFields...).Result()
 	} else {
-		result, err = b.redisClient.HMGet(key,
-			"is_success",
-			"result",
-		).Result()
+		result, err = b.redisClient.HMGet(key, TaskResultFields...).Result()
 	}
 	if err != nil {
+		observeRedisError("broker", "hmget", err)
 		logger.GetLogger().Errorln("Broker", "HandleTaskResult", err.Error(), 0, "req_key", key)
 		return nil, err
 	}
@@ -123,35 +221,164 @@ func (b *Broker) HandleTaskResult(uuid string) (*Reply, error) {
 	if result[0] == nil {
 		return nil, ErrResultNotExist
 	}
-	isSuccess, err := strconv.Atoi(result[0].(string))
+	reply, err := parseReply(result)
+	if err != nil || reply.IsSuccess == 1 {
+		return reply, err
+	}
+	finished, err := b.IsTaskFinished(uuid)
 	if err != nil {
 		return nil, err
 	}
-	ret := result[1].(string)
-	return &Reply{
-		IsResultExist: 1,
-		IsSuccess:     isSuccess,
-		Result:        ret,
-	}, nil
+	reply.Retrying = !finished
+	return reply, nil
 }
 
-//处理请求
-func (b *Broker) HandleRequest(request *TaskRequest) error {
+//校验脚本任务的可执行文件名
+func (b *Broker) CheckBinName(binName string) error {
+	if !ValidBinName(binName) {
+		return ErrPathNotAllowed
+	}
+	if b.manifest == nil {
+		return nil
+	}
+	_, ok, err := b.manifest.Lookup(binName)
+	if err != nil {
+		logger.GetLogger().Errorln("Broker", "CheckBinName", err.Error(), 0, "bin_name", binName)
+		return err
+	}
+	if !ok {
+		return ErrBinNotAllowed
+	}
+	return nil
+}
+
+//校验提交的任务请求,HTTP接口和客户端直接写入redis前都需要校验
+//脚本任务没有参数列表时按args解析,工作目录被规范化
+func (b *Broker) CheckTaskRequest(r *TaskRequest) error {
+	if len(r.BinName) == 0 {
+		return ErrInvalidArgument
+	}
+	if len(r.CallbackUrl) != 0 && !ValidCallbackUrl(r.CallbackUrl) {
+		return ErrInvalidCallbackUrl
+	}
+	if err := checkTags(r.Tags); err != nil {
+		return err
+	}
+	switch r.TaskType {
+	case ScriptTask:
+		return b.checkScriptRequest(r)
+	case RpcTaskGET, RpcTaskPOST, RpcTaskPUT, RpcTaskDELETE, RpcTaskPATCH, RpcTaskHEAD:
+		return r.Rpc.Check()
+	case GrpcTask:
+		if len(r.Args) != 0 && !json.Valid([]byte(r.Args)) {
+			return ErrInvalidArgs
+		}
+		return r.Grpc.Check()
+	case HandlerTask:
+		return nil
+	}
+	return ErrInvalidArgument
+}
+
+func (b *Broker) checkScriptRequest(r *TaskRequest) error {
+	if err := b.CheckBinName(r.BinName); err != nil {
+		return err
+	}
+	if r.ArgList == nil {
+		args, err := SplitArgs(r.Args)
+		if err != nil {
+			return err
+		}
+		if args == nil {
+			args = []string{}
+		}
+		r.ArgList = args
+	} else if err := ValidateArgs(r.ArgList); err != nil {
+		return err
+	}
+	for name, value := range r.Env {
+		if !validEnvName(name) || strings.IndexByte(value, 0) >= 0 {
+			return ErrInvalidEnv
+		}
+	}
+	if len(r.Cwd) != 0 {
+		cwd := path.Clean(r.Cwd)
+		if path.IsAbs(cwd) || cwd == ".." || strings.HasPrefix(cwd, "../") {
+			return ErrPathNotAllowed
+		}
+		r.Cwd = cwd
+	}
+	switch r.SuccessPolicy {
+	case "", SuccessPolicyExitCode, SuccessPolicyStderr:
+	default:
+		return ErrInvalidSuccessPolicy
+	}
+	if _, err := ParseSuccessCodes(r.SuccessCodes); err != nil {
+		return err
+	}
+	return nil
+}
+
+//获取任务的完整输出,没有保存完整输出时返回结果中的输出
+//返回的io.ReadCloser需要由调用者关闭
+func (b *Broker) HandleTaskLog(uuid string, stream string) (io.ReadCloser, error) {
+	if len(uuid) == 0 || (stream != "stdout" && stream != "stderr") {
+		return nil, ErrInvalidArgument
+	}
+	key := fmt.Sprintf("r_%s", uuid)
+	var result []interface{}
 	var err error
+	if b.IsCluster() {
+		result, err = b.redisClusterClient.HMGet(key, "uuid", stream, stream+"_ref").Result()
+	} else {
+		result, err = b.redisClient.HMGet(key, "uuid", stream, stream+"_ref").Result()
+	}
+	if err != nil {
+		logger.GetLogger().Errorln("Broker", "HandleTaskLog", err.Error(), 0, "req_key", key)
+		return nil, err
+	}
+	//key不存在
+	if result[0] == nil {
+		return nil, ErrResultNotExist
+	}
+	ref := hashString(result[2])
+	if len(ref) == 0 || b.logStore == nil {
+		return ioutil.NopCloser(strings.NewReader(hashString(result[1]))), nil
+	}
+	return b.logStore.Open(ref)
+}
+
+//处理请求
+func (b *Broker) HandleRequest(request *TaskRequest) (err error) {
+	//之后的span都以提交任务的span为父span
+	ctx, span := startTaskSpan(context.Background(), request, "Broker.HandleRequest")
+	defer func() {
+		spanError(span, err)
+		span.End()
+	}()
+	request.TraceParent = TraceParent(ctx)
 	now := time.Now().Unix()
 	if request.StartTime == 0 {
 		request.StartTime = now
 	}
 	if request.StartTime <= now {
+		//索引失败不影响提交
+		b.indexTask(request, TaskStatusPending)
 		err = b.AddRequestToRedis(request) //把任务信息添加到redis
 		if err != nil {
 			return err
 		}
 	} else {
+		//只访问redis的broker没有定时器
+		if b.timer == nil {
+			return ErrScheduleNotSupported
+		}
+		b.indexTask(request, TaskStateScheduled)
 		afterTime := time.Second * time.Duration(request.StartTime-now)
 		//根据调度时间,把任务信息添加到redis
 		b.timer.NewTimer(afterTime, b.AddRequestToRedis, request)
 	}
+	observeTaskSubmitted(request)
 	return nil
 }
 
@@ -172,56 +399,23 @@ func (b *Broker) HandleFailTask() error {
 			continue
 		}
 		if err != nil {
+			observeRedisError("broker", "spop", err)
 			logger.GetLogger().Errorln("Broker", "HandleFailTask", "spop error", 0, "error", err.Error())
 			continue
 		}
 
 		key := fmt.Sprintf("r_%s", uuid)
 
-		var timeInterval string
-		var err error
-
-		if b.IsCluster() {
-			timeInterval, err = b.redisClusterClient.HGet(key, "time_interval").Result()
-		} else {
-			timeInterval, err = b.redisClient.HGet(key, "time_interval").Result()
-		}
-
-		if err != nil {
-			logger.GetLogger().Errorln("Broker", "HandleFailTask", err.Error(), 0, "key", key)
-			continue
-		}
-
-		//没有超时重试机制
-		if len(timeInterval) == 0 {
-			b.SetFailTaskCount(fmt.Sprintf("t_%s", uuid))
-			continue
-		}
-
 		var results []interface{}
+		var err error
 
 		if b.IsCluster() {
-			results, err = b.redisClusterClient.HMGet(key,
-				"uuid",
-				"bin_name",
-				"args",
-				"start_time",
-				"time_interval",
-				"index",
-				"max_run_time",
-				"task_type").Result()
+			results, err = b.redisClusterClient.HMGet(key, TaskRequestFields...).Result()
 		} else {
-			results, err = b.redisClient.HMGet(key,
-				"uuid",
-				"bin_name",
-				"args",
-				"start_time",
-				"time_interval",
-				"index",
-				"max_run_time",
-				"task_type").Result()
+			results, err = b.redisClient.HMGet(key, TaskRequestFields...).Result()
 		}
 		if err != nil {
+			observeRedisError("broker", "hmget", err)
 			logger.GetLogger().Errorln("Broker", "HandleFailTask", err.Error(), 0, "key", key)
 			continue
 		}
@@ -230,99 +424,85 @@ func (b *Broker) HandleFailTask() error {
 			logger.GetLogger().Errorln("Broker", "HandleFailTask", "result expired", 0, "key", key)
 			continue
 		}
-
-		//删除结果
-		if b.IsCluster() {
-			_, err = b.redisClusterClient.Del(key).Result()
-		} else {
-			_, err = b.redisClient.Del(key).Result()
-		}
-
-		if err != nil {
-			logger.GetLogger().Errorln("Broker", "HandleFailTask", "delete result failed", 0, "key", key)
-		}
-		err = b.resetTaskRequest(results)
+		request, err := parseTaskRequest(results)
 		if err != nil {
 			logger.GetLogger().Errorln("Broker", "HandleFailTask", err.Error(), 0, "key", key)
-			b.SetFailTaskCount(fmt.Sprintf("t_%s", uuid))
+			continue
 		}
+		b.handleFailTask(key, request)
 	}
 	return nil
 }
 
-func (b *Broker) SetFailTaskCount(reqKey string) error {
-	failTaskKey := fmt.Sprintf(FailTaskKey, time.Now().Format(TimeFormat))
+//失败的任务重新加入队列,不再重试时统计为最终失败
+func (b *Broker) handleFailTask(key string, request *TaskRequest) {
+	_, span := startTaskSpan(context.Background(), request, "Broker.HandleFailTask")
+	defer span.End()
 
-	var count int64
-	var err error
-
-	if b.IsCluster() {
-		count, err = b.redisClusterClient.Incr(failTaskKey).Result()
-	} else {
-		count, err = b.redisClient.Incr(failTaskKey).Result()
+	//没有超时重试机制(旧版本worker会加入所有失败的任务),或者任务在失败后被取消,保留结果并统计为最终失败
+	if request.IsLastAttempt() || b.isTaskCanceled(request.Uuid) {
+		span.SetAttributes(attribute.Bool("ktse.task.retry", false))
+		b.finishFailTask(request)
+		return
 	}
+
+	//重试间隔无效时保留结果,回调和等待结果的请求仍然可以读取
+	afterTime, err := request.retryDelay()
+	span.SetAttributes(attribute.Bool("ktse.task.retry", err == nil))
 	if err != nil {
-		logger.GetLogger().Errorln("Worker", "SetFailTaskCount", "Incr", 0, "err", err.Error(), "req_key", reqKey)
-		return err
+		spanError(span, err)
+		logger.GetLogger().Errorln("Broker", "HandleFailTask", err.Error(), 0, "key", key)
+		b.finishFailTask(request)
+		return
 	}
 
-	//第一次设置该key
-	if count == 1 {
-		expireTime := time.Second * time.Duration(60*60*24*30)
-		if b.IsCluster() {
-			_, err = b.redisClusterClient.Expire(failTaskKey, expireTime).Result()
-		} else {
-			_, err = b.redisClient.Expire(failTaskKey, expireTime).Result()
-		}
-		if err != nil {
-			logger.GetLogger().Errorln("Worker", "SetFailTaskCount", "Expire", 0, "err", err.Error(), "req_key", reqKey)
-			return err
-		}
+	//删除结果和上一次执行的进度,等待重试期间不再显示为执行中
+	if err = b.deleteTaskKeys(key, ProgressKey(request.Uuid)); err != nil {
+		logger.GetLogger().Errorln("Broker", "HandleFailTask", "delete result failed", 0, "key", key)
 	}
-	return nil
+	b.resetTaskRequest(request, afterTime)
 }
 
-//把任务添加到队列中
-func (b *Broker) resetTaskRequest(args []interface{}) error {
-	var err error
-	if len(args) == 0 || len(args) != TaskRequestItemCount {
-		return ErrInvalidArgument
-	}
-	request := new(TaskRequest)
-	request.Uuid = args[0].(string)
-	request.BinName = args[1].(string)
-	request.Args = args[2].(string)
-	request.StartTime, err = strconv.ParseInt(args[3].(string), 10, 64)
-	if err != nil {
-		return err
-	}
-	request.TimeInterval = args[4].(string)
-	request.Index, err = strconv.Atoi(args[5].(string))
-	if err != nil {
-		return err
+//broker确定失败的任务不再重试:修改状态,统计为最终失败并投递回调
+func (b *Broker) finishFailTask(request *TaskRequest) {
+	state := TaskStateFailure
+	if b.isTaskCanceled(request.Uuid) {
+		state = TaskStateCanceled
+	}
+	b.setTaskState(request.Uuid, state)
+	b.countFinalFailure(request)
+	if err := b.PublishResult(request.Uuid); err != nil {
+		logger.GetLogger().Errorln("Broker", "finishFailTask", "publish result error", 0,
+			"uuid", request.Uuid, "err", err.Error())
+	}
+	if len(request.CallbackUrl) != 0 {
+		if err := b.addCallback(request); err != nil {
+			logger.GetLogger().Errorln("Broker", "finishFailTask", "add callback error", 0,
+				"uuid", request.Uuid, "err", err.Error())
+		}
 	}
-	request.MaxRunTime, err = strconv.ParseInt(args[6].(string), 10, 64)
-	if err != nil {
-		return err
+}
+
+//下一次重试前等待的时间
+func (r *TaskRequest) retryDelay() (time.Duration, error) {
+	vec := strings.Split(r.TimeInterval, " ")
+	if r.Index+1 >= len(vec) {
+		logger.GetLogger().Errorln("Broker", "HandleFailTask", "retry max time", 0, "key", fmt.Sprintf("t_%s", r.Uuid))
+		return 0, ErrTryMaxTimes
 	}
-	request.TaskType, err = strconv.Atoi(args[7].(string))
+	timeLater, err := strconv.Atoi(vec[r.Index+1])
 	if err != nil {
-		return err
+		return 0, err
 	}
-	vec := strings.Split(request.TimeInterval, " ")
+	return time.Second * time.Duration(timeLater), nil
+}
+
+//等待afterTime后把任务添加到队列中
+func (b *Broker) resetTaskRequest(request *TaskRequest, afterTime time.Duration) {
 	request.Index++
-	if request.Index < len(vec) {
-		timeLater, err := strconv.Atoi(vec[request.Index])
-		if err != nil {
-			return err
-		}
-		afterTime := time.Second * time.Duration(timeLater)
-		b.timer.NewTimer(afterTime, b.AddRequestToRedis, request)
-	} else {
-		logger.GetLogger().Errorln("Broker", "HandleFailTask", "retry max time", 0, "key", fmt.Sprintf("t_%s", request.Uuid))
-		return ErrTryMaxTimes
-	}
-	return nil
+	b.timer.NewTimer(afterTime, b.AddRequestToRedis, request)
+	b.setTaskState(request.Uuid, TaskStateRetrying)
+	observeTaskRetry(request)
 }
 
 func (b *Broker) AddRequestToRedis(tr interface{}) error {
@@ -330,54 +510,53 @@ func (b *Broker) AddRequestToRedis(tr interface{}) error {
 	if !ok {
 		return ErrInvalidArgument
 	}
+	_, span := startTaskSpan(context.Background(), r, "Broker.AddRequestToRedis")
+	defer span.End()
 	key := fmt.Sprintf("t_%s", r.Uuid)
+	pairs := r.redisPairs()
 
 	var err error
 	if b.IsCluster() {
-		setCmd := b.redisClusterClient.HMSet(key,
-			"uuid", r.Uuid,
-			"bin_name", r.BinName,
-			"args", r.Args,
-			"start_time", strconv.FormatInt(r.StartTime, 10),
-			"time_interval", r.TimeInterval,
-			"index", strconv.Itoa(r.Index),
-			"max_run_time", strconv.FormatInt(r.MaxRunTime, 10),
-			"task_type", strconv.Itoa(r.TaskType),
-		)
+		setCmd := b.redisClusterClient.HMSet(key, pairs[0], pairs[1], pairs[2:]...)
 		err = setCmd.Err()
 	} else {
-		setCmd := b.redisClient.HMSet(key,
-			"uuid", r.Uuid,
-			"bin_name", r.BinName,
-			"args", r.Args,
-			"start_time", strconv.FormatInt(r.StartTime, 10),
-			"time_interval", r.TimeInterval,
-			"index", strconv.Itoa(r.Index),
-			"max_run_time", strconv.FormatInt(r.MaxRunTime, 10),
-			"task_type", strconv.Itoa(r.TaskType),
-		)
+		setCmd := b.redisClient.HMSet(key, pairs[0], pairs[1], pairs[2:]...)
 		err = setCmd.Err()
 	}
 
 	if err != nil {
+		observeRedisError("broker", "hmset", err)
 		logger.GetLogger().Errorln("Broker", "AddRequestToRedis", "HMSET error", 0,
-			"set", RequestUuidSet,
+			"set", r.Queue(),
 			"uuid", r.Uuid,
 			"err", err.Error(),
 		)
 		return err
 	}
-	if b.IsCluster() {
-		saddCmd := b.redisClusterClient.SAdd(RequestUuidSet, r.Uuid)
-		err = saddCmd.Err()
-	} else {
-		saddCmd := b.redisClient.SAdd(RequestUuidSet, r.Uuid)
-		err = saddCmd.Err()
+	//加入队列前修改状态,避免覆盖worker设置的状态
+	b.setTaskState(r.Uuid, TaskStatusPending)
+	queue := r.Queue()
+	if queue != RequestUuidSet {
+		if b.IsCluster() {
+			err = b.redisClusterClient.SAdd(HandlerQueueSet, queue).Err()
+		} else {
+			err = b.redisClient.SAdd(HandlerQueueSet, queue).Err()
+		}
+	}
+	if err == nil {
+		if b.IsCluster() {
+			saddCmd := b.redisClusterClient.SAdd(queue, r.Uuid)
+			err = saddCmd.Err()
+		} else {
+			saddCmd := b.redisClient.SAdd(queue, r.Uuid)
+			err = saddCmd.Err()
+		}
 	}
 
 	if err != nil {
+		observeRedisError("broker", "sadd", err)
 		logger.GetLogger().Errorln("Broker", "AddRequestToRedis", "SADD error", 0,
-			"set", RequestUuidSet,
+			"set", queue,
 			"uuid", r.Uuid,
 			"err", err.Error(),
 		)
@@ -386,24 +565,55 @@ func (b *Broker) AddRequestToRedis(tr interface{}) error {
 	return nil
 }
 
-//获取未执行的任务数量
+//获取未执行的任务数量,包括所有处理函数队列
 func (b *Broker) GetUndoTaskCount() (int64, error) {
-
+	counts, err := b.GetQueueCounts()
+	if err != nil {
+		return 0, err
+	}
 	var count int64
-	var err error
+	for _, n := range counts {
+		count += n
+	}
+	return count, nil
+}
 
+//所有任务队列:request_uuid_set和出现过的处理函数队列
+func (b *Broker) Queues() ([]string, error) {
+	var queues []string
+	var err error
 	if b.IsCluster() {
-		count, err = b.redisClusterClient.SCard(RequestUuidSet).Result()
+		queues, err = b.redisClusterClient.SMembers(HandlerQueueSet).Result()
 	} else {
-		count, err = b.redisClient.SCard(RequestUuidSet).Result()
+		queues, err = b.redisClient.SMembers(HandlerQueueSet).Result()
 	}
-	if err == redis.Nil {
-		return 0, nil
+	if err != nil && err != redis.Nil {
+		return nil, err
 	}
+	sort.Strings(queues)
+	return append([]string{RequestUuidSet}, queues...), nil
+}
+
+//每个队列中等待执行的任务数
+func (b *Broker) GetQueueCounts() (map[string]int64, error) {
+	queues, err := b.Queues()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	return count, nil
+	counts := make(map[string]int64, len(queues))
+	for _, queue := range queues {
+		var count int64
+		if b.IsCluster() {
+			count, err = b.redisClusterClient.SCard(queue).Result()
+		} else {
+			count, err = b.redisClient.SCard(queue).Result()
+		}
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		counts[queue] = count
+	}
+	return counts, nil
 }
 
 //获取失败的任务数
@@ -0,0 +1,431 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/phillihq/ktse/logger"
+	"gopkg.in/redis.v3"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//等待投递的回调,score为下次投递的时间(秒)
+	CallbackQueue = "callback_queue"
+	//默认的重试间隔序列,单位为秒
+	DefaultCallbackInterval = "5 30 120 600 1800"
+	callbackTimeout         = time.Second * 10
+	callbackCheckInterval   = time.Second
+	//投递期间占用回调的时间,worker异常退出时超过该时间由其他worker重新投递
+	callbackLeaseTime = time.Second * 30
+	//broker没有配置result_keep_time时回调记录在重试结束后保留的时间
+	defaultCallbackKeepTime = time.Hour * 24
+	//回调记录中保存的请求体字段,入队时写入,不随结果过期
+	callbackPayloadField = "payload"
+	//回调请求头:任务uuid,时间戳(秒)和签名
+	//签名为HMAC-SHA256(callback_secret, 时间戳 + "." + 请求体)的十六进制,格式为sha256=<hex>
+	CallbackTimestampHeader = "X-Ktse-Timestamp"
+	CallbackSignatureHeader = "X-Ktse-Signature"
+)
+
+//回调投递状态
+const (
+	CallbackPending   = "pending"
+	CallbackDelivered = "delivered"
+	CallbackFailed    = "failed"
+)
+
+//回调的投递记录
+type CallbackStatus struct {
+	Url       string `json:"url"`
+	Status    string `json:"status"`
+	Attempts  int    `json:"attempts"`
+	LastTime  int64  `json:"last_time,omitempty"` //最后一次投递时间(毫秒时间戳)
+	LastError string `json:"last_error,omitempty"`
+	NextTime  int64  `json:"next_time,omitempty"` //下次投递时间(毫秒时间戳)
+}
+
+var CallbackStatusFields = []string{"url", "status", "attempts", "last_time", "last_error", "next_time"}
+
+//回调投递记录在redis中的key(hash)
+func CallbackKey(uuid string) string {
+	return fmt.Sprintf("cb_%s", uuid)
+}
+
+//回调地址只能是http或https
+func ValidCallbackUrl(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) != 0
+}
+
+//是否是最后一次执行,失败后不会再重试
+func (r *TaskRequest) IsLastAttempt() bool {
+	if len(r.TimeInterval) == 0 {
+		return true
+	}
+	return r.Index+1 >= len(strings.Split(r.TimeInterval, " "))
+}
+
+func (s *CallbackStatus) redisPairs() []string {
+	return []string{
+		"url", s.Url,
+		"status", s.Status,
+		"attempts", strconv.Itoa(s.Attempts),
+		"last_time", strconv.FormatInt(s.LastTime, 10),
+		"last_error", s.LastError,
+		"next_time", strconv.FormatInt(s.NextTime, 10),
+	}
+}
+
+//根据HMGET(CallbackStatusFields)的结果构造投递记录,没有回调时返回nil
+func parseCallbackStatus(result []interface{}) *CallbackStatus {
+	if len(result) != len(CallbackStatusFields) || result[0] == nil {
+		return nil
+	}
+	s := &CallbackStatus{
+		Url:       hashString(result[0]),
+		Status:    hashString(result[1]),
+		LastError: hashString(result[4]),
+	}
+	s.Attempts, _ = strconv.Atoi(hashString(result[2]))
+	s.LastTime, _ = strconv.ParseInt(hashString(result[3]), 10, 64)
+	s.NextTime, _ = strconv.ParseInt(hashString(result[5]), 10, 64)
+	return s
+}
+
+//到期时把回调的score改为租约结束时间,返回1表示当前worker获得投递权
+//ARGV[1]为当前时间,ARGV[2]为租约结束时间(秒),ARGV[3]为任务uuid
+const callbackClaimScript = `
+local score = redis.call('ZSCORE', KEYS[1], ARGV[3])
+if score and tonumber(score) <= tonumber(ARGV[1]) then
+	redis.call('ZADD', KEYS[1], ARGV[2], ARGV[3])
+	return 1
+end
+return 0
+`
+
+//回调的重试间隔
+func (w *Worker) callbackInterval() ([]int64, error) {
+	return parseCallbackInterval(w.cfg.CallbackInterval)
+}
+
+//解析空格分隔的重试间隔(秒),为空时使用默认值
+func parseCallbackInterval(str string) ([]int64, error) {
+	if len(str) == 0 {
+		str = DefaultCallbackInterval
+	}
+	var vec []int64
+	for _, s := range strings.Fields(str) {
+		interval, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || interval < 0 {
+			return nil, ErrInvalidArgument
+		}
+		vec = append(vec, interval)
+	}
+	return vec, nil
+}
+
+//回调记录的保存时间:全部重试完成后再保留result_keep_time
+func (w *Worker) callbackKeepTime() time.Duration {
+	intervals, _ := w.callbackInterval()
+	return callbackKeepTime(intervals, time.Second*time.Duration(w.cfg.ResultKeepTime))
+}
+
+//broker入队的回调记录的保存时间,按broker配置的callback_interval和result_keep_time计算
+//未配置result_keep_time时至少保留defaultCallbackKeepTime,避免worker开始投递前记录过期
+func (b *Broker) callbackKeepTime() time.Duration {
+	intervals, err := parseCallbackInterval(b.cfg.CallbackInterval)
+	if err != nil {
+		intervals, _ = parseCallbackInterval("")
+	}
+	keep := time.Second * time.Duration(b.cfg.ResultKeepTime)
+	if keep <= 0 {
+		keep = defaultCallbackKeepTime
+	}
+	return callbackKeepTime(intervals, keep)
+}
+
+func callbackKeepTime(intervals []int64, keep time.Duration) time.Duration {
+	for _, interval := range intervals {
+		keep += time.Second*time.Duration(interval) + callbackTimeout
+	}
+	return keep
+}
+
+//写入回调记录的命令,worker和broker共用
+type callbackCmdable interface {
+	HMGet(key string, fields ...string) *redis.SliceCmd
+	HSet(key, field, value string) *redis.BoolCmd
+	HMSet(key, field, value string, pairsKeysAndValues ...string) *redis.StatusCmd
+	Expire(key string, expiration time.Duration) *redis.BoolCmd
+	ZAdd(key string, members ...redis.Z) *redis.IntCmd
+}
+
+//任务结束后把回调加入投递队列,投递与任务执行相互独立
+//请求体在入队时生成并保存在回调记录中,重试时不依赖会过期的任务结果
+func (w *Worker) AddCallback(result *TaskResult) error {
+	if w.IsCluster() {
+		return addCallback(w.redisClusterClient, result.Uuid, result.CallbackUrl, w.callbackKeepTime())
+	}
+	return addCallback(w.redisClient, result.Uuid, result.CallbackUrl, w.callbackKeepTime())
+}
+
+//broker确定任务不再重试时投递回调,投递时按worker的配置更新保存时间
+func (b *Broker) addCallback(request *TaskRequest) error {
+	keep := b.callbackKeepTime()
+	if b.IsCluster() {
+		return addCallback(b.redisClusterClient, request.Uuid, request.CallbackUrl, keep)
+	}
+	return addCallback(b.redisClient, request.Uuid, request.CallbackUrl, keep)
+}
+
+func addCallback(c callbackCmdable, uuid string, callbackUrl string, keep time.Duration) error {
+	payload, err := callbackPayload(c, uuid)
+	if err != nil {
+		return err
+	}
+	status := &CallbackStatus{
+		Url:      callbackUrl,
+		Status:   CallbackPending,
+		NextTime: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	key := CallbackKey(uuid)
+	if err = c.HSet(key, callbackPayloadField, string(payload)).Err(); err != nil {
+		logger.GetLogger().Errorln("Callback", "addCallback", err.Error(), 0, "key", key)
+		return err
+	}
+	if err = writeCallbackStatus(c, uuid, status, keep); err != nil {
+		return err
+	}
+	z := redis.Z{Score: float64(time.Now().Unix()), Member: uuid}
+	return c.ZAdd(CallbackQueue, z).Err()
+}
+
+func (w *Worker) setCallbackStatus(uuid string, status *CallbackStatus) error {
+	if w.IsCluster() {
+		return writeCallbackStatus(w.redisClusterClient, uuid, status, w.callbackKeepTime())
+	}
+	return writeCallbackStatus(w.redisClient, uuid, status, w.callbackKeepTime())
+}
+
+func writeCallbackStatus(c callbackCmdable, uuid string, status *CallbackStatus, expire time.Duration) error {
+	key := CallbackKey(uuid)
+	pairs := status.redisPairs()
+	err := c.HMSet(key, pairs[0], pairs[1], pairs[2:]...).Err()
+	if err == nil {
+		err = c.Expire(key, expire).Err()
+	}
+	if err != nil {
+		logger.GetLogger().Errorln("Callback", "writeCallbackStatus", err.Error(), 0, "key", key)
+	}
+	return err
+}
+
+//投递到期的回调,多个worker通过租约竞争同一个回调,投递结束后才从队列中删除
+func (w *Worker) RunCallback() {
+	for w.running {
+		opt := redis.ZRangeByScore{
+			Min:   "-inf",
+			Max:   strconv.FormatInt(time.Now().Unix(), 10),
+			Count: 100,
+		}
+		var uuids []string
+		var err error
+		if w.IsCluster() {
+			uuids, err = w.redisClusterClient.ZRangeByScore(CallbackQueue, opt).Result()
+		} else {
+			uuids, err = w.redisClient.ZRangeByScore(CallbackQueue, opt).Result()
+		}
+		if err != nil && err != redis.Nil {
+			logger.GetLogger().Errorln("Worker", "RunCallback", err.Error(), 0)
+		}
+		for _, uuid := range uuids {
+			now := time.Now()
+			args := []string{
+				strconv.FormatInt(now.Unix(), 10),
+				strconv.FormatInt(now.Add(callbackLeaseTime).Unix(), 10),
+				uuid,
+			}
+			var n interface{}
+			if w.IsCluster() {
+				n, err = w.redisClusterClient.Eval(callbackClaimScript, []string{CallbackQueue}, args).Result()
+			} else {
+				n, err = w.redisClient.Eval(callbackClaimScript, []string{CallbackQueue}, args).Result()
+			}
+			if err != nil || n != int64(1) {
+				continue
+			}
+			w.deliverCallback(uuid)
+		}
+		if len(uuids) == 0 {
+			time.Sleep(callbackCheckInterval)
+		}
+	}
+}
+
+func (w *Worker) removeCallback(uuid string) {
+	var err error
+	if w.IsCluster() {
+		err = w.redisClusterClient.ZRem(CallbackQueue, uuid).Err()
+	} else {
+		err = w.redisClient.ZRem(CallbackQueue, uuid).Err()
+	}
+	if err != nil {
+		logger.GetLogger().Errorln("Worker", "removeCallback", err.Error(), 0, "key", CallbackKey(uuid))
+	}
+}
+
+//投递一次回调,失败时按照重试间隔更新队列中的投递时间
+//成功或不再重试时才从队列中删除,写入状态失败时等租约到期后重新投递
+func (w *Worker) deliverCallback(uuid string) {
+	key := CallbackKey(uuid)
+	fields := append(append([]string{}, CallbackStatusFields...), callbackPayloadField)
+	var result []interface{}
+	var err error
+	if w.IsCluster() {
+		result, err = w.redisClusterClient.HMGet(key, fields...).Result()
+	} else {
+		result, err = w.redisClient.HMGet(key, fields...).Result()
+	}
+	if err != nil {
+		logger.GetLogger().Errorln("Worker", "deliverCallback", err.Error(), 0, "key", key)
+		return
+	}
+	status := parseCallbackStatus(result[:len(CallbackStatusFields)])
+	payload := result[len(CallbackStatusFields)]
+	//投递记录已经过期或已经投递结束
+	if status == nil || payload == nil || status.Status != CallbackPending {
+		w.removeCallback(uuid)
+		return
+	}
+
+	status.Attempts++
+	status.LastTime = time.Now().UnixNano() / int64(time.Millisecond)
+	status.NextTime = 0
+	err = w.postCallback(uuid, status.Url, []byte(hashString(payload)))
+	if err == nil {
+		status.Status = CallbackDelivered
+		status.LastError = ""
+		if w.setCallbackStatus(uuid, status) == nil {
+			w.removeCallback(uuid)
+		}
+		return
+	}
+	status.LastError = err.Error()
+	logger.GetLogger().Errorln("Worker", "deliverCallback", err.Error(), 0, "key", key,
+		"url", status.Url, "attempts", status.Attempts)
+
+	intervals, err := w.callbackInterval()
+	if err != nil || status.Attempts > len(intervals) {
+		status.Status = CallbackFailed
+		if w.setCallbackStatus(uuid, status) == nil {
+			w.removeCallback(uuid)
+		}
+		return
+	}
+	next := time.Now().Add(time.Second * time.Duration(intervals[status.Attempts-1]))
+	status.NextTime = next.UnixNano() / int64(time.Millisecond)
+	if w.setCallbackStatus(uuid, status) != nil {
+		return
+	}
+	z := redis.Z{Score: float64(next.Unix()), Member: uuid}
+	if w.IsCluster() {
+		err = w.redisClusterClient.ZAdd(CallbackQueue, z).Err()
+	} else {
+		err = w.redisClient.ZAdd(CallbackQueue, z).Err()
+	}
+	if err != nil {
+		logger.GetLogger().Errorln("Worker", "deliverCallback", err.Error(), 0, "key", key)
+	}
+}
+
+//回调的请求体,与任务状态接口的返回相同
+func callbackPayload(c callbackCmdable, uuid string) ([]byte, error) {
+	key := fmt.Sprintf("r_%s", uuid)
+	result, err := c.HMGet(key, TaskResultFields...).Result()
+	if err != nil {
+		return nil, err
+	}
+	if result[0] == nil {
+		return nil, ErrResultNotExist
+	}
+	reply, err := parseReply(result)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&TaskStatus{
+		Uuid:     uuid,
+		Status:   TaskStatusFinished,
+		WorkerId: reply.WorkerId,
+		Progress: reply.Progress,
+		Result:   reply,
+	})
+}
+
+//发送保存的请求体,签名使用发送时的时间戳
+func (w *Worker) postCallback(uuid string, callbackUrl string, body []byte) error {
+	req, err := http.NewRequest("POST", callbackUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TaskUuidHeader, uuid)
+	req.Header.Set(CallbackTimestampHeader, timestamp)
+	if len(w.cfg.CallbackSecret) != 0 {
+		req.Header.Set(CallbackSignatureHeader, "sha256="+SignCallback(w.cfg.CallbackSecret, timestamp, body))
+	}
+	client, err := w.rpcClient(nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.callRpc(context.Background(), req, client, callbackTimeout)
+	if err != nil {
+		return err
+	}
+	//2xx表示接收成功
+	return resp.Check([][2]int{{200, 299}}, nil)
+}
+
+//计算回调请求的签名
+func SignCallback(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//查询任务回调的投递记录
+func (b *Broker) HandleTaskCallback(uuid string) (*CallbackStatus, error) {
+	if len(uuid) == 0 {
+		return nil, ErrInvalidArgument
+	}
+	var result []interface{}
+	var err error
+	if b.IsCluster() {
+		result, err = b.redisClusterClient.HMGet(CallbackKey(uuid), CallbackStatusFields...).Result()
+	} else {
+		result, err = b.redisClient.HMGet(CallbackKey(uuid), CallbackStatusFields...).Result()
+	}
+	if err != nil {
+		logger.GetLogger().Errorln("Broker", "HandleTaskCallback", err.Error(), 0, "key", CallbackKey(uuid))
+		return nil, err
+	}
+	status := parseCallbackStatus(result)
+	if status == nil {
+		return nil, ErrCallbackNotExist
+	}
+	return status, nil
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignCallback(t *testing.T) {
+	for _, c := range []struct {
+		secret    string
+		timestamp string
+		body      string
+		want      string
+	}{
+		{"secret", "1700000000", `{"uuid":"a"}`, "fc2027b26a0a79980c9348e96535089aeaf4b823aae80e7e39a3167d6af9e842"},
+		{"k", "1700000000", "", "5c2999a43333a6877f49c8003f235c4f6de40f85b1b7414b70bd470a8db53d97"},
+		{"", "0", "", "b849d5a581847b281957065739df36df2463d1977ea8d6e1e4e6cf33fadc68c3"},
+	} {
+		if got := SignCallback(c.secret, c.timestamp, []byte(c.body)); got != c.want {
+			t.Errorf("SignCallback(%q, %q, %q) = %s, want %s", c.secret, c.timestamp, c.body, got, c.want)
+		}
+	}
+}
+
+func TestIsLastAttempt(t *testing.T) {
+	for _, c := range []struct {
+		interval string
+		index    int
+		want     bool
+	}{
+		{"", 0, true},
+		{"0", 0, true},
+		{"0 5", 0, false},
+		{"0 5", 1, true},
+		{"0 5 30", 1, false},
+		{"0 5 30", 2, true},
+		{"0 5 30", 3, true},
+	} {
+		r := &TaskRequest{TimeInterval: c.interval, Index: c.index}
+		if got := r.IsLastAttempt(); got != c.want {
+			t.Errorf("IsLastAttempt(%q, %d) = %t, want %t", c.interval, c.index, got, c.want)
+		}
+		//与broker是否重试的判断一致
+		if _, err := r.retryDelay(); (err == ErrTryMaxTimes) != c.want {
+			t.Errorf("retryDelay(%q, %d) error = %v, IsLastAttempt = %t", c.interval, c.index, err, c.want)
+		}
+	}
+}
+
+func TestBrokerCallbackKeepTime(t *testing.T) {
+	//默认重试间隔共2555秒,每次投递另加超时时间
+	retry := time.Second*2555 + 5*callbackTimeout
+	for _, c := range []struct {
+		cfg  BrokerConfig
+		want time.Duration
+	}{
+		{BrokerConfig{}, retry + defaultCallbackKeepTime},
+		{BrokerConfig{ResultKeepTime: 1000}, retry + time.Second*1000},
+		{BrokerConfig{CallbackInterval: "10 20", ResultKeepTime: 60}, time.Second*90 + 2*callbackTimeout},
+		{BrokerConfig{CallbackInterval: "x"}, retry + defaultCallbackKeepTime},
+	} {
+		b := &Broker{cfg: &c.cfg}
+		if got := b.callbackKeepTime(); got != c.want {
+			t.Errorf("callbackKeepTime(%+v) = %v, want %v", c.cfg, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/phillihq/ktse/logger"
+	"time"
+)
+
+const (
+	//取消标记的保存时间,需要覆盖定时任务的等待时间和重试时间
+	cancelKeepTime = time.Hour * 24 * 30
+	//执行任务时检查取消标记的间隔
+	cancelCheckInterval = time.Second
+)
+
+//任务取消标记在redis中的key
+func CancelKey(uuid string) string {
+	return fmt.Sprintf("c_%s", uuid)
+}
+
+//取消任务:等待中的任务不再执行,执行中的任务被中断,失败的任务不再重试
+//还没有加入队列的定时任务在加入队列后取消
+func (b *Broker) HandleTaskCancel(uuid string) error {
+	if len(uuid) == 0 {
+		return ErrInvalidArgument
+	}
+	reply, err := b.HandleTaskResult(uuid)
+	if err == nil && reply.IsSuccess == 1 {
+		return ErrTaskFinished
+	}
+	if err != nil && err != ErrResultNotExist {
+		return err
+	}
+	if b.IsCluster() {
+		err = b.redisClusterClient.Set(CancelKey(uuid), "1", cancelKeepTime).Err()
+	} else {
+		err = b.redisClient.Set(CancelKey(uuid), "1", cancelKeepTime).Err()
+	}
+	if err != nil {
+		logger.GetLogger().Errorln("Broker", "HandleTaskCancel", err.Error(), 0, "key", CancelKey(uuid))
+	}
+	return err
+}
+
+func (b *Broker) isTaskCanceled(uuid string) bool {
+	var exist bool
+	if b.IsCluster() {
+		exist, _ = b.redisClusterClient.Exists(CancelKey(uuid)).Result()
+	} else {
+		exist, _ = b.redisClient.Exists(CancelKey(uuid)).Result()
+	}
+	return exist
+}
+
+//任务是否已经被取消,查询失败时按未取消处理
+func (w *Worker) IsTaskCanceled(uuid string) bool {
+	var exist bool
+	var err error
+	if w.IsCluster() {
+		exist, err = w.redisClusterClient.Exists(CancelKey(uuid)).Result()
+	} else {
+		exist, err = w.redisClient.Exists(CancelKey(uuid)).Result()
+	}
+	if err != nil {
+		observeRedisError("worker", "exists", err)
+		logger.GetLogger().Errorln("Worker", "IsTaskCanceled", err.Error(), 0, "key", CancelKey(uuid))
+	}
+	return exist
+}
+
+//任务执行期间定期检查取消标记,发现后中断任务
+func (w *Worker) watchCancel(ctx context.Context, uuid string, cancel context.CancelFunc) {
+	ticker := time.NewTicker(cancelCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if w.IsTaskCanceled(uuid) {
+				cancel()
+				return
+			}
+		}
+	}
+}
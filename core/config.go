@@ -10,6 +10,23 @@ type BrokerConfig struct {
 	RedisAddr string `yaml:"redis"`
 	LogPath   string `yaml:"log_path"`
 	LogLevel  string `yaml:"log_level"`
+	//可执行文件清单,配置后提交脚本任务时拒绝不在清单中的文件
+	BinManifest string `yaml:"bin_manifest"`
+	//任务完整输出的存储目录,需要与worker的log_store指向同一存储
+	LogStore string `yaml:"log_store"`
+	//任务列表索引的保存时间(秒),0表示默认30天
+	IndexKeepTime int64 `yaml:"index_keep_time"`
+	//任务执行记录的归档目录,需要与worker的archive_path指向同一存储
+	ArchivePath string `yaml:"archive_path"`
+	//OTLP/HTTP的trace导出地址,为空表示不导出
+	TraceEndpoint string `yaml:"trace_endpoint"`
+	//取消,重新执行,删除任务以及查看请求参数和归档需要在X-Ktse-Admin-Token请求头中携带的令牌,为空表示不校验
+	//上报进度的接口不校验令牌,知道uuid的调用方都可以修改执行中任务的进度
+	AdminToken string `yaml:"admin_token"`
+	//broker加入投递队列的回调(失败后被取消等)的重试间隔和保存时间,与worker的配置相同
+	//用于计算回调记录的保存时间,result_keep_time为0时在重试结束后保留一天
+	CallbackInterval string `yaml:"callback_interval"`
+	ResultKeepTime   int64  `yaml:"result_keep_time"`
 }
 
 type WorkerConfig struct {
@@ -20,6 +37,60 @@ type WorkerConfig struct {
 	Peroid         int64  `yaml:"peroid"`
 	ResultKeepTime int64  `yaml:"result_keep_time"`
 	TaskRunTime    int64  `yaml:"task_run_time"`
+	//任务可以设置的环境变量白名单和黑名单,支持通配符
+	EnvAllow []string `yaml:"env_allow"`
+	EnvDeny  []string `yaml:"env_deny"`
+	//worker标识,为空时使用主机名和进程号
+	WorkerId string `yaml:"worker_id"`
+	//脚本任务默认的成功策略(exit_code或stderr)和可接受的退出码
+	SuccessPolicy string `yaml:"success_policy"`
+	SuccessCodes  []int  `yaml:"success_codes"`
+	//超时或取消时发送SIGTERM后等待进程组退出的时间,超过后发送SIGKILL,单位为秒
+	KillGracePeriod int64 `yaml:"kill_grace_period"`
+	//脚本任务的默认资源限制,按可执行文件设置的资源限制,以及任务可以设置的上限
+	Limit    ResourceLimit            `yaml:"limit"`
+	BinLimit map[string]ResourceLimit `yaml:"bin_limit"`
+	LimitMax ResourceLimit            `yaml:"limit_max"`
+	//cgroup v2目录,内存和CPU配额需要配置,worker需要有该目录的写权限
+	CgroupPath string `yaml:"cgroup_path"`
+	//运行脚本的用户和用户组,为空表示使用worker的用户
+	RunUser  string `yaml:"run_user"`
+	RunGroup string `yaml:"run_group"`
+	//为每个任务创建私有的临时目录(通过TMPDIR传递),任务结束后删除
+	PrivateTmp bool   `yaml:"private_tmp"`
+	TmpPath    string `yaml:"tmp_path"`
+	//可执行文件清单,配置后只能执行清单中的文件,并在执行前校验sha256
+	BinManifest string `yaml:"bin_manifest"`
+	//结果中每个输出流保存的最大字节数,0表示默认值,负数表示不限制
+	OutputLimit int64 `yaml:"output_limit"`
+	//任务完整输出的存储目录和保存时间(秒),为空表示不保存完整输出
+	LogStore    string `yaml:"log_store"`
+	LogKeepTime int64  `yaml:"log_keep_time"`
+	//脚本运行时写入redis的实时输出行数,0表示默认值,负数表示关闭
+	LiveLogLines int64 `yaml:"live_log_lines"`
+	//回调请求的签名密钥,为空表示不签名;回调失败后的重试间隔(秒),空格分隔
+	CallbackSecret   string `yaml:"callback_secret"`
+	CallbackInterval string `yaml:"callback_interval"`
+	//RPC任务引用的认证信息和TLS配置,任务中只保存名称;是否允许任务跳过证书校验
+	RpcSecrets         map[string]RpcSecret    `yaml:"rpc_secrets"`
+	RpcTls             map[string]RpcTlsConfig `yaml:"rpc_tls"`
+	RpcAllowSkipVerify bool                    `yaml:"rpc_allow_skip_verify"`
+	//RPC任务默认的成功状态码,空格分隔,支持范围,为空表示只接受200
+	RpcSuccessStatus string `yaml:"rpc_success_status"`
+	//RPC任务的连接超时和等待响应头超时(秒),0表示连接超时使用默认值,不单独限制等待响应头的时间
+	RpcConnectTimeout int64 `yaml:"rpc_connect_timeout"`
+	RpcHeaderTimeout  int64 `yaml:"rpc_header_timeout"`
+	//RPC连接池中每个地址保留的空闲连接数,0表示默认值
+	RpcMaxIdleConns int `yaml:"rpc_max_idle_conns"`
+	//gRPC任务引用的接口定义(protoc --include_imports --descriptor_set_out生成的文件),任务中只保存名称
+	GrpcDescriptors map[string]string `yaml:"grpc_descriptors"`
+	//Prometheus指标的监听地址(如:9596),为空表示不开启
+	MetricsAddr string `yaml:"metrics_addr"`
+	//任务执行记录的归档目录和保存时间(秒),为空表示不归档,保存时间为0表示不删除
+	ArchivePath     string `yaml:"archive_path"`
+	ArchiveKeepTime int64  `yaml:"archive_keep_time"`
+	//OTLP/HTTP的trace导出地址,为空表示不导出
+	TraceEndpoint string `yaml:"trace_endpoint"`
 }
 
 func ParseBrokerConfigFile(filename string) (*BrokerConfig, error) {
@@ -1,18 +1,24 @@
 package core
 
 const (
-	DefaultRedisDB       = 0
-	TaskRequestItemCount = 6
-	RequestUuidSet       = "request_uuid_set"
-	FailResultUuidSet    = "fail_result_uuid_set"
-	TimeFormat           = "2006-01-02"
-	FailTaskKey          = "fail_task_count:%s"
-	SuccessTaskKey       = "success_task_count:%s"
-	TypeRequestTask      = 1
-	TypeGetTaskResult    = 2
-	TypeCloseConn        = 3
+	DefaultRedisDB    = 0
+	RequestUuidSet    = "request_uuid_set"
+	FailResultUuidSet = "fail_result_uuid_set"
+	//处理函数任务按名称进入单独的队列,只有注册了该处理函数的worker读取
+	HandlerQueuePrefix = "handler_uuid_set:"
+	//出现过的处理函数队列,用于统计积压任务
+	HandlerQueueSet   = "handler_queue_set"
+	TimeFormat        = "2006-01-02"
+	FailTaskKey       = "fail_task_count:%s"
+	SuccessTaskKey    = "success_task_count:%s"
+	TypeRequestTask   = 1
+	TypeGetTaskResult = 2
+	TypeCloseConn     = 3
 )
 
+// HMGET(TaskRequestFields)返回的字段数
+var TaskRequestItemCount = len(TaskRequestFields)
+
 const (
 	ResultNotExist = 0
 	ResultIsExist  = 1
@@ -0,0 +1,54 @@
+package core
+
+import (
+	"embed"
+	"github.com/labstack/echo"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+)
+
+//管理页面的静态文件,编译进程序,不依赖外部CDN
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+const DashboardPath = "/dashboard"
+
+//注册管理页面,与API使用相同的中间件
+func (b *Broker) RegisterDashboard() {
+	//页面中的相对路径以/dashboard/为基准
+	b.web.Get(DashboardPath, echo.HandlerFunc(func(c echo.Context) error {
+		return c.Redirect(http.StatusMovedPermanently, DashboardPath+"/")
+	}))
+	b.web.Get(DashboardPath+"/", echo.HandlerFunc(func(c echo.Context) error {
+		return serveDashboardFile(c, "index.html")
+	}))
+	fs.WalkDir(dashboardFiles, "dashboard", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		file := name[len("dashboard/"):]
+		b.web.Get(path.Join(DashboardPath, file), echo.HandlerFunc(func(c echo.Context) error {
+			return serveDashboardFile(c, file)
+		}))
+		return nil
+	})
+}
+
+func serveDashboardFile(c echo.Context, name string) error {
+	buf, err := dashboardFiles.ReadFile(path.Join("dashboard", name))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ErrFileNotExist.Error())
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	c.Response().Header().Set("Content-Type", contentType)
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	c.Response().WriteHeader(http.StatusOK)
+	_, err = c.Response().Write(buf)
+	return err
+}
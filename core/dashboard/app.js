@@ -0,0 +1,507 @@
+(function () {
+  "use strict";
+
+  var api = "../api/task";
+  var listApi = "../api/tasks";
+  var workersApi = "../api/workers";
+  var depthSamples = [];
+  var maxSamples = 120;
+  var currentUuid = "";
+  var logSource = null;
+
+  function $(id) {
+    return document.getElementById(id);
+  }
+
+  //broker出错时返回JSON字符串形式的错误信息
+  //broker配置了admin_token时管理接口返回401,输入令牌后在当前会话中保存并重新请求
+  var tokenDeclined = false;
+
+  function request(method, url, retried) {
+    var headers = {};
+    var token = sessionStorage.getItem("ktse-admin-token");
+    if (token) {
+      headers["X-Ktse-Admin-Token"] = token;
+    }
+    return fetch(url, { method: method, headers: headers, credentials: "same-origin" }).then(function (resp) {
+      var type = resp.headers.get("Content-Type") || "";
+      var body = type.indexOf("json") >= 0 ? resp.json() : resp.text();
+      return body.then(function (data) {
+        if (resp.status === 401 && !retried && !tokenDeclined) {
+          token = prompt("admin token");
+          if (token) {
+            sessionStorage.setItem("ktse-admin-token", token);
+            return request(method, url, true);
+          }
+          tokenDeclined = true;
+        }
+        if (!resp.ok) {
+          throw new Error(typeof data === "string" ? data : resp.statusText);
+        }
+        return data;
+      });
+    });
+  }
+
+  function get(path) {
+    return request("GET", api + path);
+  }
+
+  function post(path) {
+    return request("POST", api + path);
+  }
+
+  function pad(n) {
+    return n < 10 ? "0" + n : "" + n;
+  }
+
+  function formatDate(d) {
+    return d.getFullYear() + "-" + pad(d.getMonth() + 1) + "-" + pad(d.getDate());
+  }
+
+  function formatTime(ms) {
+    if (!ms) {
+      return "";
+    }
+    var d = new Date(ms);
+    return formatDate(d) + " " + pad(d.getHours()) + ":" + pad(d.getMinutes()) + ":" + pad(d.getSeconds());
+  }
+
+  function svg(tag, attrs, text) {
+    var el = document.createElementNS("http://www.w3.org/2000/svg", tag);
+    Object.keys(attrs).forEach(function (k) {
+      el.setAttribute(k, attrs[k]);
+    });
+    if (text !== undefined) {
+      el.textContent = text;
+    }
+    return el;
+  }
+
+  function clear(el) {
+    while (el.firstChild) {
+      el.removeChild(el.firstChild);
+    }
+  }
+
+  function drawDepth() {
+    var el = $("depth");
+    clear(el);
+    var w = 800, h = 160, top = 10, bottom = 20, left = 40;
+    var max = Math.max.apply(null, depthSamples.map(function (s) { return s.value; }).concat([1]));
+    el.appendChild(svg("text", { x: 0, y: top + 4, "class": "axis" }, max));
+    el.appendChild(svg("text", { x: 0, y: h - bottom, "class": "axis" }, 0));
+    el.appendChild(svg("line", { x1: left, y1: h - bottom, x2: w, y2: h - bottom, "class": "grid" }));
+    if (depthSamples.length < 2) {
+      return;
+    }
+    var step = (w - left) / (maxSamples - 1);
+    var points = depthSamples.map(function (s, i) {
+      var x = left + i * step;
+      var y = h - bottom - (s.value / max) * (h - top - bottom);
+      return x.toFixed(1) + "," + y.toFixed(1);
+    });
+    el.appendChild(svg("polyline", { points: points.join(" "), "class": "line" }));
+    el.appendChild(svg("text", { x: left, y: h - 4, "class": "axis" }, formatTime(depthSamples[0].time)));
+  }
+
+  function drawDaily(days) {
+    var el = $("daily");
+    clear(el);
+    var w = 800, h = 200, top = 10, bottom = 20, left = 40;
+    var max = Math.max.apply(null, days.map(function (d) { return d.success + d.failure; }).concat([1]));
+    el.appendChild(svg("text", { x: 0, y: top + 4, "class": "axis" }, max));
+    el.appendChild(svg("line", { x1: left, y1: h - bottom, x2: w, y2: h - bottom, "class": "grid" }));
+    var slot = (w - left) / days.length;
+    var barWidth = slot * 0.6;
+    days.forEach(function (d, i) {
+      var x = left + i * slot + (slot - barWidth) / 2;
+      var scale = (h - top - bottom) / max;
+      var okHeight = d.success * scale;
+      var failHeight = d.failure * scale;
+      var rate = d.success + d.failure ? (d.failure * 100 / (d.success + d.failure)).toFixed(1) + "%" : "-";
+      var ok = svg("rect", { x: x, y: h - bottom - okHeight, width: barWidth, height: okHeight, "class": "ok" });
+      ok.appendChild(svg("title", {}, d.date + " 成功 " + d.success + " 失败 " + d.failure + " 失败率 " + rate));
+      el.appendChild(ok);
+      el.appendChild(svg("rect", {
+        x: x, y: h - bottom - okHeight - failHeight, width: barWidth, height: failHeight, "class": "fail"
+      }));
+      el.appendChild(svg("text", { x: x, y: h - 4, "class": "axis" }, d.date.substring(5)));
+    });
+  }
+
+  function refreshPending() {
+    return get("/count/undo").then(function (count) {
+      $("pending").textContent = count;
+      depthSamples.push({ time: Date.now(), value: count });
+      if (depthSamples.length > maxSamples) {
+        depthSamples.shift();
+      }
+      drawDepth();
+    });
+  }
+
+  function refreshDaily() {
+    var dates = [];
+    var now = new Date();
+    for (var i = 13; i >= 0; i--) {
+      dates.push(formatDate(new Date(now.getFullYear(), now.getMonth(), now.getDate() - i)));
+    }
+    return Promise.all(dates.map(function (date) {
+      return Promise.all([get("/result/success/" + date), get("/result/failure/" + date)]).then(function (r) {
+        return { date: date, success: r[0], failure: r[1] };
+      });
+    })).then(function (days) {
+      var today = days[days.length - 1];
+      var total = today.success + today.failure;
+      $("success").textContent = today.success;
+      $("failure").textContent = today.failure;
+      $("rate").textContent = total ? (today.failure * 100 / total).toFixed(1) + "%" : "-";
+      drawDaily(days);
+    });
+  }
+
+  function refresh() {
+    Promise.all([refreshPending(), refreshDaily()]).then(function () {
+      $("updated").textContent = "更新于 " + formatTime(Date.now());
+    }, function (err) {
+      $("updated").textContent = "更新失败: " + err.message;
+    });
+  }
+
+  function fillFields(table, fields) {
+    clear(table);
+    fields.forEach(function (f) {
+      var v = f[1];
+      if (v === undefined || v === null || v === "") {
+        return;
+      }
+      if (typeof v === "object") {
+        v = JSON.stringify(v, null, 2);
+      }
+      var tr = document.createElement("tr");
+      var th = document.createElement("th");
+      var td = document.createElement("td");
+      th.textContent = f[0];
+      td.textContent = v;
+      tr.appendChild(th);
+      tr.appendChild(td);
+      table.appendChild(tr);
+    });
+  }
+
+  var taskTypes = { 1: "script", 2: "GET", 3: "POST", 4: "PUT", 5: "DELETE", 6: "PATCH", 7: "HEAD", 8: "grpc", 9: "handler" };
+
+  function showRequest(req) {
+    if (!req) {
+      fillFields($("request"), []);
+      return;
+    }
+    var attempts = req.time_interval ? req.time_interval.split(" ").length : 1;
+    fillFields($("request"), [
+      ["task_type", taskTypes[req.task_type] || req.task_type],
+      ["bin_name", req.bin_name],
+      ["args", req.arg_list ? req.arg_list : req.args],
+      ["start_time", formatTime(req.start_time * 1000)],
+      ["attempt", (parseInt(req.index, 10) + 1) + " / " + attempts],
+      ["time_interval", req.time_interval],
+      ["max_run_time", req.max_run_time !== "0" ? req.max_run_time : ""],
+      ["env", req.env],
+      ["cwd", req.cwd],
+      ["stdin", req.stdin],
+      ["success_policy", req.success_policy],
+      ["success_codes", req.success_codes],
+      ["limit", req.limit],
+      ["callback_url", req.callback_url],
+      ["tags", req.tags ? req.tags.join(" ") : ""],
+      ["rpc", req.rpc],
+      ["grpc", req.grpc]
+    ]);
+  }
+
+  function showStatus(status) {
+    var label = status.status;
+    var cls = status.status;
+    var r = status.result;
+    if (r) {
+      label = r.is_success === 1 ? "成功" : "失败";
+      cls = r.is_success === 1 ? "finished" : "failed";
+    }
+    $("task-status").textContent = label;
+    $("task-status").className = "status " + cls;
+    $("cancel").disabled = !!(r && r.is_success === 1);
+    $("retry").disabled = !(r && r.is_success !== 1);
+    $("purge").disabled = status.status === "running";
+    fillFields($("result"), r ? [
+      ["message", r.message],
+      ["worker_id", r.worker_id],
+      ["exec_start_time", formatTime(r.exec_start_time)],
+      ["exec_end_time", formatTime(r.exec_end_time)],
+      ["duration", r.duration ? r.duration + "ms" : ""],
+      ["exit_code", r.exit_code],
+      ["signal", r.signal],
+      ["http_status", r.http_status],
+      ["http_headers", r.http_headers],
+      ["http_body", r.http_body],
+      ["grpc_code", r.grpc_code],
+      ["grpc_message", r.grpc_message],
+      ["progress", r.progress ? r.progress.percent + "% " + r.progress.message : ""]
+    ] : [
+      ["worker_id", status.worker_id],
+      ["progress", status.progress ? status.progress.percent + "% " + status.progress.message : ""]
+    ]);
+    fillFields($("callback"), status.callback ? [
+      ["url", status.callback.url],
+      ["status", status.callback.status],
+      ["attempts", status.callback.attempts],
+      ["last_time", formatTime(status.callback.last_time)],
+      ["last_error", status.callback.last_error],
+      ["next_time", formatTime(status.callback.next_time)]
+    ] : []);
+  }
+
+  function stopLog() {
+    if (logSource) {
+      logSource.close();
+      logSource = null;
+    }
+  }
+
+  function appendLog(stream, text) {
+    var span = document.createElement("span");
+    span.className = stream;
+    span.textContent = text + "\n";
+    $("log").appendChild(span);
+    $("log").scrollTop = $("log").scrollHeight;
+  }
+
+  //执行中的任务跟踪实时输出,结束的任务读取完整输出
+  function showLog(status) {
+    stopLog();
+    clear($("log"));
+    var uuid = status.uuid;
+    if (status.status === "running" && window.EventSource) {
+      logSource = new EventSource(api + "/" + encodeURIComponent(uuid) + "/logs?follow=1");
+      ["stdout", "stderr"].forEach(function (stream) {
+        logSource.addEventListener(stream, function (e) {
+          appendLog(stream, JSON.parse(e.data).line);
+        });
+      });
+      logSource.addEventListener("end", function () {
+        stopLog();
+        if (uuid === currentUuid) {
+          lookup(uuid);
+        }
+      });
+      logSource.addEventListener("error", stopLog);
+      return;
+    }
+    if (status.status !== "finished") {
+      return;
+    }
+    var stream = $("stream").value;
+    request("GET", api + "/log?uuid=" + encodeURIComponent(uuid) + "&stream=" + stream).then(function (text) {
+      appendLog(stream, text);
+    }, function (err) {
+      appendLog("stderr", err.message);
+    });
+  }
+
+  function rememberUuid(uuid) {
+    var recent = JSON.parse(localStorage.getItem("ktse_recent") || "[]").filter(function (u) {
+      return u !== uuid;
+    });
+    recent.unshift(uuid);
+    localStorage.setItem("ktse_recent", JSON.stringify(recent.slice(0, 10)));
+    showRecent();
+  }
+
+  function showRecent() {
+    var list = $("recent");
+    clear(list);
+    JSON.parse(localStorage.getItem("ktse_recent") || "[]").forEach(function (uuid) {
+      var li = document.createElement("li");
+      li.textContent = uuid;
+      li.onclick = function () {
+        $("uuid").value = uuid;
+        lookup(uuid);
+      };
+      list.appendChild(li);
+    });
+  }
+
+  function lookup(uuid) {
+    currentUuid = uuid;
+    $("action-msg").textContent = "";
+    return Promise.all([
+      get("/status?uuid=" + encodeURIComponent(uuid)),
+      get("/request?uuid=" + encodeURIComponent(uuid)).catch(function () { return null; })
+    ]).then(function (r) {
+      $("task").hidden = false;
+      rememberUuid(uuid);
+      showStatus(r[0]);
+      showRequest(r[1]);
+      showLog(r[0]);
+    }, function (err) {
+      $("task").hidden = true;
+      stopLog();
+      alert(uuid + ": " + err.message);
+    });
+  }
+
+  var listCursor = "";
+
+  function listQuery() {
+    var params = [];
+    var fields = { state: "q-state", task_type: "q-type", bin_name: "q-bin", tags: "q-tags" };
+    Object.keys(fields).forEach(function (name) {
+      var v = $(fields[name]).value.trim();
+      if (v) {
+        params.push(name + "=" + encodeURIComponent(v));
+      }
+    });
+    var since = $("q-since").value;
+    if (since) {
+      var finished = since.charAt(0) === "f";
+      var seconds = parseInt(finished ? since.substring(1) : since, 10);
+      var after = Math.floor(Date.now() / 1000) - seconds;
+      params.push((finished ? "finished_after=" : "submitted_after=") + after);
+    }
+    if (listCursor) {
+      params.push("cursor=" + encodeURIComponent(listCursor));
+    }
+    return params.join("&");
+  }
+
+  function cell(tr, text, cls) {
+    var td = document.createElement("td");
+    td.textContent = text || "";
+    if (cls) {
+      td.className = cls;
+    }
+    tr.appendChild(td);
+    return td;
+  }
+
+  function showTask(uuid) {
+    return function () {
+      $("uuid").value = uuid;
+      lookup(uuid);
+    };
+  }
+
+  function refreshWorkers() {
+    request("GET", workersApi).then(function (workers) {
+      var body = $("workers").tBodies[0];
+      clear(body);
+      workers.forEach(function (w) {
+        var tr = document.createElement("tr");
+        cell(tr, w.id);
+        cell(tr, w.host);
+        cell(tr, String(w.pid));
+        cell(tr, w.queues.join(" "));
+        var current = cell(tr, w.current_task);
+        if (w.current_task) {
+          current.onclick = showTask(w.current_task);
+        }
+        cell(tr, formatTime(w.start_time));
+        cell(tr, formatTime(w.heartbeat));
+        body.appendChild(tr);
+      });
+    }, function () {});
+  }
+
+  function refreshScheduled() {
+    request("GET", listApi + "/scheduled?limit=100").then(function (tasks) {
+      var body = $("scheduled").tBodies[0];
+      clear(body);
+      tasks.forEach(function (task) {
+        var tr = document.createElement("tr");
+        cell(tr, task.uuid).onclick = showTask(task.uuid);
+        cell(tr, task.task_type);
+        cell(tr, task.bin_name);
+        cell(tr, (task.tags || []).join(" "));
+        cell(tr, task.index ? String(task.index) : "");
+        cell(tr, formatTime(task.run_time));
+        body.appendChild(tr);
+      });
+    }, function () {});
+  }
+
+  //append为false时重新查询第一页
+  function search(append) {
+    if (!append) {
+      listCursor = "";
+      clear($("tasks").tBodies[0]);
+    }
+    request("GET", listApi + "?" + listQuery()).then(function (list) {
+      var body = $("tasks").tBodies[0];
+      list.tasks.forEach(function (task) {
+        var tr = document.createElement("tr");
+        cell(tr, task.uuid).onclick = showTask(task.uuid);
+        cell(tr, task.state, task.state);
+        cell(tr, task.task_type);
+        cell(tr, task.bin_name);
+        cell(tr, (task.tags || []).join(" "));
+        cell(tr, formatTime(task.submit_time));
+        cell(tr, formatTime(task.finish_time));
+        body.appendChild(tr);
+      });
+      listCursor = list.next_cursor || "";
+      $("more").hidden = !listCursor;
+    }, function (err) {
+      alert(err.message);
+    });
+  }
+
+  function action(path, confirmText) {
+    return function () {
+      var uuid = currentUuid;
+      if (confirmText && !confirm(confirmText + "\n" + uuid)) {
+        return;
+      }
+      post(path + "?uuid=" + encodeURIComponent(uuid)).then(function () {
+        $("action-msg").textContent = "已提交";
+        setTimeout(function () {
+          lookup(uuid).catch(function () {});
+        }, 1000);
+      }, function (err) {
+        $("action-msg").textContent = err.message;
+      });
+    };
+  }
+
+  $("lookup").onsubmit = function (e) {
+    e.preventDefault();
+    var uuid = $("uuid").value.trim();
+    if (uuid) {
+      lookup(uuid);
+    }
+  };
+  $("search").onsubmit = function (e) {
+    e.preventDefault();
+    search(false);
+  };
+  $("more").onclick = function () {
+    search(true);
+  };
+  $("stream").onchange = function () {
+    if (currentUuid) {
+      lookup(currentUuid);
+    }
+  };
+  $("cancel").onclick = action("/cancel", "取消任务?");
+  $("retry").onclick = action("/retry");
+  $("purge").onclick = action("/purge", "删除任务的所有数据?");
+
+  $("scheduled-refresh").onclick = refreshScheduled;
+
+  showRecent();
+  search(false);
+  refresh();
+  refreshWorkers();
+  refreshScheduled();
+  setInterval(refreshWorkers, 10000);
+  setInterval(refreshPending, 5000);
+  setInterval(refreshDaily, 60000);
+})();
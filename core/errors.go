@@ -16,4 +16,46 @@ var (
 	ErrBadConn         = errors.New("bad net connection")
 	ErrResultNotExist  = errors.New("result not exist")
 	ErrExecTimeout     = errors.New("exec time out")
+	ErrInvalidArgs     = errors.New("invalid task args")
+	ErrInvalidEnv      = errors.New("invalid task env")
+	ErrEnvNotAllowed   = errors.New("task env not allowed")
+	ErrPathNotAllowed  = errors.New("path not allowed")
+
+	ErrInvalidSuccessPolicy = errors.New("invalid success policy")
+	ErrTaskCanceled         = errors.New("task canceled")
+	ErrProcessGroupAlive    = errors.New("process group still alive after kill")
+	ErrInvalidLimit         = errors.New("invalid resource limit")
+	ErrSandboxNotSupported  = errors.New("resource limit not supported on this platform")
+	ErrCgroupNotConfigured  = errors.New("cgroup path not configured")
+	ErrSandboxNotInit       = errors.New("sandbox not initialized, call SandboxInit in main")
+	ErrCgroupRoot           = errors.New("cgroup path must not be the cgroup root")
+	ErrBinNotAllowed        = errors.New("bin not allowed")
+	ErrChecksumMismatch     = errors.New("bin checksum mismatch")
+	ErrInvalidLogStore      = errors.New("invalid log store")
+	ErrLogNotExist          = errors.New("log not exist")
+	ErrStreamNotSupported   = errors.New("stream not supported")
+	ErrTaskNotExist         = errors.New("task not exist")
+	ErrTaskNotRunning       = errors.New("task not running")
+	ErrInvalidCallbackUrl   = errors.New("invalid callback url")
+	ErrCallbackNotExist     = errors.New("callback not exist")
+	ErrInvalidRpcOption     = errors.New("invalid rpc option")
+	ErrSecretNotExist       = errors.New("secret not exist")
+	ErrTlsNotExist          = errors.New("tls config not exist")
+	ErrInvalidCert          = errors.New("invalid certificate")
+	ErrSkipVerifyNotAllowed = errors.New("skip verify not allowed")
+	ErrBodyNotMatch         = errors.New("response body not match")
+	ErrInvalidGrpcOption    = errors.New("invalid grpc option")
+	ErrDescriptorNotExist   = errors.New("grpc descriptor not exist")
+	ErrGrpcMethodNotFound   = errors.New("grpc method not found")
+	ErrGrpcStreaming        = errors.New("grpc streaming method not supported")
+	ErrHandlerNotExist      = errors.New("handler not exist")
+	ErrTaskFinished         = errors.New("task already finished")
+	ErrScheduleNotSupported = errors.New("scheduled task not supported")
+	ErrTaskRunning          = errors.New("task is running")
+	ErrTaskNotFailed        = errors.New("task not failed")
+	ErrInvalidTags          = errors.New("invalid tags")
+	ErrInvalidCursor        = errors.New("invalid cursor")
+	ErrArchiveNotEnabled    = errors.New("archive not enabled")
+	ErrStatsRangeTooLarge   = errors.New("stats range too large")
+	ErrUnauthorized         = errors.New("unauthorized")
 )
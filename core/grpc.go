@@ -0,0 +1,368 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/phillihq/ktse/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	rpbalpha "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+//gRPC任务的附加参数,任务的bin_name为服务地址,args为JSON格式的请求消息
+type GrpcOption struct {
+	Method   string            `json:"method"` //完整方法名,例如package.Service/Method
+	Metadata map[string]string `json:"metadata,omitempty"`
+	//worker配置grpc_descriptors中的名称,为空时通过服务端反射获取接口定义
+	Descriptor string `json:"descriptor,omitempty"`
+	//worker配置rpc_tls中的名称,没有TLS选项时使用明文连接
+	Tls        string `json:"tls,omitempty"`
+	SkipVerify bool   `json:"skip_verify,omitempty"`
+	//成功的状态码,空格分隔,支持名称和数字,例如"OK NOT_FOUND",为空表示只接受OK
+	SuccessCodes string `json:"success_codes,omitempty"`
+}
+
+//gRPC调用的结果,Body为JSON格式的响应消息,最多保存output_limit字节
+type GrpcResponse struct {
+	Code    codes.Code
+	Message string
+	Body    string
+}
+
+//检查gRPC任务的参数
+func (o *GrpcOption) Check() error {
+	if o == nil {
+		return ErrInvalidGrpcOption
+	}
+	if _, _, ok := splitGrpcMethod(o.Method); !ok {
+		return ErrInvalidGrpcOption
+	}
+	for name := range o.Metadata {
+		//grpc-开头的是协议保留的元数据
+		if !validHeaderName(name) || strings.HasPrefix(strings.ToLower(name), "grpc-") {
+			return ErrInvalidGrpcOption
+		}
+	}
+	if _, err := ParseGrpcCodes(o.SuccessCodes); err != nil {
+		return err
+	}
+	return nil
+}
+
+//把完整方法名拆分成服务名和方法名,支持/package.Service/Method的形式
+func splitGrpcMethod(name string) (string, string, bool) {
+	name = strings.TrimPrefix(name, "/")
+	i := strings.LastIndex(name, "/")
+	if i <= 0 || i == len(name)-1 {
+		return "", "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+//解析空格分隔的状态码,为空时只接受OK
+func ParseGrpcCodes(s string) ([]codes.Code, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return []codes.Code{codes.OK}, nil
+	}
+	var vec []codes.Code
+	for _, field := range fields {
+		var code codes.Code
+		//UnmarshalJSON支持数字和"NOT_FOUND"形式的名称
+		if _, err := strconv.Atoi(field); err != nil {
+			field = strconv.Quote(strings.ToUpper(field))
+		}
+		if err := code.UnmarshalJSON([]byte(field)); err != nil {
+			return nil, ErrInvalidGrpcOption
+		}
+		vec = append(vec, code)
+	}
+	return vec, nil
+}
+
+func containsGrpcCode(vec []codes.Code, code codes.Code) bool {
+	for _, c := range vec {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+//返回服务地址的连接,相同地址和TLS选项的任务共享同一个连接
+func (w *Worker) grpcConn(target string, opt *GrpcOption) (*grpc.ClientConn, error) {
+	key := fmt.Sprintf("%s/%s/%t", target, opt.Tls, opt.SkipVerify)
+	w.rpcLock.Lock()
+	defer w.rpcLock.Unlock()
+	if conn, ok := w.grpcConns[key]; ok {
+		return conn, nil
+	}
+	tlsConfig, err := w.rpcTlsConfig(&RpcOption{Tls: opt.Tls, SkipVerify: opt.SkipVerify})
+	if err != nil {
+		return nil, err
+	}
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.NewClient(target,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.DefaultConfig,
+			MinConnectTimeout: w.rpcConnectTimeout(),
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if w.grpcConns == nil {
+		w.grpcConns = make(map[string]*grpc.ClientConn)
+	}
+	w.grpcConns[key] = conn
+	return conn, nil
+}
+
+//获取服务的接口定义,配置的descriptor set只加载一次,服务端反射每次重新查询
+func (w *Worker) grpcFiles(ctx context.Context, conn *grpc.ClientConn, name string, service string) (*protoregistry.Files, error) {
+	if len(name) == 0 {
+		return grpcReflectFiles(ctx, conn, service)
+	}
+	w.rpcLock.Lock()
+	defer w.rpcLock.Unlock()
+	if files, ok := w.grpcDescriptors[name]; ok {
+		return files, nil
+	}
+	path, ok := w.cfg.GrpcDescriptors[name]
+	if !ok {
+		return nil, ErrDescriptorNotExist
+	}
+	//protoc --include_imports --descriptor_set_out生成的文件
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set := new(descriptorpb.FileDescriptorSet)
+	if err = proto.Unmarshal(data, set); err != nil {
+		return nil, err
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+	if w.grpcDescriptors == nil {
+		w.grpcDescriptors = make(map[string]*protoregistry.Files)
+	}
+	w.grpcDescriptors[name] = files
+	return files, nil
+}
+
+//服务端反射的一次查询,symbol和filename只设置一个,返回序列化的FileDescriptorProto
+type reflectQuery func(symbol string, filename string) ([][]byte, error)
+
+//通过服务端反射获取服务及其依赖的接口定义,服务端不支持v1时使用v1alpha
+func grpcReflectFiles(ctx context.Context, conn *grpc.ClientConn, service string) (*protoregistry.Files, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	files, err := reflectFiles(reflectV1(ctx, conn), service)
+	if status.Code(err) == codes.Unimplemented {
+		files, err = reflectFiles(reflectV1alpha(ctx, conn), service)
+	}
+	return files, err
+}
+
+func reflectFiles(query reflectQuery, service string) (*protoregistry.Files, error) {
+	pending, err := query(service, "")
+	if err != nil {
+		return nil, err
+	}
+	set := new(descriptorpb.FileDescriptorSet)
+	seen := make(map[string]bool)
+	for len(pending) != 0 {
+		fd := new(descriptorpb.FileDescriptorProto)
+		if err = proto.Unmarshal(pending[0], fd); err != nil {
+			return nil, err
+		}
+		pending = pending[1:]
+		if seen[fd.GetName()] {
+			continue
+		}
+		seen[fd.GetName()] = true
+		set.File = append(set.File, fd)
+		for _, dep := range fd.GetDependency() {
+			if seen[dep] {
+				continue
+			}
+			//服务端可能不返回标准类型的定义,优先使用本地注册的定义
+			if local, err := protoregistry.GlobalFiles.FindFileByPath(dep); err == nil {
+				seen[dep] = true
+				set.File = append(set.File, protodesc.ToFileDescriptorProto(local))
+				continue
+			}
+			more, err := query("", dep)
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending, more...)
+		}
+	}
+	return protodesc.NewFiles(set)
+}
+
+func reflectV1(ctx context.Context, conn *grpc.ClientConn) reflectQuery {
+	var stream rpb.ServerReflection_ServerReflectionInfoClient
+	return func(symbol string, filename string) ([][]byte, error) {
+		var err error
+		if stream == nil {
+			if stream, err = rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx); err != nil {
+				return nil, err
+			}
+		}
+		req := &rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol},
+		}
+		if len(filename) != 0 {
+			req.MessageRequest = &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: filename}
+		}
+		//发送失败时错误原因由Recv返回
+		if err = stream.Send(req); err != nil && err != io.EOF {
+			return nil, err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if e := resp.GetErrorResponse(); e != nil {
+			return nil, status.Error(codes.Code(e.GetErrorCode()), e.GetErrorMessage())
+		}
+		return resp.GetFileDescriptorResponse().GetFileDescriptorProto(), nil
+	}
+}
+
+func reflectV1alpha(ctx context.Context, conn *grpc.ClientConn) reflectQuery {
+	var stream rpbalpha.ServerReflection_ServerReflectionInfoClient
+	return func(symbol string, filename string) ([][]byte, error) {
+		var err error
+		if stream == nil {
+			if stream, err = rpbalpha.NewServerReflectionClient(conn).ServerReflectionInfo(ctx); err != nil {
+				return nil, err
+			}
+		}
+		req := &rpbalpha.ServerReflectionRequest{
+			MessageRequest: &rpbalpha.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol},
+		}
+		if len(filename) != 0 {
+			req.MessageRequest = &rpbalpha.ServerReflectionRequest_FileByFilename{FileByFilename: filename}
+		}
+		if err = stream.Send(req); err != nil && err != io.EOF {
+			return nil, err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if e := resp.GetErrorResponse(); e != nil {
+			return nil, status.Error(codes.Code(e.GetErrorCode()), e.GetErrorMessage())
+		}
+		return resp.GetFileDescriptorResponse().GetFileDescriptorProto(), nil
+	}
+}
+
+//查找一元调用的方法定义,不支持流式方法
+func grpcMethod(files *protoregistry.Files, service string, method string) (protoreflect.MethodDescriptor, error) {
+	d, err := files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, ErrGrpcMethodNotFound
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, ErrGrpcMethodNotFound
+	}
+	md := sd.Methods().ByName(protoreflect.Name(method))
+	if md == nil {
+		return nil, ErrGrpcMethodNotFound
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, ErrGrpcStreaming
+	}
+	return md, nil
+}
+
+//执行gRPC任务请求,根据状态码判断结果,收到状态码时总是返回结果
+func (w *Worker) DoGrpcTaskRequest(ctx context.Context, req *TaskRequest) (*GrpcResponse, error) {
+	opt := req.Grpc
+	if err := opt.Check(); err != nil {
+		return nil, err
+	}
+	service, method, _ := splitGrpcMethod(opt.Method)
+	successCodes, _ := ParseGrpcCodes(opt.SuccessCodes)
+	conn, err := w.grpcConn(req.BinName, opt)
+	if err != nil {
+		logger.GetLogger().Errorln("worker", "DoGrpcTaskRequest", err.Error(), 0,
+			"key", fmt.Sprintf("t_%s", req.Uuid), "target", req.BinName)
+		return nil, err
+	}
+
+	//反射查询和调用都在任务的最长运行时间内完成
+	ctx, cancel := context.WithTimeout(ctx, w.taskRunTime(req))
+	defer cancel()
+	md := metadata.New(opt.Metadata)
+	md.Set(TaskUuidHeader, req.Uuid)
+	ctx = metadata.NewOutgoingContext(ctx, md)
+
+	files, err := w.grpcFiles(ctx, conn, opt.Descriptor, service)
+	if err != nil {
+		logger.GetLogger().Errorln("worker", "DoGrpcTaskRequest", err.Error(), 0,
+			"key", fmt.Sprintf("t_%s", req.Uuid), "target", req.BinName, "descriptor", opt.Descriptor)
+		return nil, rpcError(ctx, err)
+	}
+	desc, err := grpcMethod(files, service, method)
+	if err != nil {
+		return nil, err
+	}
+	types := dynamicpb.NewTypes(files)
+	in := dynamicpb.NewMessage(desc.Input())
+	if len(req.Args) != 0 {
+		if err = (protojson.UnmarshalOptions{Resolver: types}).Unmarshal([]byte(req.Args), in); err != nil {
+			return nil, ErrInvalidArgs
+		}
+	}
+	out := dynamicpb.NewMessage(desc.Output())
+	err = conn.Invoke(ctx, fmt.Sprintf("/%s/%s", service, method), in, out)
+
+	st := status.Convert(err)
+	resp := &GrpcResponse{Code: st.Code(), Message: st.Message(), Body: st.Message()}
+	if err == nil {
+		buf, err := (protojson.MarshalOptions{Resolver: types}).Marshal(out)
+		if err != nil {
+			return resp, err
+		}
+		//结果中只保存限制长度的响应
+		body := newCappedBuffer(w.outputLimit())
+		body.Write(buf)
+		resp.Body = body.String()
+	}
+	if containsGrpcCode(successCodes, st.Code()) {
+		return resp, nil
+	}
+	if err == nil {
+		return resp, NewError(fmt.Sprintf("grpc status: %s", st.Code()))
+	}
+	return resp, rpcError(ctx, err)
+}
@@ -0,0 +1,215 @@
+package core
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	healthMethod = "grpc.health.v1.Health/Check"
+	//请求带有该元数据时测试服务端一直等待到调用结束
+	blockMetadata = "x-test-block"
+)
+
+//启动使用health服务的测试服务端,reflect为false时不注册服务端反射
+func startGrpcServer(t *testing.T, reflect bool) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(blockMetadata)) != 0 {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return handler(ctx, req)
+	}
+	s := grpc.NewServer(grpc.UnaryInterceptor(block))
+	hs := health.NewServer()
+	hs.SetServingStatus("ktse", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(s, hs)
+	if reflect {
+		reflection.Register(s)
+	}
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return lis.Addr().String()
+}
+
+func newGrpcTestWorker(t *testing.T) *Worker {
+	w := &Worker{cfg: &WorkerConfig{}}
+	t.Cleanup(func() {
+		for _, conn := range w.grpcConns {
+			conn.Close()
+		}
+	})
+	return w
+}
+
+func grpcTaskRequest(target string, args string, opt *GrpcOption) *TaskRequest {
+	return &TaskRequest{Uuid: "test-uuid", BinName: target, Args: args, TaskType: GrpcTask, MaxRunTime: 5, Grpc: opt}
+}
+
+func TestDoGrpcTaskRequestReflection(t *testing.T) {
+	w := newGrpcTestWorker(t)
+	target := startGrpcServer(t, true)
+	req := grpcTaskRequest(target, `{"service":"ktse"}`, &GrpcOption{Method: "/" + healthMethod})
+	resp, err := w.DoGrpcTaskRequest(context.Background(), req)
+	if err != nil {
+		t.Fatalf("DoGrpcTaskRequest error: %v", err)
+	}
+	if resp.Code != codes.OK || !strings.Contains(resp.Body, `"SERVING"`) {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+}
+
+func TestDoGrpcTaskRequestDescriptorSet(t *testing.T) {
+	set := &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(healthpb.File_grpc_health_v1_health_proto)},
+	}
+	data, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "health.pb")
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := newGrpcTestWorker(t)
+	w.cfg.GrpcDescriptors = map[string]string{"health": path}
+	//服务端没有反射,只能使用配置的接口定义
+	target := startGrpcServer(t, false)
+
+	req := grpcTaskRequest(target, `{"service":"ktse"}`, &GrpcOption{Method: healthMethod, Descriptor: "health"})
+	resp, err := w.DoGrpcTaskRequest(context.Background(), req)
+	if err != nil {
+		t.Fatalf("DoGrpcTaskRequest error: %v", err)
+	}
+	if resp.Code != codes.OK || !strings.Contains(resp.Body, `"SERVING"`) {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+
+	req.Grpc = &GrpcOption{Method: healthMethod, Descriptor: "missing"}
+	if _, err = w.DoGrpcTaskRequest(context.Background(), req); err != ErrDescriptorNotExist {
+		t.Fatalf("expected ErrDescriptorNotExist, got %v", err)
+	}
+}
+
+func TestDoGrpcTaskRequestSuccessCodes(t *testing.T) {
+	w := newGrpcTestWorker(t)
+	target := startGrpcServer(t, true)
+	//health服务对未知的服务返回NOT_FOUND
+	for _, c := range []struct {
+		codes string
+		ok    bool
+	}{
+		{"", false},
+		{"OK", false},
+		{"OK not_found", true},
+		{"5", true},
+	} {
+		req := grpcTaskRequest(target, `{"service":"unknown"}`, &GrpcOption{Method: healthMethod, SuccessCodes: c.codes})
+		resp, err := w.DoGrpcTaskRequest(context.Background(), req)
+		if resp == nil || resp.Code != codes.NotFound {
+			t.Fatalf("success_codes %q: unexpected response %+v, err %v", c.codes, resp, err)
+		}
+		if (err == nil) != c.ok {
+			t.Errorf("success_codes %q: err = %v, want ok = %t", c.codes, err, c.ok)
+		}
+	}
+}
+
+func TestDoGrpcTaskRequestDeadline(t *testing.T) {
+	w := newGrpcTestWorker(t)
+	target := startGrpcServer(t, true)
+	req := grpcTaskRequest(target, `{"service":"ktse"}`, &GrpcOption{
+		Method:   healthMethod,
+		Metadata: map[string]string{blockMetadata: "1"},
+	})
+	req.MaxRunTime = 1
+	start := time.Now()
+	resp, err := w.DoGrpcTaskRequest(context.Background(), req)
+	if err != ErrExecTimeout {
+		t.Fatalf("expected ErrExecTimeout, got %v", err)
+	}
+	if resp == nil || resp.Code != codes.DeadlineExceeded {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > time.Second*3 {
+		t.Fatalf("deadline not taken from max_run_time: %v", elapsed)
+	}
+}
+
+func TestParseGrpcCodes(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want []codes.Code
+		err  bool
+	}{
+		{"", []codes.Code{codes.OK}, false},
+		{"   ", []codes.Code{codes.OK}, false},
+		{"OK", []codes.Code{codes.OK}, false},
+		{"ok not_found", []codes.Code{codes.OK, codes.NotFound}, false},
+		{"0 5 16", []codes.Code{codes.OK, codes.NotFound, codes.Unauthenticated}, false},
+		{"NOT_FOUND 14", []codes.Code{codes.NotFound, codes.Unavailable}, false},
+		{"NOTFOUND", nil, true},
+		{"17", nil, true},
+		{"-1", nil, true},
+		{"OK,NOT_FOUND", nil, true},
+	} {
+		got, err := ParseGrpcCodes(c.s)
+		if (err != nil) != c.err {
+			t.Errorf("ParseGrpcCodes(%q) error = %v", c.s, err)
+			continue
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("ParseGrpcCodes(%q) = %v, want %v", c.s, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("ParseGrpcCodes(%q) = %v, want %v", c.s, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSplitGrpcMethod(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		service string
+		method  string
+		ok      bool
+	}{
+		{"grpc.health.v1.Health/Check", "grpc.health.v1.Health", "Check", true},
+		{"/grpc.health.v1.Health/Check", "grpc.health.v1.Health", "Check", true},
+		{"Health/Check", "Health", "Check", true},
+		{"a/b/Check", "a/b", "Check", true},
+		{"", "", "", false},
+		{"/", "", "", false},
+		{"Check", "", "", false},
+		{"/Check", "", "", false},
+		{"grpc.health.v1.Health/", "", "", false},
+		{"//Check", "", "", false},
+	} {
+		service, method, ok := splitGrpcMethod(c.name)
+		if service != c.service || method != c.method || ok != c.ok {
+			t.Errorf("splitGrpcMethod(%q) = %q, %q, %t", c.name, service, method, ok)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/phillihq/ktse/logger"
+	"runtime/debug"
+)
+
+//处理函数,payload为任务的args,返回值作为任务结果
+//ctx在任务超时或取消时结束,处理函数应该及时返回
+type HandlerFunc func(ctx context.Context, payload string) (string, error)
+
+type taskUuidKey struct{}
+
+//注册处理函数,提交的处理函数任务按名称调用
+//名称为空,处理函数为nil或重复注册时panic;可以在Run之后调用,下一次读取任务时开始读取对应的队列
+func (w *Worker) Handle(name string, handler HandlerFunc) {
+	if len(name) == 0 || handler == nil {
+		panic("ktse: invalid handler")
+	}
+	w.handlerLock.Lock()
+	defer w.handlerLock.Unlock()
+	if _, ok := w.handlers[name]; ok {
+		panic("ktse: multiple registrations for handler " + name)
+	}
+	if w.handlers == nil {
+		w.handlers = make(map[string]HandlerFunc)
+	}
+	w.handlers[name] = handler
+}
+
+func (w *Worker) handler(name string) HandlerFunc {
+	w.handlerLock.RLock()
+	defer w.handlerLock.RUnlock()
+	return w.handlers[name]
+}
+
+//获取处理函数正在执行的任务uuid,可以用于上报进度
+func TaskUuidFromContext(ctx context.Context) (string, bool) {
+	uuid, ok := ctx.Value(taskUuidKey{}).(string)
+	return uuid, ok
+}
+
+//执行处理函数任务,超时或取消时不等待处理函数返回
+func (w *Worker) DoHandlerTaskRequest(ctx context.Context, req *TaskRequest) (string, error) {
+	handler := w.handler(req.BinName)
+	if handler == nil {
+		logger.GetLogger().Errorln("worker", "DoHandlerTaskRequest", "handler not exist", 0,
+			"key", fmt.Sprintf("t_%s", req.Uuid), "handler", req.BinName)
+		return "", ErrHandlerNotExist
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.taskRunTime(req))
+	defer cancel()
+	ctx = context.WithValue(ctx, taskUuidKey{}, req.Uuid)
+
+	type handlerResult struct {
+		output string
+		err    error
+	}
+	ch := make(chan handlerResult, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.GetLogger().Errorln("worker", "DoHandlerTaskRequest", "handler panic", 0,
+					"key", fmt.Sprintf("t_%s", req.Uuid), "handler", req.BinName,
+					"panic", r, "stack", string(debug.Stack()))
+				ch <- handlerResult{err: NewError(fmt.Sprintf("handler panic: %v", r))}
+			}
+		}()
+		output, err := handler(ctx, req.Args)
+		ch <- handlerResult{output: output, err: err}
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return "", rpcError(ctx, r.err)
+		}
+		//结果中只保存限制长度的输出
+		output := newCappedBuffer(w.outputLimit())
+		output.Write([]byte(r.output))
+		return output.String(), nil
+	case <-ctx.Done():
+		logger.GetLogger().Errorln("worker", "DoHandlerTaskRequest", "handler not return", 0,
+			"key", fmt.Sprintf("t_%s", req.Uuid), "handler", req.BinName, "err", ctx.Err().Error())
+		return "", rpcError(ctx, ctx.Err())
+	}
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"fmt"
+	"github.com/phillihq/ktse/logger"
+	"gopkg.in/redis.v3"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//在线worker的集合(sorted set),score为最后一次心跳的时间(秒)
+	WorkerSet               = "worker_set"
+	workerHeartbeatInterval = time.Second * 10
+	//超过该时间没有心跳的worker视为离线
+	workerTimeout = time.Second * 30
+)
+
+//在线worker的信息
+type WorkerInfo struct {
+	Id          string   `json:"id"`
+	Host        string   `json:"host"`
+	Pid         int      `json:"pid"`
+	StartTime   int64    `json:"start_time"` //启动时间(毫秒时间戳)
+	Heartbeat   int64    `json:"heartbeat"`  //最后一次心跳时间(毫秒时间戳)
+	Queues      []string `json:"queues"`
+	CurrentTask string   `json:"current_task,omitempty"` //正在执行的任务uuid
+}
+
+var WorkerInfoFields = []string{"host", "pid", "start_time", "heartbeat", "queues", "current_task"}
+
+//worker信息在redis中的key(hash),没有心跳后过期
+func WorkerKey(id string) string {
+	return fmt.Sprintf("wk_%s", id)
+}
+
+func parseWorkerInfo(id string, result []interface{}) *WorkerInfo {
+	info := &WorkerInfo{
+		Id:          id,
+		Host:        hashString(result[0]),
+		CurrentTask: hashString(result[5]),
+	}
+	info.Pid, _ = strconv.Atoi(hashString(result[1]))
+	info.StartTime, _ = strconv.ParseInt(hashString(result[2]), 10, 64)
+	info.Heartbeat, _ = strconv.ParseInt(hashString(result[3]), 10, 64)
+	info.Queues = strings.Fields(hashString(result[4]))
+	return info
+}
+
+//记录正在执行的任务,为空表示空闲
+func (w *Worker) setCurrentTask(uuid string) {
+	w.stateLock.Lock()
+	w.currentTask = uuid
+	w.stateLock.Unlock()
+}
+
+func (w *Worker) getCurrentTask() string {
+	w.stateLock.Lock()
+	defer w.stateLock.Unlock()
+	return w.currentTask
+}
+
+//定期写入心跳,broker据此列出在线的worker
+func (w *Worker) Heartbeat() {
+	for w.running {
+		w.heartbeat()
+		time.Sleep(workerHeartbeatInterval)
+	}
+}
+
+func (w *Worker) heartbeat() {
+	host, _ := os.Hostname()
+	now := time.Now()
+	key := WorkerKey(w.id)
+	pairs := []string{
+		"host", host,
+		"pid", strconv.Itoa(os.Getpid()),
+		"start_time", strconv.FormatInt(w.startTime.UnixNano()/int64(time.Millisecond), 10),
+		"heartbeat", strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10),
+		"queues", strings.Join(w.queues(), " "),
+		"current_task", w.getCurrentTask(),
+	}
+	z := redis.Z{Score: float64(now.Unix()), Member: w.id}
+	var err error
+	if w.IsCluster() {
+		err = w.redisClusterClient.HMSet(key, pairs[0], pairs[1], pairs[2:]...).Err()
+		if err == nil {
+			err = w.redisClusterClient.Expire(key, workerTimeout).Err()
+		}
+		if err == nil {
+			err = w.redisClusterClient.ZAdd(WorkerSet, z).Err()
+		}
+	} else {
+		err = w.redisClient.HMSet(key, pairs[0], pairs[1], pairs[2:]...).Err()
+		if err == nil {
+			err = w.redisClient.Expire(key, workerTimeout).Err()
+		}
+		if err == nil {
+			err = w.redisClient.ZAdd(WorkerSet, z).Err()
+		}
+	}
+	if err != nil {
+		observeRedisError("worker", "heartbeat", err)
+		logger.GetLogger().Errorln("Worker", "heartbeat", err.Error(), 0, "key", key)
+	}
+}
+
+//worker退出时删除心跳
+func (w *Worker) removeHeartbeat() {
+	if w.IsCluster() {
+		w.redisClusterClient.ZRem(WorkerSet, w.id)
+		w.redisClusterClient.Del(WorkerKey(w.id))
+	} else {
+		w.redisClient.ZRem(WorkerSet, w.id)
+		w.redisClient.Del(WorkerKey(w.id))
+	}
+}
+
+//列出在线的worker,同时删除超时没有心跳的worker
+func (b *Broker) ListWorkers() ([]*WorkerInfo, error) {
+	min := strconv.FormatInt(time.Now().Add(-workerTimeout).Unix(), 10)
+	var ids []string
+	var err error
+	if b.IsCluster() {
+		b.redisClusterClient.ZRemRangeByScore(WorkerSet, "-inf", "("+min)
+		ids, err = b.redisClusterClient.ZRangeByScore(WorkerSet, redis.ZRangeByScore{Min: min, Max: "+inf"}).Result()
+	} else {
+		b.redisClient.ZRemRangeByScore(WorkerSet, "-inf", "("+min)
+		ids, err = b.redisClient.ZRangeByScore(WorkerSet, redis.ZRangeByScore{Min: min, Max: "+inf"}).Result()
+	}
+	if err != nil {
+		observeRedisError("broker", "zrangebyscore", err)
+		logger.GetLogger().Errorln("Broker", "ListWorkers", err.Error(), 0, "key", WorkerSet)
+		return nil, err
+	}
+	sort.Strings(ids)
+	workers := []*WorkerInfo{}
+	for _, id := range ids {
+		var result []interface{}
+		if b.IsCluster() {
+			result, err = b.redisClusterClient.HMGet(WorkerKey(id), WorkerInfoFields...).Result()
+		} else {
+			result, err = b.redisClient.HMGet(WorkerKey(id), WorkerInfoFields...).Result()
+		}
+		if err != nil {
+			observeRedisError("broker", "hmget", err)
+			logger.GetLogger().Errorln("Broker", "ListWorkers", err.Error(), 0, "key", WorkerKey(id))
+			return nil, err
+		}
+		//心跳已经过期
+		if result[0] == nil {
+			continue
+		}
+		workers = append(workers, parseWorkerInfo(id, result))
+	}
+	return workers, nil
+}
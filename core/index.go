@@ -0,0 +1,613 @@
+package core
+
+import (
+	"fmt"
+	"github.com/phillihq/ktse/logger"
+	"gopkg.in/redis.v3"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//索引的key使用相同的hash tag,集群模式下在同一个slot
+	indexKeyPrefix = "{ktse_index}:"
+	//按可执行文件和标签建立的索引key的集合,用于清理过期的索引项
+	IndexKeySet = indexKeyPrefix + "keys"
+	//索引保存时间,单位为秒
+	DefaultIndexKeepTime = 60 * 60 * 24 * 30
+	indexTrimInterval    = time.Hour
+	//任务列表每页的默认和最大数量,一次查询最多扫描的索引项是每页数量的倍数
+	DefaultTaskListLimit = 50
+	MaxTaskListLimit     = 500
+	taskListScanFactor   = 10
+	//每个任务最多的标签数
+	MaxTaskTags = 16
+)
+
+//任务列表中的状态,等待执行和正在执行与TaskStatusPending,TaskStatusRunning相同
+//结束的状态与指标中的outcome相同
+const (
+	TaskStateScheduled = "scheduled" //还没有到开始时间
+	TaskStateRetrying  = "retrying"  //失败后等待重试
+	TaskStateSuccess   = OutcomeSuccess
+	TaskStateFailure   = OutcomeFailure
+	TaskStateCanceled  = OutcomeCanceled
+)
+
+var TaskStates = []string{TaskStateScheduled, TaskStatusPending, TaskStatusRunning, TaskStateRetrying,
+	TaskStateSuccess, TaskStateFailure, TaskStateCanceled}
+
+var TaskTypeNames = []string{"script", "rpc", "grpc", "handler"}
+
+var validTag = regexp.MustCompile(`^[A-Za-z0-9_.:=-]{1,64}$`)
+
+//任务摘要,任务列表中返回
+type TaskInfo struct {
+	Uuid       string   `json:"uuid"`
+	State      string   `json:"state"`
+	TaskType   string   `json:"task_type"`
+	BinName    string   `json:"bin_name"` //脚本和处理函数的名称,RPC任务的地址,gRPC任务的服务地址
+	Queue      string   `json:"queue"`
+	Tags       []string `json:"tags,omitempty"`
+	SubmitTime int64    `json:"submit_time"`           //毫秒时间戳
+	FinishTime int64    `json:"finish_time,omitempty"` //毫秒时间戳,重试时为最后一次执行的结束时间
+}
+
+var TaskInfoFields = []string{"state", "task_type", "bin_name", "tags", "submit_time", "finish_time", "queue"}
+
+//任务列表的查询条件,时间为毫秒时间戳,0表示不限制
+type TaskQuery struct {
+	State           string
+	Queue           string
+	TaskType        string
+	BinName         string
+	Tags            []string
+	SubmittedAfter  int64
+	SubmittedBefore int64
+	FinishedAfter   int64
+	FinishedBefore  int64
+	Limit           int
+	Cursor          string
+}
+
+type TaskList struct {
+	Tasks []*TaskInfo `json:"tasks"`
+	//下一页的游标,为空表示没有更多;扫描数量达到上限时任务数可能少于limit
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+//任务摘要在redis中的key(hash)
+func TaskInfoKey(uuid string) string {
+	return fmt.Sprintf("i_%s", uuid)
+}
+
+//索引在redis中的key(sorted set),按提交时间排序,结束时间索引按结束时间排序
+func IndexKey(name string, value string) string {
+	return indexKeyPrefix + name + ":" + value
+}
+
+func allIndexKey() string {
+	return indexKeyPrefix + "all"
+}
+
+func finishedIndexKey() string {
+	return indexKeyPrefix + "finished"
+}
+
+//解析空格分隔的标签
+func ParseTags(s string) ([]string, error) {
+	tags := strings.Fields(s)
+	if err := checkTags(tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func checkTags(tags []string) error {
+	if len(tags) > MaxTaskTags {
+		return ErrInvalidTags
+	}
+	for _, tag := range tags {
+		if !validTag.MatchString(tag) {
+			return ErrInvalidTags
+		}
+	}
+	return nil
+}
+
+func containsString(vec []string, s string) bool {
+	for _, v := range vec {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTaskInfo(uuid string, result []interface{}) *TaskInfo {
+	info := &TaskInfo{
+		Uuid:     uuid,
+		State:    hashString(result[0]),
+		TaskType: hashString(result[1]),
+		BinName:  hashString(result[2]),
+	}
+	if tags := hashString(result[3]); len(tags) != 0 {
+		info.Tags = strings.Split(tags, " ")
+	}
+	info.SubmitTime, _ = strconv.ParseInt(hashString(result[4]), 10, 64)
+	info.FinishTime, _ = strconv.ParseInt(hashString(result[5]), 10, 64)
+	info.Queue = hashString(result[6])
+	//升级前建立的索引没有队列,按任务类型推断
+	if len(info.Queue) == 0 {
+		info.Queue = RequestUuidSet
+		if info.TaskType == taskTypeName(HandlerTask) {
+			info.Queue = HandlerQueue(info.BinName)
+		}
+	}
+	return info
+}
+
+func (q *TaskQuery) match(info *TaskInfo) bool {
+	if len(q.State) != 0 && info.State != q.State {
+		return false
+	}
+	if len(q.TaskType) != 0 && info.TaskType != q.TaskType {
+		return false
+	}
+	if len(q.Queue) != 0 && info.Queue != q.Queue {
+		return false
+	}
+	if len(q.BinName) != 0 && info.BinName != q.BinName {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !containsString(info.Tags, tag) {
+			return false
+		}
+	}
+	if (q.SubmittedAfter != 0 && info.SubmitTime < q.SubmittedAfter) ||
+		(q.SubmittedBefore != 0 && info.SubmitTime > q.SubmittedBefore) {
+		return false
+	}
+	if q.FinishedAfter != 0 || q.FinishedBefore != 0 {
+		if info.FinishTime == 0 ||
+			(q.FinishedAfter != 0 && info.FinishTime < q.FinishedAfter) ||
+			(q.FinishedBefore != 0 && info.FinishTime > q.FinishedBefore) {
+			return false
+		}
+	}
+	return true
+}
+
+//选择扫描的索引:有结束时间条件时按结束时间,否则选择最具体的条件,其他条件逐个判断
+func (q *TaskQuery) index() (key string, min string, max string) {
+	after, before := q.SubmittedAfter, q.SubmittedBefore
+	switch {
+	case q.FinishedAfter != 0 || q.FinishedBefore != 0:
+		key = finishedIndexKey()
+		after, before = q.FinishedAfter, q.FinishedBefore
+	case len(q.BinName) != 0:
+		key = IndexKey("bin", q.BinName)
+	case len(q.Tags) != 0:
+		key = IndexKey("tag", q.Tags[0])
+	case len(q.State) != 0:
+		key = IndexKey("state", q.State)
+	case len(q.TaskType) != 0:
+		key = IndexKey("type", q.TaskType)
+	default:
+		key = allIndexKey()
+	}
+	min, max = "-inf", "+inf"
+	if after != 0 {
+		min = strconv.FormatInt(after, 10)
+	}
+	if before != 0 {
+		max = strconv.FormatInt(before, 10)
+	}
+	return key, min, max
+}
+
+//游标格式为"分数:uuid"
+func parseTaskCursor(cursor string) (*redis.Z, error) {
+	vec := strings.SplitN(cursor, ":", 2)
+	if len(vec) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	score, err := strconv.ParseInt(vec[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &redis.Z{Score: float64(score), Member: vec[1]}, nil
+}
+
+func formatTaskCursor(z *redis.Z) string {
+	return fmt.Sprintf("%d:%s", int64(z.Score), z.Member)
+}
+
+//提交任务时建立索引,定时任务的状态为scheduled
+func (b *Broker) indexTask(req *TaskRequest, state string) error {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	taskType := taskTypeName(req.TaskType)
+	key := TaskInfoKey(req.Uuid)
+	pairs := []string{
+		"state", state,
+		"task_type", taskType,
+		"bin_name", req.BinName,
+		"tags", strings.Join(req.Tags, " "),
+		"submit_time", strconv.FormatInt(now, 10),
+		"queue", req.Queue(),
+	}
+	var err error
+	if b.IsCluster() {
+		err = b.redisClusterClient.HMSet(key, pairs[0], pairs[1], pairs[2:]...).Err()
+	} else {
+		err = b.redisClient.HMSet(key, pairs[0], pairs[1], pairs[2:]...).Err()
+	}
+	if err != nil {
+		observeRedisError("broker", "hmset", err)
+		logger.GetLogger().Errorln("Broker", "indexTask", err.Error(), 0, "key", key)
+		return err
+	}
+	if b.IsCluster() {
+		err = b.redisClusterClient.Expire(key, b.indexKeepTime()).Err()
+	} else {
+		err = b.redisClient.Expire(key, b.indexKeepTime()).Err()
+	}
+	if err != nil {
+		logger.GetLogger().Errorln("Broker", "indexTask", err.Error(), 0, "key", key)
+		return err
+	}
+
+	keys := []string{allIndexKey(), IndexKey("state", state), IndexKey("type", taskType)}
+	dynamicKeys := []string{IndexKey("bin", req.BinName)}
+	for _, tag := range req.Tags {
+		dynamicKeys = append(dynamicKeys, IndexKey("tag", tag))
+	}
+	for _, indexKey := range dynamicKeys {
+		if b.IsCluster() {
+			err = b.redisClusterClient.SAdd(IndexKeySet, indexKey).Err()
+		} else {
+			err = b.redisClient.SAdd(IndexKeySet, indexKey).Err()
+		}
+		if err != nil {
+			observeRedisError("broker", "sadd", err)
+			logger.GetLogger().Errorln("Broker", "indexTask", err.Error(), 0, "key", IndexKeySet)
+			return err
+		}
+	}
+	for _, indexKey := range append(keys, dynamicKeys...) {
+		if err = b.indexAdd(indexKey, float64(now), req.Uuid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Broker) indexAdd(key string, score float64, uuid string) error {
+	var err error
+	z := redis.Z{Score: score, Member: uuid}
+	if b.IsCluster() {
+		err = b.redisClusterClient.ZAdd(key, z).Err()
+	} else {
+		err = b.redisClient.ZAdd(key, z).Err()
+	}
+	if err != nil {
+		observeRedisError("broker", "zadd", err)
+		logger.GetLogger().Errorln("Broker", "indexAdd", err.Error(), 0, "key", key, "uuid", uuid)
+	}
+	return err
+}
+
+func (b *Broker) indexRemove(key string, uuid string) error {
+	var err error
+	if b.IsCluster() {
+		err = b.redisClusterClient.ZRem(key, uuid).Err()
+	} else {
+		err = b.redisClient.ZRem(key, uuid).Err()
+	}
+	if err != nil {
+		observeRedisError("broker", "zrem", err)
+		logger.GetLogger().Errorln("Broker", "indexRemove", err.Error(), 0, "key", key, "uuid", uuid)
+	}
+	return err
+}
+
+func (b *Broker) getTaskInfo(uuid string) (*TaskInfo, error) {
+	key := TaskInfoKey(uuid)
+	var result []interface{}
+	var err error
+	if b.IsCluster() {
+		result, err = b.redisClusterClient.HMGet(key, TaskInfoFields...).Result()
+	} else {
+		result, err = b.redisClient.HMGet(key, TaskInfoFields...).Result()
+	}
+	if err != nil {
+		observeRedisError("broker", "hmget", err)
+		logger.GetLogger().Errorln("Broker", "getTaskInfo", err.Error(), 0, "key", key)
+		return nil, err
+	}
+	//升级前提交的任务或者索引已经过期
+	if result[0] == nil {
+		return nil, nil
+	}
+	return parseTaskInfo(uuid, result), nil
+}
+
+//修改任务状态,没有索引的任务不处理
+func (b *Broker) setTaskState(uuid string, state string) error {
+	info, err := b.getTaskInfo(uuid)
+	if err != nil || info == nil || info.State == state {
+		return err
+	}
+	if err = b.indexRemove(IndexKey("state", info.State), uuid); err != nil {
+		return err
+	}
+	if err = b.indexAdd(IndexKey("state", state), float64(info.SubmitTime), uuid); err != nil {
+		return err
+	}
+	if b.IsCluster() {
+		err = b.redisClusterClient.HSet(TaskInfoKey(uuid), "state", state).Err()
+	} else {
+		err = b.redisClient.HSet(TaskInfoKey(uuid), "state", state).Err()
+	}
+	if err != nil {
+		observeRedisError("broker", "hset", err)
+		logger.GetLogger().Errorln("Broker", "setTaskState", err.Error(), 0, "key", TaskInfoKey(uuid))
+	}
+	return err
+}
+
+//删除任务的索引
+func (b *Broker) unindexTask(uuid string) error {
+	info, err := b.getTaskInfo(uuid)
+	if err != nil || info == nil {
+		return err
+	}
+	keys := []string{allIndexKey(), finishedIndexKey(), IndexKey("state", info.State),
+		IndexKey("type", info.TaskType), IndexKey("bin", info.BinName)}
+	for _, tag := range info.Tags {
+		keys = append(keys, IndexKey("tag", tag))
+	}
+	for _, key := range keys {
+		if err = b.indexRemove(key, uuid); err != nil {
+			return err
+		}
+	}
+	return b.deleteTaskKeys(TaskInfoKey(uuid))
+}
+
+func (b *Broker) indexKeepTime() time.Duration {
+	if b.cfg.IndexKeepTime > 0 {
+		return time.Second * time.Duration(b.cfg.IndexKeepTime)
+	}
+	return time.Second * DefaultIndexKeepTime
+}
+
+//按分数从大到小读取有序集合,分数相同时按成员从大到小
+type zrevrangeFunc func(key string, opt redis.ZRangeByScore) ([]redis.Z, error)
+
+func (b *Broker) zrevrangeByScore(key string, opt redis.ZRangeByScore) ([]redis.Z, error) {
+	var result []redis.Z
+	var err error
+	if b.IsCluster() {
+		result, err = b.redisClusterClient.ZRevRangeByScoreWithScores(key, opt).Result()
+	} else {
+		result, err = b.redisClient.ZRevRangeByScoreWithScores(key, opt).Result()
+	}
+	if err != nil {
+		observeRedisError("broker", "zrevrangebyscore", err)
+	}
+	return result, err
+}
+
+//从游标之后读取一批索引项,按分数从大到小,分数相同时按uuid从大到小
+//游标所在分数的剩余项全部返回,之后最多返回count项
+func scanIndex(zrevrange zrevrangeFunc, key string, min string, max string, after *redis.Z, count int64) ([]redis.Z, error) {
+	var ret []redis.Z
+	if after != nil {
+		score := strconv.FormatInt(int64(after.Score), 10)
+		result, err := zrevrange(key, redis.ZRangeByScore{Min: score, Max: score})
+		if err != nil {
+			return nil, err
+		}
+		for _, z := range result {
+			if z.Member.(string) < after.Member.(string) {
+				ret = append(ret, z)
+			}
+		}
+		max = "(" + score
+	}
+	result, err := zrevrange(key, redis.ZRangeByScore{Min: min, Max: max, Count: count})
+	if err != nil {
+		return nil, err
+	}
+	return append(ret, result...), nil
+}
+
+//查询任务列表,按提交时间(有结束时间条件时按结束时间)从新到旧
+func (b *Broker) SearchTasks(q *TaskQuery) (*TaskList, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultTaskListLimit
+	}
+	if q.Limit > MaxTaskListLimit {
+		q.Limit = MaxTaskListLimit
+	}
+	if len(q.State) != 0 && !containsString(TaskStates, q.State) {
+		return nil, ErrInvalidArgument
+	}
+	if len(q.TaskType) != 0 && !containsString(TaskTypeNames, q.TaskType) {
+		return nil, ErrInvalidArgument
+	}
+	list := &TaskList{Tasks: []*TaskInfo{}}
+	var after *redis.Z
+	var err error
+	if len(q.Cursor) != 0 {
+		if after, err = parseTaskCursor(q.Cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	key, min, max := q.index()
+	scanned := 0
+	for {
+		batch, err := scanIndex(b.zrevrangeByScore, key, min, max, after, int64(q.Limit))
+		if err != nil {
+			logger.GetLogger().Errorln("Broker", "SearchTasks", err.Error(), 0, "key", key)
+			return nil, err
+		}
+		if len(batch) == 0 {
+			return list, nil
+		}
+		for i := range batch {
+			after = &batch[i]
+			scanned++
+			info, err := b.getTaskInfo(after.Member.(string))
+			if err != nil {
+				return nil, err
+			}
+			if info != nil && q.match(info) {
+				list.Tasks = append(list.Tasks, info)
+			}
+			if len(list.Tasks) == q.Limit || scanned >= q.Limit*taskListScanFactor {
+				list.NextCursor = formatTaskCursor(after)
+				return list, nil
+			}
+		}
+	}
+}
+
+//定期删除过期的索引项
+func (b *Broker) TrimTaskIndex() {
+	for b.running {
+		b.trimTaskIndex()
+		time.Sleep(indexTrimInterval)
+	}
+}
+
+func (b *Broker) trimTaskIndex() {
+	keys := []string{allIndexKey(), finishedIndexKey()}
+	for _, state := range TaskStates {
+		keys = append(keys, IndexKey("state", state))
+	}
+	for _, taskType := range TaskTypeNames {
+		keys = append(keys, IndexKey("type", taskType))
+	}
+	var dynamicKeys []string
+	var err error
+	if b.IsCluster() {
+		dynamicKeys, err = b.redisClusterClient.SMembers(IndexKeySet).Result()
+	} else {
+		dynamicKeys, err = b.redisClient.SMembers(IndexKeySet).Result()
+	}
+	if err != nil {
+		observeRedisError("broker", "smembers", err)
+		logger.GetLogger().Errorln("Broker", "trimTaskIndex", err.Error(), 0, "key", IndexKeySet)
+	}
+
+	expire := time.Now().Add(-b.indexKeepTime()).UnixNano() / int64(time.Millisecond)
+	max := "(" + strconv.FormatInt(expire, 10)
+	for _, key := range append(keys, dynamicKeys...) {
+		if b.IsCluster() {
+			err = b.redisClusterClient.ZRemRangeByScore(key, "-inf", max).Err()
+		} else {
+			err = b.redisClient.ZRemRangeByScore(key, "-inf", max).Err()
+		}
+		if err != nil {
+			observeRedisError("broker", "zremrangebyscore", err)
+			logger.GetLogger().Errorln("Broker", "trimTaskIndex", err.Error(), 0, "key", key)
+		}
+	}
+	//删除已经为空的可执行文件和标签索引
+	for _, key := range dynamicKeys {
+		var count int64
+		if b.IsCluster() {
+			count, err = b.redisClusterClient.ZCard(key).Result()
+		} else {
+			count, err = b.redisClient.ZCard(key).Result()
+		}
+		if err == nil && count == 0 {
+			if b.IsCluster() {
+				b.redisClusterClient.SRem(IndexKeySet, key)
+			} else {
+				b.redisClient.SRem(IndexKeySet, key)
+			}
+		}
+	}
+}
+
+//任务开始执行或结束时修改状态,结束时记录结束时间
+func (w *Worker) setTaskState(uuid string, state string, finishTime int64) error {
+	key := TaskInfoKey(uuid)
+	var result []interface{}
+	var err error
+	if w.IsCluster() {
+		result, err = w.redisClusterClient.HMGet(key, "state", "submit_time").Result()
+	} else {
+		result, err = w.redisClient.HMGet(key, "state", "submit_time").Result()
+	}
+	if err != nil {
+		observeRedisError("worker", "hmget", err)
+		logger.GetLogger().Errorln("Worker", "setTaskState", err.Error(), 0, "key", key)
+		return err
+	}
+	//升级前提交的任务或者索引已经过期
+	if result[0] == nil {
+		return nil
+	}
+	oldState := hashString(result[0])
+	submitTime, _ := strconv.ParseFloat(hashString(result[1]), 64)
+
+	pairs := []string{"state", state}
+	if finishTime != 0 {
+		pairs = append(pairs, "finish_time", strconv.FormatInt(finishTime, 10))
+	}
+	if w.IsCluster() {
+		err = w.redisClusterClient.HMSet(key, pairs[0], pairs[1], pairs[2:]...).Err()
+	} else {
+		err = w.redisClient.HMSet(key, pairs[0], pairs[1], pairs[2:]...).Err()
+	}
+	if err != nil {
+		observeRedisError("worker", "hmset", err)
+		logger.GetLogger().Errorln("Worker", "setTaskState", err.Error(), 0, "key", key)
+		return err
+	}
+	if oldState != state {
+		if w.IsCluster() {
+			err = w.redisClusterClient.ZRem(IndexKey("state", oldState), uuid).Err()
+		} else {
+			err = w.redisClient.ZRem(IndexKey("state", oldState), uuid).Err()
+		}
+		if err != nil {
+			observeRedisError("worker", "zrem", err)
+			logger.GetLogger().Errorln("Worker", "setTaskState", err.Error(), 0, "key", IndexKey("state", oldState))
+			return err
+		}
+		z := redis.Z{Score: submitTime, Member: uuid}
+		if w.IsCluster() {
+			err = w.redisClusterClient.ZAdd(IndexKey("state", state), z).Err()
+		} else {
+			err = w.redisClient.ZAdd(IndexKey("state", state), z).Err()
+		}
+		if err != nil {
+			observeRedisError("worker", "zadd", err)
+			logger.GetLogger().Errorln("Worker", "setTaskState", err.Error(), 0, "key", IndexKey("state", state))
+			return err
+		}
+	}
+	if finishTime != 0 {
+		z := redis.Z{Score: float64(finishTime), Member: uuid}
+		if w.IsCluster() {
+			err = w.redisClusterClient.ZAdd(finishedIndexKey(), z).Err()
+		} else {
+			err = w.redisClient.ZAdd(finishedIndexKey(), z).Err()
+		}
+		if err != nil {
+			observeRedisError("worker", "zadd", err)
+			logger.GetLogger().Errorln("Worker", "setTaskState", err.Error(), 0, "key", finishedIndexKey())
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package core
+
+import (
+	"fmt"
+	"github.com/pborman/uuid"
+	"gopkg.in/redis.v3"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//内存中的有序集合,按ZREVRANGEBYSCORE的规则返回,分数相同时按成员从大到小
+type fakeIndex struct {
+	members []redis.Z
+	calls   int
+}
+
+func newFakeIndex(members []redis.Z) *fakeIndex {
+	sorted := append([]redis.Z(nil), members...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Score != sorted[j].Score {
+			return sorted[i].Score > sorted[j].Score
+		}
+		return sorted[i].Member.(string) > sorted[j].Member.(string)
+	})
+	return &fakeIndex{members: sorted}
+}
+
+//解析分数范围,(表示不包含边界
+func parseScoreBound(t *testing.T, s string) (float64, bool) {
+	switch s {
+	case "-inf":
+		return -1 << 62, false
+	case "+inf":
+		return 1 << 62, false
+	}
+	exclusive := strings.HasPrefix(s, "(")
+	score, err := strconv.ParseFloat(strings.TrimPrefix(s, "("), 64)
+	if err != nil {
+		t.Fatalf("invalid score bound %q", s)
+	}
+	return score, exclusive
+}
+
+func (f *fakeIndex) zrevrange(t *testing.T) zrevrangeFunc {
+	return func(key string, opt redis.ZRangeByScore) ([]redis.Z, error) {
+		f.calls++
+		min, minEx := parseScoreBound(t, opt.Min)
+		max, maxEx := parseScoreBound(t, opt.Max)
+		var ret []redis.Z
+		for _, z := range f.members {
+			if z.Score < min || minEx && z.Score == min || z.Score > max || maxEx && z.Score == max {
+				continue
+			}
+			if opt.Count > 0 && int64(len(ret)) == opt.Count {
+				break
+			}
+			ret = append(ret, z)
+		}
+		return ret, nil
+	}
+}
+
+//与SearchTasks相同的方式翻页,每页最多limit项,返回所有页的成员和页数
+func pageIndex(t *testing.T, f *fakeIndex, min string, max string, limit int) ([]string, int) {
+	var members []string
+	cursor := ""
+	pages := 0
+	for {
+		var after *redis.Z
+		if len(cursor) != 0 {
+			var err error
+			if after, err = parseTaskCursor(cursor); err != nil {
+				t.Fatalf("parseTaskCursor(%q) error: %v", cursor, err)
+			}
+		}
+		pages++
+		page := 0
+		cursor = ""
+		for len(cursor) == 0 {
+			batch, err := scanIndex(f.zrevrange(t), "index", min, max, after, int64(limit))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(batch) == 0 {
+				return members, pages
+			}
+			for i := range batch {
+				after = &batch[i]
+				members = append(members, after.Member.(string))
+				page++
+				if page == limit {
+					cursor = formatTaskCursor(after)
+					break
+				}
+			}
+		}
+		if pages > len(f.members)+1 {
+			t.Fatalf("pagination does not terminate")
+		}
+	}
+}
+
+func TestScanIndexSameScore(t *testing.T) {
+	const score = 1700000000000
+	var members []redis.Z
+	//大部分任务在同一毫秒提交,前后还有其他任务
+	for i := 0; i < 300; i++ {
+		members = append(members, redis.Z{Score: score, Member: uuid.New()})
+	}
+	for i := 0; i < 20; i++ {
+		members = append(members, redis.Z{Score: score + 1, Member: uuid.New()})
+		members = append(members, redis.Z{Score: score - 1, Member: uuid.New()})
+		members = append(members, redis.Z{Score: float64(score - 1000 - i), Member: uuid.New()})
+	}
+	f := newFakeIndex(members)
+
+	for _, c := range []struct {
+		min string
+		max string
+	}{
+		{"-inf", "+inf"},
+		{strconv.Itoa(score), strconv.Itoa(score)},
+		{strconv.Itoa(score - 1), "+inf"},
+		{"-inf", strconv.Itoa(score)},
+	} {
+		min, minEx := parseScoreBound(t, c.min)
+		max, maxEx := parseScoreBound(t, c.max)
+		var want []string
+		for _, z := range f.members {
+			if z.Score >= min && !(minEx && z.Score == min) && z.Score <= max && !(maxEx && z.Score == max) {
+				want = append(want, z.Member.(string))
+			}
+		}
+		for _, limit := range []int{1, 7, 50, 299, 300, 500} {
+			got, pages := pageIndex(t, f, c.min, c.max, limit)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("range [%s, %s] limit %d: got %d members, want %d", c.min, c.max, limit, len(got), len(want))
+				seen := make(map[string]bool)
+				for _, m := range got {
+					if seen[m] {
+						t.Errorf("duplicate member %s", m)
+					}
+					seen[m] = true
+				}
+				continue
+			}
+			//最后一页正好满时还需要多读一页才知道没有更多
+			if wantPages := len(want)/limit + 1; pages != wantPages {
+				t.Errorf("range [%s, %s] limit %d: %d pages, want %d", c.min, c.max, limit, pages, wantPages)
+			}
+		}
+	}
+}
+
+func TestParseTaskCursor(t *testing.T) {
+	z := &redis.Z{Score: 1700000000123, Member: "f28307d6-c639-4927-aee5-442c41016ad1"}
+	cursor := formatTaskCursor(z)
+	if cursor != "1700000000123:f28307d6-c639-4927-aee5-442c41016ad1" {
+		t.Fatalf("formatTaskCursor = %q", cursor)
+	}
+	got, err := parseTaskCursor(cursor)
+	if err != nil || got.Score != z.Score || got.Member != z.Member {
+		t.Fatalf("parseTaskCursor(%q) = %+v, %v", cursor, got, err)
+	}
+	//成员中的冒号属于成员
+	if got, err = parseTaskCursor("1:a:b"); err != nil || got.Member != "a:b" {
+		t.Errorf("parseTaskCursor(%q) = %+v, %v", "1:a:b", got, err)
+	}
+	for _, s := range []string{"", "1700000000123", "x:uuid", "1.5:uuid", fmt.Sprintf("%d0:uuid", uint64(1)<<63)} {
+		if _, err := parseTaskCursor(s); err != ErrInvalidCursor {
+			t.Errorf("parseTaskCursor(%q) error = %v, want ErrInvalidCursor", s, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+//允许执行的可执行文件清单,格式为"相对于bin_path的文件名: sha256"
+//sha256为空表示允许执行但不校验,清单文件修改后自动重新加载
+type BinManifest struct {
+	sync.Mutex
+	filename string
+	modTime  time.Time
+	entries  map[string]string
+}
+
+func LoadBinManifest(filename string) (*BinManifest, error) {
+	m := new(BinManifest)
+	m.filename = filename
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *BinManifest) reload() error {
+	info, err := os.Stat(m.filename)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(m.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(m.filename)
+	if err != nil {
+		return err
+	}
+	var vec map[string]string
+	if err = yaml.Unmarshal(data, &vec); err != nil {
+		return err
+	}
+	entries := make(map[string]string, len(vec))
+	for name, sum := range vec {
+		entries[path.Clean(name)] = strings.ToLower(strings.TrimSpace(sum))
+	}
+	m.entries = entries
+	m.modTime = info.ModTime()
+	return nil
+}
+
+//查找可执行文件的sha256,第二个返回值表示是否在清单中
+func (m *BinManifest) Lookup(binName string) (string, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	if err := m.reload(); err != nil {
+		return "", false, err
+	}
+	sum, ok := m.entries[path.Clean(binName)]
+	return sum, ok, nil
+}
+
+//可执行文件名必须是bin_path下的相对路径
+func ValidBinName(binName string) bool {
+	if len(binName) == 0 || strings.IndexByte(binName, 0) >= 0 || path.IsAbs(binName) {
+		return false
+	}
+	name := path.Clean(binName)
+	return name != "." && name != ".." && !strings.HasPrefix(name, "../")
+}
+
+//计算文件的sha256
+func fileSHA256(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,225 @@
+package core
+
+import (
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/engine/standard"
+	"github.com/phillihq/ktse/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/redis.v3"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	MetricsPath      = "/metrics"
+	metricsNamespace = "ktse"
+	//任务结果
+	OutcomeSuccess  = "success"
+	OutcomeFailure  = "failure"
+	OutcomeCanceled = "canceled"
+)
+
+var (
+	tasksSubmitted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tasks_submitted_total",
+		Help:      "Tasks submitted to the broker, including scheduled tasks.",
+	}, []string{"task_type"})
+	tasksCompleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tasks_completed_total",
+		Help:      "Task attempts finished by the worker.",
+	}, []string{"outcome", "task_type", "queue", "bin_name"})
+	taskRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "task_retries_total",
+		Help:      "Failed tasks scheduled for another attempt.",
+	}, []string{"task_type"})
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_depth",
+		Help:      "Number of tasks in each redis queue.",
+	}, []string{"queue"})
+	timerPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "timer_pending",
+		Help:      "Scheduled tasks and retries waiting in the broker timer wheel.",
+	})
+	taskQueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "task_queue_wait_seconds",
+		Help:      "Time from the start time of a task to the start of its first attempt.",
+		Buckets:   []float64{1, 2, 5, 10, 30, 60, 300, 900, 1800, 3600},
+	}, []string{"task_type"})
+	taskRunDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "task_run_seconds",
+		Help:      "Run time of task attempts.",
+		Buckets:   []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300, 900, 3600},
+	}, []string{"task_type", "outcome"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of broker API requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "path", "code"})
+	redisErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "redis_errors_total",
+		Help:      "Failed redis commands.",
+	}, []string{"component", "op"})
+)
+
+func init() {
+	prometheus.MustRegister(tasksSubmitted, tasksCompleted, taskRetries, queueDepth, timerPending,
+		taskQueueWait, taskRunDuration, httpDuration, redisErrors)
+}
+
+//指标中的任务类型,RPC任务不区分请求方法
+func taskTypeName(taskType int) string {
+	switch taskType {
+	case ScriptTask:
+		return "script"
+	case RpcTaskGET, RpcTaskPOST, RpcTaskPUT, RpcTaskDELETE, RpcTaskPATCH, RpcTaskHEAD:
+		return "rpc"
+	case GrpcTask:
+		return "grpc"
+	case HandlerTask:
+		return "handler"
+	}
+	return "unknown"
+}
+
+//指标中的可执行文件名,RPC任务使用地址中的主机名,gRPC任务使用方法名,避免标签过多
+func metricBinName(req *TaskRequest) string {
+	switch req.TaskType {
+	case ScriptTask, HandlerTask:
+		return req.BinName
+	case GrpcTask:
+		if req.Grpc != nil {
+			return req.Grpc.Method
+		}
+	case RpcTaskGET, RpcTaskPOST, RpcTaskPUT, RpcTaskDELETE, RpcTaskPATCH, RpcTaskHEAD:
+		if u, err := url.Parse(req.BinName); err == nil {
+			return u.Host
+		}
+	}
+	return ""
+}
+
+func taskOutcome(result *TaskResult) string {
+	if result.Canceled {
+		return OutcomeCanceled
+	}
+	if result.IsSuccess == 1 {
+		return OutcomeSuccess
+	}
+	return OutcomeFailure
+}
+
+//记录redis命令失败,key不存在不算失败
+func observeRedisError(component string, op string, err error) {
+	if err != nil && err != redis.Nil {
+		redisErrors.WithLabelValues(component, op).Inc()
+	}
+}
+
+func observeTaskSubmitted(req *TaskRequest) {
+	tasksSubmitted.WithLabelValues(taskTypeName(req.TaskType)).Inc()
+}
+
+func observeTaskRetry(req *TaskRequest) {
+	taskRetries.WithLabelValues(taskTypeName(req.TaskType)).Inc()
+}
+
+//记录一次执行的结果和耗时,等待时间只记录第一次执行,重试的开始时间不变
+func observeTaskResult(result *TaskResult) {
+	taskType := taskTypeName(result.TaskType)
+	outcome := taskOutcome(result)
+	tasksCompleted.WithLabelValues(outcome, taskType, result.Queue(), metricBinName(&result.TaskRequest)).Inc()
+	taskRunDuration.WithLabelValues(taskType, outcome).Observe(float64(result.ExecEndTime-result.ExecStartTime) / 1000)
+	if result.FirstAttempt() && result.StartTime > 0 {
+		wait := float64(result.ExecStartTime)/1000 - float64(result.StartTime)
+		if wait < 0 {
+			wait = 0
+		}
+		taskQueueWait.WithLabelValues(taskType).Observe(wait)
+	}
+}
+
+//记录API请求耗时,path使用路由地址
+func (b *Broker) metricsMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			code := c.Response().Status()
+			if err != nil {
+				code = http.StatusInternalServerError
+				if he, ok := err.(*echo.HTTPError); ok {
+					code = he.Code
+				}
+			}
+			route := c.Path()
+			if len(route) == 0 {
+				route = "unmatched"
+			}
+			httpDuration.WithLabelValues(c.Request().Method(), route, strconv.Itoa(code)).Observe(time.Since(start).Seconds())
+			return err
+		}
+	}
+}
+
+//采集时更新队列长度和定时器中等待的任务数
+func (b *Broker) updateMetrics() {
+	queues, err := b.Queues()
+	observeRedisError("broker", "smembers", err)
+	if err != nil {
+		queues = []string{RequestUuidSet}
+	}
+	for _, queue := range append(queues, FailResultUuidSet) {
+		var count int64
+		var err error
+		if b.IsCluster() {
+			count, err = b.redisClusterClient.SCard(queue).Result()
+		} else {
+			count, err = b.redisClient.SCard(queue).Result()
+		}
+		observeRedisError("broker", "scard", err)
+		if err == nil {
+			queueDepth.WithLabelValues(queue).Set(float64(count))
+		}
+	}
+	var count int64
+	if b.IsCluster() {
+		count, err = b.redisClusterClient.ZCard(CallbackQueue).Result()
+	} else {
+		count, err = b.redisClient.ZCard(CallbackQueue).Result()
+	}
+	observeRedisError("broker", "zcard", err)
+	if err == nil {
+		queueDepth.WithLabelValues(CallbackQueue).Set(float64(count))
+	}
+	if b.timer != nil {
+		timerPending.Set(float64(b.timer.Pending()))
+	}
+}
+
+//Prometheus指标
+func (b *Broker) Metrics(c echo.Context) error {
+	b.updateMetrics()
+	return standard.WrapHandler(promhttp.Handler())(c)
+}
+
+//worker单独监听的指标地址,为空表示不开启
+func (w *Worker) runMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, promhttp.Handler())
+	server := &http.Server{Addr: w.cfg.MetricsAddr, Handler: mux}
+	if err := server.ListenAndServe(); err != nil {
+		logger.GetLogger().Errorln("Worker", "runMetrics", err.Error(), 0, "addr", w.cfg.MetricsAddr)
+	}
+}
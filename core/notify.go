@@ -0,0 +1,167 @@
+package core
+
+import (
+	"github.com/phillihq/ktse/logger"
+	"gopkg.in/redis.v3"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//任务结果写入后,worker向该频道发布任务uuid
+	ResultChannel = "ktse_result"
+	//查询结果时最长的等待时间,单位为秒
+	MaxResultWaitTime = 60
+	//一次最多订阅的任务数
+	MaxWatchUuidCount = 1000
+)
+
+//订阅任务结果频道,通知等待结果的请求
+//集群模式下PUBLISH会广播到所有节点,所以发布和订阅都使用单实例客户端连接任一节点
+type resultNotifier struct {
+	sync.Mutex
+	pubsub  *redis.PubSub
+	waiters map[string]map[chan string]struct{}
+}
+
+func newResultNotifier() *resultNotifier {
+	return &resultNotifier{waiters: make(map[string]map[chan string]struct{})}
+}
+
+//订阅频道并分发消息,直到broker关闭
+func (b *Broker) runNotifier() {
+	n := b.notifier
+	for b.running {
+		pubsub, err := b.redisClient.Subscribe(ResultChannel)
+		if err != nil {
+			logger.GetLogger().Errorln("Broker", "runNotifier", "subscribe error", 0, "err", err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		n.Lock()
+		n.pubsub = pubsub
+		n.Unlock()
+		//重新订阅期间可能丢失消息,通知所有等待者重新查询
+		n.notifyAll()
+		for b.running {
+			msg, err := pubsub.ReceiveMessage()
+			if err != nil {
+				if b.running {
+					logger.GetLogger().Errorln("Broker", "runNotifier", "receive error", 0, "err", err.Error())
+				}
+				break
+			}
+			n.notify(msg.Payload)
+		}
+		pubsub.Close()
+	}
+}
+
+//关闭订阅,正在阻塞的ReceiveMessage会返回
+func (n *resultNotifier) Close() {
+	n.Lock()
+	defer n.Unlock()
+	if n.pubsub != nil {
+		n.pubsub.Close()
+	}
+}
+
+//监听任务结果,返回的channel在任务结束时收到uuid,收到空字符串时需要重新查询所有任务
+func (n *resultNotifier) Watch(uuids ...string) chan string {
+	ch := make(chan string, len(uuids)+1)
+	n.Lock()
+	defer n.Unlock()
+	for _, uuid := range uuids {
+		if n.waiters[uuid] == nil {
+			n.waiters[uuid] = make(map[chan string]struct{})
+		}
+		n.waiters[uuid][ch] = struct{}{}
+	}
+	return ch
+}
+
+func (n *resultNotifier) Unwatch(ch chan string, uuids ...string) {
+	n.Lock()
+	defer n.Unlock()
+	for _, uuid := range uuids {
+		delete(n.waiters[uuid], ch)
+		if len(n.waiters[uuid]) == 0 {
+			delete(n.waiters, uuid)
+		}
+	}
+}
+
+func (n *resultNotifier) notify(uuid string) {
+	n.Lock()
+	defer n.Unlock()
+	for ch := range n.waiters[uuid] {
+		select {
+		case ch <- uuid:
+		default:
+		}
+	}
+}
+
+func (n *resultNotifier) notifyAll() {
+	n.Lock()
+	defer n.Unlock()
+	for _, waiters := range n.waiters {
+		for ch := range waiters {
+			select {
+			case ch <- "":
+			default:
+			}
+		}
+	}
+}
+
+//发布任务结束的消息
+func (w *Worker) PublishResult(uuid string) error {
+	return w.redisClient.Publish(ResultChannel, uuid).Err()
+}
+
+//broker确定失败的任务不再重试时发布任务结束的消息
+func (b *Broker) PublishResult(uuid string) error {
+	return b.redisClient.Publish(ResultChannel, uuid).Err()
+}
+
+//查询任务结果,结果不存在或者失败后还会重试时最多等待wait时间
+func (b *Broker) WaitTaskResult(uuid string, wait time.Duration) (*Reply, error) {
+	if wait <= 0 {
+		return b.HandleTaskResult(uuid)
+	}
+	//先监听再查询,避免错过查询之后写入的结果
+	ch := b.notifier.Watch(uuid)
+	defer b.notifier.Unwatch(ch, uuid)
+	timeout := time.After(wait)
+	for {
+		reply, err := b.HandleTaskResult(uuid)
+		if err != ErrResultNotExist && (err != nil || !reply.Retrying) {
+			return reply, err
+		}
+		select {
+		case <-ch:
+		case <-timeout:
+			return reply, err
+		}
+	}
+}
+
+//解析逗号分隔的uuid列表,去掉重复和空的uuid
+func ParseUuidList(s string) ([]string, error) {
+	var uuids []string
+	seen := make(map[string]bool)
+	for _, uuid := range strings.Split(s, ",") {
+		uuid = strings.TrimSpace(uuid)
+		if len(uuid) == 0 || seen[uuid] {
+			continue
+		}
+		seen[uuid] = true
+		uuids = append(uuids, uuid)
+	}
+	if len(uuids) == 0 || len(uuids) > MaxWatchUuidCount {
+		return nil, ErrInvalidArgument
+	}
+	return uuids, nil
+}
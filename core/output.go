@@ -0,0 +1,172 @@
+package core
+
+import (
+	"fmt"
+	"github.com/phillihq/ktse/logger"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultOutputLimit = 1024 * 1024 //每个输出流在结果中保存的最大字节数
+	logDateFormat      = "20060102"
+)
+
+//保存输出的开头和结尾部分,超过限制时丢弃中间部分并插入截断标记
+type cappedBuffer struct {
+	headLimit int
+	tailLimit int
+	head      []byte
+	tail      []byte
+	total     int64
+}
+
+//limit小于等于0表示不限制
+func newCappedBuffer(limit int64) *cappedBuffer {
+	b := new(cappedBuffer)
+	if limit <= 0 {
+		b.headLimit = int(^uint(0) >> 1)
+	} else {
+		b.headLimit = int(limit / 2)
+		b.tailLimit = int(limit) - b.headLimit
+	}
+	return b
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	b.total += int64(n)
+	if len(b.head) < b.headLimit {
+		size := b.headLimit - len(b.head)
+		if size > len(p) {
+			size = len(p)
+		}
+		b.head = append(b.head, p[:size]...)
+		p = p[size:]
+	}
+	if len(p) != 0 && b.tailLimit > 0 {
+		b.tail = append(b.tail, p...)
+		//保留两倍的空间,减少数据搬移
+		if len(b.tail) > 2*b.tailLimit {
+			b.tail = append(b.tail[:0:0], b.tail[len(b.tail)-b.tailLimit:]...)
+		}
+	}
+	return n, nil
+}
+
+//输出的总字节数
+func (b *cappedBuffer) Len() int64 {
+	return b.total
+}
+
+func (b *cappedBuffer) String() string {
+	tail := b.tail
+	if len(tail) > b.tailLimit {
+		tail = tail[len(tail)-b.tailLimit:]
+	}
+	dropped := b.total - int64(len(b.head)) - int64(len(tail))
+	if dropped <= 0 {
+		return string(b.head) + string(tail)
+	}
+	return string(b.head) + fmt.Sprintf("\n...[truncated %d bytes]...\n", dropped) + string(tail)
+}
+
+//任务完整输出的存储
+type LogStore interface {
+	//创建保存输出的文件,返回写入对象和引用(保存在任务结果中)
+	Create(uuid string, index int, stream string) (io.WriteCloser, string, error)
+	//根据引用读取输出
+	Open(ref string) (io.ReadCloser, error)
+	//删除keep之前的输出
+	Clean(keep time.Duration) error
+}
+
+//根据配置创建输出存储,目前只支持本地目录(可以是共享存储),例如/data/ktse/logs或file:///data/ktse/logs
+func NewLogStore(uri string) (LogStore, error) {
+	if strings.HasPrefix(uri, "file://") {
+		uri = strings.TrimPrefix(uri, "file://")
+	} else if strings.Contains(uri, "://") {
+		return nil, ErrInvalidLogStore
+	}
+	if err := os.MkdirAll(uri, 0755); err != nil {
+		return nil, err
+	}
+	return &FileLogStore{dir: uri}, nil
+}
+
+//按日期目录保存输出文件:<dir>/<yyyymmdd>/<uuid>.<index>.<stream>.log
+type FileLogStore struct {
+	dir string
+}
+
+func (s *FileLogStore) Create(uuid string, index int, stream string) (io.WriteCloser, string, error) {
+	date := time.Now().Format(logDateFormat)
+	if err := os.MkdirAll(filepath.Join(s.dir, date), 0755); err != nil {
+		return nil, "", err
+	}
+	ref := fmt.Sprintf("%s/%s.%d.%s.log", date, uuid, index, stream)
+	f, err := os.Create(filepath.Join(s.dir, filepath.FromSlash(ref)))
+	if err != nil {
+		return nil, "", err
+	}
+	return &logFile{file: f, ref: ref}, ref, nil
+}
+
+func (s *FileLogStore) Open(ref string) (io.ReadCloser, error) {
+	if !ValidBinName(ref) {
+		return nil, ErrPathNotAllowed
+	}
+	f, err := os.Open(filepath.Join(s.dir, filepath.FromSlash(ref)))
+	if err != nil && os.IsNotExist(err) {
+		return nil, ErrLogNotExist
+	}
+	return f, err
+}
+
+func (s *FileLogStore) Clean(keep time.Duration) error {
+	vec, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	expire := time.Now().Add(-keep)
+	for _, info := range vec {
+		if !info.IsDir() {
+			continue
+		}
+		date, err := time.ParseInLocation(logDateFormat, info.Name(), time.Local)
+		if err != nil {
+			continue
+		}
+		//目录中最晚的文件在第二天零点之前写入
+		if date.AddDate(0, 0, 1).Before(expire) {
+			if err = os.RemoveAll(filepath.Join(s.dir, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//写入失败时只记录日志,不影响脚本执行
+type logFile struct {
+	file *os.File
+	ref  string
+	err  error
+}
+
+func (f *logFile) Write(p []byte) (int, error) {
+	if f.err == nil {
+		if _, f.err = f.file.Write(p); f.err != nil {
+			logger.GetLogger().Errorln("worker", "logFile", "write error", 0, "ref", f.ref, "err", f.err.Error())
+		}
+	}
+	return len(p), nil
+}
+
+func (f *logFile) Close() error {
+	return f.file.Close()
+}
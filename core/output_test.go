@@ -0,0 +1,64 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCappedBuffer(t *testing.T) {
+	for _, c := range []struct {
+		limit  int64
+		writes []string
+		want   string
+	}{
+		{0, []string{"abc", "def"}, "abcdef"},
+		{-1, []string{strings.Repeat("x", 10000)}, strings.Repeat("x", 10000)},
+		{10, nil, ""},
+		{10, []string{"0123456789"}, "0123456789"},
+		{10, []string{"01234", "56789"}, "0123456789"},
+		//超过限制时保留开头和结尾
+		{10, []string{"0123456789a"}, "01234\n...[truncated 1 bytes]...\n6789a"},
+		{10, []string{"0123", "4567", "89ab", "cdef"}, "01234\n...[truncated 6 bytes]...\nbcdef"},
+		{11, []string{"abcdefghijklmnopqrstuvwxyz"}, "abcde\n...[truncated 15 bytes]...\nuvwxyz"},
+		//结尾部分多次写入后仍然是最后的字节
+		{4, []string{"ab", "c", "d", "e", "f", "g", "h", "i", "j"}, "ab\n...[truncated 6 bytes]...\nij"},
+		{1, []string{"abc"}, "\n...[truncated 2 bytes]...\nc"},
+	} {
+		b := newCappedBuffer(c.limit)
+		var total int64
+		for _, s := range c.writes {
+			n, err := b.Write([]byte(s))
+			if n != len(s) || err != nil {
+				t.Errorf("limit %d: Write(%q) = %d, %v", c.limit, s, n, err)
+			}
+			total += int64(len(s))
+		}
+		if got := b.String(); got != c.want {
+			t.Errorf("limit %d writes %q: String() = %q, want %q", c.limit, c.writes, got, c.want)
+		}
+		if b.Len() != total {
+			t.Errorf("limit %d: Len() = %d, want %d", c.limit, b.Len(), total)
+		}
+	}
+}
+
+//大量小块写入时结尾部分的内存不超过限制的两倍
+func TestCappedBufferTail(t *testing.T) {
+	const limit = 64
+	b := newCappedBuffer(limit)
+	var all strings.Builder
+	for i := 0; i < 10000; i++ {
+		s := fmt.Sprintf("%d,", i)
+		b.Write([]byte(s))
+		all.WriteString(s)
+		if len(b.tail) > 2*b.tailLimit {
+			t.Fatalf("tail grows to %d bytes", len(b.tail))
+		}
+	}
+	s := all.String()
+	want := s[:limit/2] + fmt.Sprintf("\n...[truncated %d bytes]...\n", len(s)-limit) + s[len(s)-limit/2:]
+	if got := b.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
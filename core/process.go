@@ -0,0 +1,69 @@
+package core
+
+import (
+	"github.com/phillihq/ktse/logger"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultKillGracePeriod = 5 //SIGTERM之后等待进程退出的时间,单位为秒
+	killWaitTime           = time.Second * 5
+	processCheckInterval   = time.Millisecond * 50
+	//组长进程退出后等待输出管道关闭的时间,后台子进程仍持有管道时不再等待
+	outputWaitDelay = time.Second
+)
+
+//SIGTERM之后等待进程退出的时间
+func (w *Worker) killGracePeriod() time.Duration {
+	if w.cfg.KillGracePeriod <= 0 {
+		return time.Second * DefaultKillGracePeriod
+	}
+	return time.Second * time.Duration(w.cfg.KillGracePeriod)
+}
+
+//终止进程组:先发送SIGTERM,宽限期后仍未退出则发送SIGKILL,直到进程组中没有进程
+//errCh不为nil表示组长进程还没有被回收,需要等待cmd.Wait返回;返回值表示进程组是否已经全部退出
+func (w *Worker) stopProcessGroup(pgid int, errCh <-chan error) bool {
+	if errCh == nil && !processGroupAlive(pgid) {
+		return true
+	}
+	syscall.Kill(-pgid, syscall.SIGTERM)
+	if waitProcessGroup(pgid, &errCh, w.killGracePeriod()) {
+		return true
+	}
+	logger.GetLogger().Infoln("worker", "stopProcessGroup", "send SIGKILL", 0, "pgid", pgid)
+	syscall.Kill(-pgid, syscall.SIGKILL)
+	if waitProcessGroup(pgid, &errCh, killWaitTime) {
+		return true
+	}
+	logger.GetLogger().Errorln("worker", "stopProcessGroup", ErrProcessGroupAlive.Error(), 0, "pgid", pgid)
+	return false
+}
+
+//等待组长进程被回收并且进程组中所有进程退出
+func waitProcessGroup(pgid int, errCh *<-chan error, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if *errCh != nil {
+			select {
+			case <-*errCh:
+				*errCh = nil
+			default:
+			}
+		}
+		if *errCh == nil && !processGroupAlive(pgid) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(processCheckInterval)
+	}
+}
+
+//进程组中是否还有进程
+func processGroupAlive(pgid int) bool {
+	err := syscall.Kill(-pgid, 0)
+	return err == nil || err == syscall.EPERM
+}
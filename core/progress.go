@@ -0,0 +1,352 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/phillihq/ktse/logger"
+	"gopkg.in/redis.v3"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//脚本通过该文件描述符写入进度,每行格式为"KTSE_PROGRESS <0-100> [message]"
+	ProgressFdEnv    = "KTSE_PROGRESS_FD"
+	progressFd       = 3
+	progressPrefix   = "KTSE_PROGRESS"
+	progressMsgSize  = 1024
+	progressInterval = time.Millisecond * 500 //两次写入redis的最小间隔
+	//RPC任务请求中携带的任务uuid,服务端可以据此调用broker的进度接口
+	TaskUuidHeader = "X-Ktse-Task-Uuid"
+)
+
+//任务状态
+const (
+	TaskStatusPending  = "pending"
+	TaskStatusRunning  = "running"
+	TaskStatusFinished = "finished"
+	TaskStatusRetrying = "retrying" //失败后等待重试,结果为上一次执行的结果
+)
+
+//任务进度
+type Progress struct {
+	Percent    int    `json:"percent"`
+	Message    string `json:"message"`
+	UpdateTime int64  `json:"update_time"` //毫秒时间戳
+}
+
+//任务状态查询结果
+type TaskStatus struct {
+	Uuid     string    `json:"uuid"`
+	Status   string    `json:"status"`
+	WorkerId string    `json:"worker_id,omitempty"`
+	Progress *Progress `json:"progress,omitempty"`
+	Result   *Reply    `json:"result,omitempty"` //任务结束后的结果
+	//任务结束后回调的投递记录
+	Callback *CallbackStatus `json:"callback,omitempty"`
+}
+
+//进度在redis中的key(hash),任务开始执行时创建
+func ProgressKey(uuid string) string {
+	return fmt.Sprintf("p_%s", uuid)
+}
+
+//解析进度行,不是进度行或格式错误时返回false
+func ParseProgressLine(line string) (*Progress, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, progressPrefix+" ") {
+		return nil, false
+	}
+	vec := strings.SplitN(strings.TrimSpace(line[len(progressPrefix):]), " ", 2)
+	percent, err := strconv.ParseFloat(vec[0], 64)
+	//NaN不能转换成整数
+	if err != nil || math.IsNaN(percent) {
+		return nil, false
+	}
+	if percent < 0 {
+		percent = 0
+	} else if percent > 100 {
+		percent = 100
+	}
+	p := &Progress{Percent: int(percent)}
+	if len(vec) == 2 {
+		p.Message = strings.TrimSpace(vec[1])
+		if len(p.Message) > progressMsgSize {
+			p.Message = p.Message[:progressMsgSize]
+		}
+	}
+	return p, true
+}
+
+//进度hash的field/value序列
+func (p *Progress) redisPairs() []string {
+	return []string{
+		"percent", strconv.Itoa(p.Percent),
+		"message", p.Message,
+		"update_time", strconv.FormatInt(p.UpdateTime, 10),
+	}
+}
+
+//根据HMGET(percent, message, update_time)的结果构造进度,没有进度时返回nil
+func parseProgress(result []interface{}) *Progress {
+	if len(result) != 3 || result[0] == nil || len(hashString(result[0])) == 0 {
+		return nil
+	}
+	p := new(Progress)
+	p.Percent, _ = strconv.Atoi(hashString(result[0]))
+	p.Message = hashString(result[1])
+	p.UpdateTime, _ = strconv.ParseInt(hashString(result[2]), 10, 64)
+	return p
+}
+
+//任务开始执行时创建进度,记录执行任务的worker并清除之前执行的进度
+func (w *Worker) StartProgress(uuid string) error {
+	return w.setProgress(uuid, []string{"worker_id", w.id, "percent", "", "message", "", "update_time", ""})
+}
+
+//写入任务进度
+func (w *Worker) SetProgress(uuid string, p *Progress) error {
+	return w.setProgress(uuid, append(p.redisPairs(), "worker_id", w.id))
+}
+
+//写入进度hash,并设置和结果相同的过期时间
+func (w *Worker) setProgress(uuid string, pairs []string) error {
+	key := ProgressKey(uuid)
+	expire := time.Second * time.Duration(w.cfg.ResultKeepTime)
+	var err error
+	if w.IsCluster() {
+		err = w.redisClusterClient.HMSet(key, pairs[0], pairs[1], pairs[2:]...).Err()
+		if err == nil {
+			err = w.redisClusterClient.Expire(key, expire).Err()
+		}
+	} else {
+		err = w.redisClient.HMSet(key, pairs[0], pairs[1], pairs[2:]...).Err()
+		if err == nil {
+			err = w.redisClient.Expire(key, expire).Err()
+		}
+	}
+	if err != nil {
+		logger.GetLogger().Errorln("Worker", "SetProgress", err.Error(), 0, "key", key)
+	}
+	return err
+}
+
+//读取任务最后一次上报的进度
+func (w *Worker) GetProgress(uuid string) (*Progress, error) {
+	var result []interface{}
+	var err error
+	if w.IsCluster() {
+		result, err = w.redisClusterClient.HMGet(ProgressKey(uuid), "percent", "message", "update_time").Result()
+	} else {
+		result, err = w.redisClient.HMGet(ProgressKey(uuid), "percent", "message", "update_time").Result()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseProgress(result), nil
+}
+
+//读取脚本写入的进度行并写入redis,写入过于频繁时只保留最新的进度,
+//在距离上一次写入progressInterval后写入
+type progressReader struct {
+	w    *Worker
+	uuid string
+	done chan struct{}
+	sync.Mutex
+	last    time.Time
+	pending *Progress
+	timer   *time.Timer
+	//保证写入redis的顺序与进度的顺序相同
+	writeLock sync.Mutex
+}
+
+//创建脚本写入进度的管道,写入端需要通过ExtraFiles传给脚本
+func (w *Worker) newProgressReader(uuid string) (*progressReader, *os.File, error) {
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	pr := &progressReader{w: w, uuid: uuid, done: make(chan struct{})}
+	go pr.run(r)
+	return pr, pw, nil
+}
+
+func (pr *progressReader) run(r *os.File) {
+	defer close(pr.done)
+	defer r.Close()
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if p, ok := ParseProgressLine(strings.TrimRight(line, "\n")); ok {
+			pr.update(p)
+		}
+		if err != nil {
+			if err != io.EOF {
+				logger.GetLogger().Errorln("Worker", "progressReader", err.Error(), 0, "key", ProgressKey(pr.uuid))
+			}
+			break
+		}
+	}
+	pr.Lock()
+	if pr.timer != nil {
+		pr.timer.Stop()
+	}
+	pr.Unlock()
+	pr.flush()
+}
+
+func (pr *progressReader) update(p *Progress) {
+	now := time.Now()
+	p.UpdateTime = now.UnixNano() / int64(time.Millisecond)
+	pr.Lock()
+	pr.pending = p
+	if wait := progressInterval - now.Sub(pr.last); wait > 0 {
+		if pr.timer == nil {
+			pr.timer = time.AfterFunc(wait, pr.flush)
+		}
+		pr.Unlock()
+		return
+	}
+	pr.Unlock()
+	pr.flush()
+}
+
+//写入最新的进度
+func (pr *progressReader) flush() {
+	pr.writeLock.Lock()
+	defer pr.writeLock.Unlock()
+	pr.Lock()
+	p := pr.pending
+	pr.pending = nil
+	pr.timer = nil
+	if p != nil {
+		pr.last = time.Now()
+	}
+	pr.Unlock()
+	if p != nil {
+		pr.w.SetProgress(pr.uuid, p)
+	}
+}
+
+//等待进度全部写入redis,脚本遗留的进程仍持有管道时最多等待killWaitTime
+func (pr *progressReader) Wait() {
+	select {
+	case <-pr.done:
+	case <-time.After(killWaitTime):
+		logger.GetLogger().Errorln("Worker", "progressReader", "wait timeout", 0, "key", ProgressKey(pr.uuid))
+	}
+}
+
+//查询任务状态:已结束的任务返回结果,执行中的任务返回进度
+func (b *Broker) HandleTaskStatus(uuid string) (*TaskStatus, error) {
+	if len(uuid) == 0 {
+		return nil, ErrInvalidArgument
+	}
+	status := &TaskStatus{Uuid: uuid}
+	reply, err := b.HandleTaskResult(uuid)
+	if err == nil {
+		status.Status = TaskStatusFinished
+		if reply.Retrying {
+			status.Status = TaskStatusRetrying
+		}
+		status.WorkerId = reply.WorkerId
+		status.Progress = reply.Progress
+		status.Result = reply
+		status.Callback, _ = b.HandleTaskCallback(uuid)
+		return status, nil
+	}
+	if err != ErrResultNotExist {
+		return nil, err
+	}
+
+	var result []interface{}
+	if b.IsCluster() {
+		result, err = b.redisClusterClient.HMGet(ProgressKey(uuid), "percent", "message", "update_time", "worker_id").Result()
+	} else {
+		result, err = b.redisClient.HMGet(ProgressKey(uuid), "percent", "message", "update_time", "worker_id").Result()
+	}
+	if err != nil {
+		logger.GetLogger().Errorln("Broker", "HandleTaskStatus", err.Error(), 0, "key", ProgressKey(uuid))
+		return nil, err
+	}
+	if result[3] != nil {
+		status.Status = TaskStatusRunning
+		status.WorkerId = hashString(result[3])
+		status.Progress = parseProgress(result[:3])
+		return status, nil
+	}
+
+	var exist bool
+	if b.IsCluster() {
+		exist, err = b.redisClusterClient.Exists(fmt.Sprintf("t_%s", uuid)).Result()
+	} else {
+		exist, err = b.redisClient.Exists(fmt.Sprintf("t_%s", uuid)).Result()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if exist {
+		status.Status = TaskStatusPending
+		return status, nil
+	}
+	//等待重试和还没有到开始时间的任务不在队列中,从索引中读取状态
+	info, err := b.getTaskInfo(uuid)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, ErrTaskNotExist
+	}
+	switch info.State {
+	case TaskStateRetrying:
+		status.Status = TaskStatusRetrying
+	case TaskStateScheduled:
+		status.Status = TaskStatusPending
+	default:
+		return nil, ErrTaskNotExist
+	}
+	return status, nil
+}
+
+//RPC任务的服务端上报进度,只接受正在执行的任务
+func (b *Broker) HandleTaskProgress(uuid string, p *Progress) error {
+	if len(uuid) == 0 || p.Percent < 0 || p.Percent > 100 {
+		return ErrInvalidArgument
+	}
+	if len(p.Message) > progressMsgSize {
+		p.Message = p.Message[:progressMsgSize]
+	}
+	p.UpdateTime = time.Now().UnixNano() / int64(time.Millisecond)
+	finished, err := b.IsTaskFinished(uuid)
+	if err != nil {
+		return err
+	}
+	key := ProgressKey(uuid)
+	var workerId string
+	if b.IsCluster() {
+		workerId, err = b.redisClusterClient.HGet(key, "worker_id").Result()
+	} else {
+		workerId, err = b.redisClient.HGet(key, "worker_id").Result()
+	}
+	if err == redis.Nil || finished {
+		return ErrTaskNotRunning
+	}
+	if err != nil {
+		return err
+	}
+	pairs := append(p.redisPairs(), "worker_id", workerId)
+	if b.IsCluster() {
+		err = b.redisClusterClient.HMSet(key, pairs[0], pairs[1], pairs[2:]...).Err()
+	} else {
+		err = b.redisClient.HMSet(key, pairs[0], pairs[1], pairs[2:]...).Err()
+	}
+	if err != nil {
+		logger.GetLogger().Errorln("Broker", "HandleTaskProgress", err.Error(), 0, "key", key)
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+package core
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProgressLine(t *testing.T) {
+	long := strings.Repeat("x", progressMsgSize+10)
+	for _, c := range []struct {
+		line string
+		want *Progress
+	}{
+		{"KTSE_PROGRESS 42", &Progress{Percent: 42}},
+		{"KTSE_PROGRESS 42 processed 420/1000", &Progress{Percent: 42, Message: "processed 420/1000"}},
+		{"KTSE_PROGRESS   7   spaces  ", &Progress{Percent: 7, Message: "spaces"}},
+		{"KTSE_PROGRESS 12.9", &Progress{Percent: 12}},
+		//超出范围时取边界值
+		{"KTSE_PROGRESS -5", &Progress{Percent: 0}},
+		{"KTSE_PROGRESS 150 done", &Progress{Percent: 100, Message: "done"}},
+		{"KTSE_PROGRESS +Inf", &Progress{Percent: 100}},
+		{"KTSE_PROGRESS -Inf", &Progress{Percent: 0}},
+		//换行符
+		{"KTSE_PROGRESS 10\r", &Progress{Percent: 10}},
+		{"KTSE_PROGRESS 10 step one\r\n", &Progress{Percent: 10, Message: "step one"}},
+		//说明最多progressMsgSize字节
+		{"KTSE_PROGRESS 1 " + long, &Progress{Percent: 1, Message: long[:progressMsgSize]}},
+		//不是进度行
+		{"", nil},
+		{"KTSE_PROGRESS", nil},
+		{"KTSE_PROGRESS ", nil},
+		{"KTSE_PROGRESS42", nil},
+		{"KTSE_PROGRESS\t42", nil},
+		{"ktse_progress 42", nil},
+		{" KTSE_PROGRESS 42", nil},
+		{"KTSE_PROGRESS abc", nil},
+		{"KTSE_PROGRESS 42%", nil},
+		{"KTSE_PROGRESS NaN", nil},
+		{"KTSE_PROGRESS nan message", nil},
+	} {
+		got, ok := ParseProgressLine(c.line)
+		if ok != (c.want != nil) || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ParseProgressLine(%q) = %+v, %t, want %+v", c.line, got, ok, c.want)
+		}
+	}
+}
@@ -0,0 +1,465 @@
+package core
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//RPC任务的请求体编码
+const (
+	RpcBodyJson = "json" //args原样发送,Content-Type为application/json
+	RpcBodyForm = "form" //args为JSON对象,编码为application/x-www-form-urlencoded
+	RpcBodyRaw  = "raw"  //args原样发送,Content-Type由content_type指定
+)
+
+//RPC认证方式
+const (
+	RpcAuthBasic  = "basic"
+	RpcAuthBearer = "bearer"
+)
+
+//RPC任务的附加参数,认证信息和TLS配置只保存名称,内容在worker的配置中
+type RpcOption struct {
+	Headers     map[string]string `json:"headers,omitempty"`
+	Query       map[string]string `json:"query,omitempty"` //追加到url中的查询参数
+	Auth        string            `json:"auth,omitempty"`  //worker配置rpc_secrets中的名称
+	BodyType    string            `json:"body_type,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Tls         string            `json:"tls,omitempty"` //worker配置rpc_tls中的名称
+	SkipVerify  bool              `json:"skip_verify,omitempty"`
+	//成功的状态码,空格分隔,支持范围,例如"200-299 304",为空时使用worker的配置
+	SuccessStatus string `json:"success_status,omitempty"`
+	//响应体需要满足的条件:正则表达式,或者JSON路径(例如data.items.0.id)及其值
+	BodyRegex string `json:"body_regex,omitempty"`
+	JsonPath  string `json:"json_path,omitempty"`
+	JsonValue string `json:"json_value,omitempty"`
+}
+
+const (
+	//判断成功条件时最多读取的响应体字节数
+	rpcBodyLimit = 16 * 1024 * 1024
+	//任务和worker都没有设置最长运行时间时使用的值,单位为秒
+	DefaultTaskRunTime = 3600
+	//RPC连接超时(秒)和每个地址保留的空闲连接数
+	DefaultRpcConnectTimeout = 10
+	DefaultRpcMaxIdleConns   = 16
+)
+
+//RPC调用的响应,Body最多保存output_limit字节
+type RpcResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       string
+	raw        []byte //判断成功条件使用的完整响应体
+}
+
+//worker配置的RPC认证信息
+type RpcSecret struct {
+	Type     string `yaml:"type"` //basic或bearer
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Token    string `yaml:"token"`
+}
+
+//worker配置的RPC TLS选项
+type RpcTlsConfig struct {
+	CaFile     string `yaml:"ca_file"` //自定义CA证书
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	SkipVerify bool   `yaml:"skip_verify"`
+}
+
+//是否没有设置任何选项,所有字段都是omitempty,新增字段不需要修改这里
+func (o *RpcOption) IsEmpty() bool {
+	data, err := json.Marshal(o)
+	return err == nil && string(data) == "{}"
+}
+
+//校验RPC任务的附加参数,nil表示没有附加参数
+func (o *RpcOption) Check() error {
+	if o == nil {
+		return nil
+	}
+	for name, value := range o.Headers {
+		if !validHeaderName(name) || strings.ContainsAny(value, "\r\n\x00") {
+			return ErrInvalidRpcOption
+		}
+	}
+	switch o.BodyType {
+	case "", RpcBodyJson, RpcBodyForm:
+		if len(o.ContentType) != 0 {
+			return ErrInvalidRpcOption
+		}
+	case RpcBodyRaw:
+		if len(o.ContentType) == 0 || strings.ContainsAny(o.ContentType, "\r\n\x00") {
+			return ErrInvalidRpcOption
+		}
+	default:
+		return ErrInvalidRpcOption
+	}
+	if _, err := ParseStatusRanges(o.SuccessStatus); err != nil {
+		return err
+	}
+	if len(o.BodyRegex) != 0 {
+		if _, err := regexp.Compile(o.BodyRegex); err != nil {
+			return ErrInvalidRpcOption
+		}
+	}
+	if len(o.JsonValue) != 0 && len(o.JsonPath) == 0 {
+		return ErrInvalidRpcOption
+	}
+	return nil
+}
+
+//解析空格分隔的状态码或状态码范围
+func ParseStatusRanges(s string) ([][2]int, error) {
+	var vec [][2]int
+	for _, str := range strings.Fields(s) {
+		var r [2]int
+		var err error
+		bounds := strings.SplitN(str, "-", 2)
+		if r[0], err = strconv.Atoi(bounds[0]); err != nil {
+			return nil, ErrInvalidRpcOption
+		}
+		r[1] = r[0]
+		if len(bounds) == 2 {
+			if r[1], err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, ErrInvalidRpcOption
+			}
+		}
+		if r[0] < 100 || r[1] > 599 || r[0] > r[1] {
+			return nil, ErrInvalidRpcOption
+		}
+		vec = append(vec, r)
+	}
+	return vec, nil
+}
+
+func containsStatus(ranges [][2]int, status int) bool {
+	for _, r := range ranges {
+		if status >= r[0] && status <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+//任务的成功状态码,任务未设置时使用worker的配置,默认只有200表示成功
+func (w *Worker) rpcSuccessStatus(opt *RpcOption) ([][2]int, error) {
+	str := w.cfg.RpcSuccessStatus
+	if opt != nil && len(opt.SuccessStatus) != 0 {
+		str = opt.SuccessStatus
+	}
+	ranges, err := ParseStatusRanges(str)
+	if err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 {
+		ranges = [][2]int{{http.StatusOK, http.StatusOK}}
+	}
+	return ranges, nil
+}
+
+//根据成功条件判断响应是否成功,失败时返回失败原因
+func (r *RpcResponse) Check(ranges [][2]int, opt *RpcOption) error {
+	if !containsStatus(ranges, r.StatusCode) {
+		if len(r.Body) != 0 {
+			return NewError(r.Body)
+		}
+		return NewError(fmt.Sprintf("http status: %d", r.StatusCode))
+	}
+	if opt == nil {
+		return nil
+	}
+	if len(opt.BodyRegex) != 0 {
+		re, err := regexp.Compile(opt.BodyRegex)
+		if err != nil {
+			return ErrInvalidRpcOption
+		}
+		if !re.Match(r.raw) {
+			return ErrBodyNotMatch
+		}
+	}
+	if len(opt.JsonPath) != 0 {
+		value, ok := jsonPathValue(r.raw, opt.JsonPath)
+		if !ok || (len(opt.JsonValue) != 0 && value != opt.JsonValue) {
+			return ErrBodyNotMatch
+		}
+	}
+	return nil
+}
+
+//按点分隔的路径读取JSON中的值,数组使用下标,返回值转换为字符串(字符串不带引号)
+func jsonPathValue(body []byte, jsonPath string) (string, bool) {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return "", false
+	}
+	for _, key := range strings.Split(strings.TrimPrefix(jsonPath, "$."), ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			child, ok := node[key]
+			if !ok {
+				return "", false
+			}
+			v = child
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			v = node[i]
+		default:
+			return "", false
+		}
+	}
+	if str, ok := v.(string); ok {
+		return str, true
+	}
+	buf, _ := json.Marshal(v)
+	return string(buf), true
+}
+
+//请求头名称只能包含token字符
+func validHeaderName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0 {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+//RPC任务的请求方法
+func rpcMethod(taskType int) string {
+	switch taskType {
+	case RpcTaskGET:
+		return "GET"
+	case RpcTaskPOST:
+		return "POST"
+	case RpcTaskPUT:
+		return "PUT"
+	case RpcTaskDELETE:
+		return "DELETE"
+	case RpcTaskPATCH:
+		return "PATCH"
+	case RpcTaskHEAD:
+		return "HEAD"
+	default:
+		return "GET"
+	}
+}
+
+//根据请求方法返回任务类型,不支持的方法返回0
+func RpcTaskType(method string) int {
+	switch strings.ToUpper(method) {
+	case "GET":
+		return RpcTaskGET
+	case "POST":
+		return RpcTaskPOST
+	case "PUT":
+		return RpcTaskPUT
+	case "DELETE":
+		return RpcTaskDELETE
+	case "PATCH":
+		return RpcTaskPATCH
+	case "HEAD":
+		return RpcTaskHEAD
+	default:
+		return 0
+	}
+}
+
+//是否是RPC任务
+func IsRpcTask(taskType int) bool {
+	return taskType >= RpcTaskGET && taskType <= RpcTaskHEAD
+}
+
+//根据编码方式生成请求体和Content-Type
+func rpcBody(args string, opt *RpcOption) (io.Reader, string, error) {
+	bodyType := RpcBodyJson
+	if opt != nil && len(opt.BodyType) != 0 {
+		bodyType = opt.BodyType
+	}
+	switch bodyType {
+	case RpcBodyForm:
+		var vec map[string]string
+		if len(args) != 0 {
+			if err := json.Unmarshal([]byte(args), &vec); err != nil {
+				return nil, "", ErrInvalidRpcOption
+			}
+		}
+		form := url.Values{}
+		for k, v := range vec {
+			form.Set(k, v)
+		}
+		return strings.NewReader(form.Encode()), "application/x-www-form-urlencoded", nil
+	case RpcBodyRaw:
+		return bytes.NewBufferString(args), opt.ContentType, nil
+	}
+	if len(args) == 0 {
+		return nil, "application/json", nil
+	}
+	return bytes.NewBufferString(args), "application/json", nil
+}
+
+//在url中追加查询参数
+func rpcUrl(rawUrl string, query map[string]string) (string, error) {
+	if len(query) == 0 {
+		return rawUrl, nil
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	values := u.Query()
+	for k, v := range query {
+		values.Set(k, v)
+	}
+	u.RawQuery = values.Encode()
+	return u.String(), nil
+}
+
+//设置任务引用的认证信息
+func (w *Worker) setRpcAuth(req *http.Request, name string) error {
+	secret, ok := w.cfg.RpcSecrets[name]
+	if !ok {
+		return ErrSecretNotExist
+	}
+	switch secret.Type {
+	case RpcAuthBasic:
+		req.SetBasicAuth(secret.Username, secret.Password)
+	case RpcAuthBearer:
+		req.Header.Set("Authorization", "Bearer "+secret.Token)
+	default:
+		return ErrSecretNotExist
+	}
+	return nil
+}
+
+//任务的最长运行时间:任务设置的max_run_time优先,其次是worker的task_run_time
+func (w *Worker) taskRunTime(req *TaskRequest) time.Duration {
+	if req.MaxRunTime > 0 {
+		return time.Second * time.Duration(req.MaxRunTime)
+	}
+	if w.cfg.TaskRunTime > 0 {
+		return time.Second * time.Duration(w.cfg.TaskRunTime)
+	}
+	return time.Second * DefaultTaskRunTime
+}
+
+//RPC和gRPC任务的连接超时
+func (w *Worker) rpcConnectTimeout() time.Duration {
+	if w.cfg.RpcConnectTimeout > 0 {
+		return time.Second * time.Duration(w.cfg.RpcConnectTimeout)
+	}
+	return time.Second * DefaultRpcConnectTimeout
+}
+
+//根据配置创建连接池,连接超时和等待响应头超时对所有RPC任务生效
+func (w *Worker) newTransport(tlsConfig *tls.Config) *http.Transport {
+	connectTimeout := w.rpcConnectTimeout()
+	maxIdleConns := DefaultRpcMaxIdleConns
+	if w.cfg.RpcMaxIdleConns > 0 {
+		maxIdleConns = w.cfg.RpcMaxIdleConns
+	}
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: time.Second * 30,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: time.Second * time.Duration(w.cfg.RpcHeaderTimeout),
+		MaxIdleConns:          maxIdleConns * 4,
+		MaxIdleConnsPerHost:   maxIdleConns,
+		IdleConnTimeout:       time.Second * 90,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+//返回任务使用的http客户端,相同TLS选项的任务共享同一个连接池
+func (w *Worker) rpcClient(opt *RpcOption) (*http.Client, error) {
+	key := ""
+	if opt != nil && (len(opt.Tls) != 0 || opt.SkipVerify) {
+		key = fmt.Sprintf("%s/%t", opt.Tls, opt.SkipVerify)
+	}
+	w.rpcLock.Lock()
+	defer w.rpcLock.Unlock()
+	if client, ok := w.rpcClients[key]; ok {
+		return client, nil
+	}
+	tlsConfig, err := w.rpcTlsConfig(opt)
+	if err != nil {
+		return nil, err
+	}
+	if w.rpcClients == nil {
+		w.rpcClients = make(map[string]*http.Client)
+	}
+	client := &http.Client{Transport: w.newTransport(tlsConfig)}
+	w.rpcClients[key] = client
+	return client, nil
+}
+
+//根据任务的TLS选项生成TLS配置,没有TLS选项时返回nil
+func (w *Worker) rpcTlsConfig(opt *RpcOption) (*tls.Config, error) {
+	if opt == nil || (len(opt.Tls) == 0 && !opt.SkipVerify) {
+		return nil, nil
+	}
+	tlsConfig := new(tls.Config)
+	if len(opt.Tls) != 0 {
+		cfg, ok := w.cfg.RpcTls[opt.Tls]
+		if !ok {
+			return nil, ErrTlsNotExist
+		}
+		if len(cfg.CaFile) != 0 {
+			data, err := ioutil.ReadFile(cfg.CaFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, ErrInvalidCert
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if len(cfg.CertFile) != 0 {
+			cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		tlsConfig.InsecureSkipVerify = cfg.SkipVerify
+	}
+	//任务设置跳过证书校验需要worker允许
+	if opt.SkipVerify {
+		if !w.cfg.RpcAllowSkipVerify {
+			return nil, ErrSkipVerifyNotAllowed
+		}
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStatusRanges(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want [][2]int
+		err  bool
+	}{
+		{"", nil, false},
+		{"200", [][2]int{{200, 200}}, false},
+		{"200-299", [][2]int{{200, 299}}, false},
+		{" 200  201-204 404 ", [][2]int{{200, 200}, {201, 204}, {404, 404}}, false},
+		{"100-599", [][2]int{{100, 599}}, false},
+		{"99", nil, true},
+		{"600", nil, true},
+		{"200-600", nil, true},
+		{"299-200", nil, true},
+		{"2xx", nil, true},
+		{"200-", nil, true},
+		{"-200", nil, true},
+		{"200,201", nil, true},
+		{"200-201-202", nil, true},
+	} {
+		got, err := ParseStatusRanges(c.s)
+		if (err != nil) != c.err {
+			t.Errorf("ParseStatusRanges(%q) error = %v", c.s, err)
+			continue
+		}
+		if err != nil && err != ErrInvalidRpcOption {
+			t.Errorf("ParseStatusRanges(%q) error = %v, want ErrInvalidRpcOption", c.s, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ParseStatusRanges(%q) = %v, want %v", c.s, got, c.want)
+		}
+	}
+}
+
+func TestJsonPathValue(t *testing.T) {
+	body := []byte(`{"code":0,"msg":"ok","ok":true,"none":null,"rate":1.50,"big":12345678901234567890,
+		"data":{"items":[{"id":"a"},{"id":"b","n":2}],"tags":["x","y"],"empty":{}},"a.b":1}`)
+	for _, c := range []struct {
+		path  string
+		value string
+		ok    bool
+	}{
+		//$.前缀可以省略
+		{"$.code", "0", true},
+		{"code", "0", true},
+		//字符串不带引号,其他值为JSON
+		{"msg", "ok", true},
+		{"ok", "true", true},
+		{"none", "null", true},
+		{"rate", "1.50", true},
+		{"big", "12345678901234567890", true},
+		{"data.empty", "{}", true},
+		{"data.tags", `["x","y"]`, true},
+		//数组下标
+		{"data.tags.1", "y", true},
+		{"$.data.items.1.n", "2", true},
+		{"data.items.0", `{"id":"a"}`, true},
+		{"data.items.2", "", false},
+		{"data.items.-1", "", false},
+		{"data.items.id", "", false},
+		{"missing", "", false},
+		{"msg.len", "", false},
+		{"code.0", "", false},
+		//点号总是作为分隔符
+		{"a.b", "", false},
+	} {
+		value, ok := jsonPathValue(body, c.path)
+		if value != c.value || ok != c.ok {
+			t.Errorf("jsonPathValue(%q) = %q, %t, want %q, %t", c.path, value, ok, c.value, c.ok)
+		}
+	}
+	if _, ok := jsonPathValue([]byte("not json"), "$.a"); ok {
+		t.Errorf("jsonPathValue on invalid JSON returned ok")
+	}
+	if value, ok := jsonPathValue([]byte(`[1,"2"]`), "$.1"); value != "2" || !ok {
+		t.Errorf("jsonPathValue on top-level array = %q, %t", value, ok)
+	}
+}
+
+func TestRpcResponseCheck(t *testing.T) {
+	ok := [][2]int{{200, 299}}
+	response := func(status int, body string) *RpcResponse {
+		return &RpcResponse{StatusCode: status, Body: body, raw: []byte(body)}
+	}
+	for _, c := range []struct {
+		name string
+		resp *RpcResponse
+		opt  *RpcOption
+		err  string
+	}{
+		{"status ok", response(204, ""), nil, ""},
+		{"status with body", response(500, "boom"), nil, "boom"},
+		{"status without body", response(404, ""), nil, "http status: 404"},
+		{"empty option", response(200, "x"), &RpcOption{}, ""},
+		{"regex match", response(200, `{"result":"done"}`), &RpcOption{BodyRegex: `"result":\s*"done"`}, ""},
+		{"regex mismatch", response(200, `{"result":"fail"}`), &RpcOption{BodyRegex: `"done"`}, ErrBodyNotMatch.Error()},
+		{"invalid regex", response(200, ""), &RpcOption{BodyRegex: "("}, ErrInvalidRpcOption.Error()},
+		{"path exists", response(200, `{"data":{"id":1}}`), &RpcOption{JsonPath: "$.data.id"}, ""},
+		{"path missing", response(200, `{"data":{}}`), &RpcOption{JsonPath: "$.data.id"}, ErrBodyNotMatch.Error()},
+		{"number value", response(200, `{"code":0}`), &RpcOption{JsonPath: "code", JsonValue: "0"}, ""},
+		{"number mismatch", response(200, `{"code":1}`), &RpcOption{JsonPath: "code", JsonValue: "0"}, ErrBodyNotMatch.Error()},
+		//数字和字符串按字符串比较,字符串值不带引号
+		{"string value", response(200, `{"code":"0"}`), &RpcOption{JsonPath: "code", JsonValue: "0"}, ""},
+		{"quoted value", response(200, `{"code":"0"}`), &RpcOption{JsonPath: "code", JsonValue: `"0"`}, ErrBodyNotMatch.Error()},
+		{"bool value", response(200, `{"ok":true}`), &RpcOption{JsonPath: "ok", JsonValue: "true"}, ""},
+		{"array value", response(200, `{"list":["a","b"]}`), &RpcOption{JsonPath: "list.1", JsonValue: "b"}, ""},
+		{"body not json", response(200, "ok"), &RpcOption{JsonPath: "code"}, ErrBodyNotMatch.Error()},
+		//状态码不满足时不再检查响应体
+		{"status before body", response(503, "busy"), &RpcOption{JsonPath: "code"}, "busy"},
+	} {
+		err := c.resp.Check(ok, c.opt)
+		var got string
+		if err != nil {
+			got = err.Error()
+		}
+		if got != c.err {
+			t.Errorf("%s: Check() error = %q, want %q", c.name, got, c.err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package core
+
+import (
+	"fmt"
+	"github.com/phillihq/ktse/logger"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+const (
+	//worker以包装进程的方式启动时的第一个参数,设置rlimit后执行真正的脚本
+	sandboxArg      = "__ktse_sandbox__"
+	sandboxLimitEnv = "KTSE_SANDBOX_LIMIT"
+	//包装进程自身出错时的退出码
+	sandboxExitCode = 126
+)
+
+//脚本任务的资源限制,0表示不限制
+type ResourceLimit struct {
+	CpuTime   uint64 `yaml:"cpu_time" json:"cpu_time,omitempty"`     //CPU时间,单位为秒
+	AddrSpace uint64 `yaml:"addr_space" json:"addr_space,omitempty"` //虚拟内存,单位为MB
+	OpenFiles uint64 `yaml:"open_files" json:"open_files,omitempty"` //打开文件数
+	Processes uint64 `yaml:"processes" json:"processes,omitempty"`   //运行用户的进程数
+	Memory    uint64 `yaml:"memory" json:"memory,omitempty"`         //cgroup v2内存上限,单位为MB
+	CpuQuota  uint64 `yaml:"cpu_quota" json:"cpu_quota,omitempty"`   //cgroup v2 CPU配额,100表示一个核
+}
+
+func (l *ResourceLimit) fields() []*uint64 {
+	return []*uint64{&l.CpuTime, &l.AddrSpace, &l.OpenFiles, &l.Processes, &l.Memory, &l.CpuQuota}
+}
+
+//用other中设置了的项覆盖当前限制
+func (l *ResourceLimit) merge(other *ResourceLimit) {
+	vec := l.fields()
+	for i, v := range other.fields() {
+		if *v != 0 {
+			*vec[i] = *v
+		}
+	}
+}
+
+//不能超过上限,上限不为0时不限制也会被设置为上限
+func (l *ResourceLimit) clamp(max *ResourceLimit) {
+	vec := l.fields()
+	for i, v := range max.fields() {
+		if *v != 0 && (*vec[i] == 0 || *vec[i] > *v) {
+			*vec[i] = *v
+		}
+	}
+}
+
+//是否需要通过rlimit限制
+func (l *ResourceLimit) HasRlimit() bool {
+	return l != nil && (l.CpuTime != 0 || l.AddrSpace != 0 || l.OpenFiles != 0 || l.Processes != 0)
+}
+
+//是否需要通过cgroup限制
+func (l *ResourceLimit) HasCgroup() bool {
+	return l != nil && (l.Memory != 0 || l.CpuQuota != 0)
+}
+
+//合并资源限制:worker默认配置,可执行文件的配置,任务的配置依次覆盖,并且不能超过上限
+func (w *Worker) resourceLimit(req *TaskRequest) *ResourceLimit {
+	limit := w.cfg.Limit
+	if binLimit, ok := w.cfg.BinLimit[req.BinName]; ok {
+		limit.merge(&binLimit)
+	}
+	if req.Limit != nil {
+		limit.merge(req.Limit)
+	}
+	limit.clamp(&w.cfg.LimitMax)
+	return &limit
+}
+
+//根据配置准备脚本的运行环境:资源限制,运行用户,cgroup和私有临时目录
+//返回的清理函数需要在进程组全部退出后调用
+func (w *Worker) prepareSandbox(req *TaskRequest, opt *ExecOption) (func(), error) {
+	var err error
+	var cleanups []func()
+	cleanup := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+
+	opt.Limit = w.resourceLimit(req)
+	if (opt.Limit.HasRlimit() || opt.Limit.HasCgroup()) && !sandboxSupported {
+		return nil, ErrSandboxNotSupported
+	}
+	if len(w.cfg.RunUser) != 0 {
+		opt.Credential, err = lookupCredential(w.cfg.RunUser, w.cfg.RunGroup)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opt.Limit.HasCgroup() {
+		if len(w.cfg.CgroupPath) == 0 {
+			return nil, ErrCgroupNotConfigured
+		}
+		fd, remove, err := createCgroup(w.cfg.CgroupPath, "task-"+req.Uuid, opt.Limit)
+		if err != nil {
+			logger.GetLogger().Errorln("worker", "prepareSandbox", "create cgroup error", 0,
+				"key", fmt.Sprintf("t_%s", req.Uuid), "err", err.Error())
+			return nil, err
+		}
+		opt.CgroupFD = fd
+		cleanups = append(cleanups, remove)
+	}
+
+	if w.cfg.PrivateTmp {
+		dir, err := ioutil.TempDir(w.cfg.TmpPath, "ktse-"+req.Uuid+"-")
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		cleanups = append(cleanups, func() {
+			os.RemoveAll(dir)
+		})
+		if opt.Credential != nil {
+			if err = os.Chown(dir, int(opt.Credential.Uid), int(opt.Credential.Gid)); err != nil {
+				cleanup()
+				return nil, err
+			}
+		}
+		opt.Env = append(opt.Env, "TMPDIR="+dir, "TMP="+dir, "TEMP="+dir)
+	}
+	return cleanup, nil
+}
+
+//查找运行脚本的用户和用户组,支持名称或数字id,用户组为空时使用用户的主组
+func lookupCredential(userName string, groupName string) (*syscall.Credential, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return nil, err
+		}
+	}
+	gid := u.Gid
+	if len(groupName) != 0 {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return nil, err
+			}
+		}
+		gid = g.Gid
+	}
+	uidNum, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gidNum, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &syscall.Credential{Uid: uint32(uidNum), Gid: uint32(gidNum)}, nil
+}
+
+//是否调用过SandboxInit,没有调用时重新执行自身会再次启动整个程序,此时不能使用rlimit
+var sandboxInitialized bool
+
+//worker以包装进程的方式启动时,设置rlimit后执行脚本,不会返回
+//需要在worker的main函数开始时调用
+func SandboxInit() {
+	if len(os.Args) < 3 || os.Args[1] != sandboxArg {
+		sandboxInitialized = true
+		return
+	}
+	err := sandboxExec(os.Args[2], os.Args[2:])
+	fmt.Fprintf(os.Stderr, "ktse sandbox: %v\n", err)
+	os.Exit(sandboxExitCode)
+}
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	sandboxSupported = true
+	rlimitNproc      = 6 //RLIMIT_NPROC,syscall包中没有定义
+	cgroupCpuPeriod  = 100000
+)
+
+//设置rlimit并执行脚本
+func sandboxExec(binPath string, args []string) error {
+	limit := new(ResourceLimit)
+	if err := json.Unmarshal([]byte(os.Getenv(sandboxLimitEnv)), limit); err != nil {
+		return err
+	}
+	os.Unsetenv(sandboxLimitEnv)
+
+	rlimits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_CPU, limit.CpuTime},
+		{syscall.RLIMIT_AS, limit.AddrSpace * 1024 * 1024},
+		{syscall.RLIMIT_NOFILE, limit.OpenFiles},
+		{rlimitNproc, limit.Processes},
+	}
+	for _, r := range rlimits {
+		if r.value == 0 {
+			continue
+		}
+		rlim := &syscall.Rlimit{Cur: r.value, Max: r.value}
+		if err := syscall.Setrlimit(r.resource, rlim); err != nil {
+			return fmt.Errorf("setrlimit %d: %v", r.resource, err)
+		}
+	}
+	return syscall.Exec(binPath, args, os.Environ())
+}
+
+//在配置的cgroup v2目录parent下为任务创建子cgroup并设置内存和CPU配额
+//返回子cgroup的文件描述符(用于在创建进程时直接加入cgroup)和删除函数
+func createCgroup(parent string, name string, limit *ResourceLimit) (int, func(), error) {
+	if err := enableControllers(parent, limit); err != nil {
+		return 0, nil, err
+	}
+	dir := filepath.Join(parent, name)
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		return 0, nil, err
+	}
+	remove := func() {
+		removeCgroup(dir)
+	}
+	if limit.Memory != 0 {
+		max := fmt.Sprintf("%d", limit.Memory*1024*1024)
+		if err = ioutil.WriteFile(filepath.Join(dir, "memory.max"), []byte(max), 0644); err != nil {
+			remove()
+			return 0, nil, err
+		}
+		//不使用swap绕过内存限制,没有开启swap时该文件不存在
+		ioutil.WriteFile(filepath.Join(dir, "memory.swap.max"), []byte("0"), 0644)
+	}
+	if limit.CpuQuota != 0 {
+		max := fmt.Sprintf("%d %d", limit.CpuQuota*cgroupCpuPeriod/100, cgroupCpuPeriod)
+		if err = ioutil.WriteFile(filepath.Join(dir, "cpu.max"), []byte(max), 0644); err != nil {
+			remove()
+			return 0, nil, err
+		}
+	}
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		remove()
+		return 0, nil, err
+	}
+	return fd, func() {
+		syscall.Close(fd)
+		remove()
+	}, nil
+}
+
+//在parent中开启子cgroup需要的控制器,只修改parent自身,已经开启的不再写入
+//parent不能是cgroup根目录(根目录没有cgroup.type文件),避免修改整个系统的控制器
+func enableControllers(parent string, limit *ResourceLimit) error {
+	if _, err := os.Stat(filepath.Join(parent, "cgroup.type")); err != nil {
+		if os.IsNotExist(err) {
+			return ErrCgroupRoot
+		}
+		return err
+	}
+	path := filepath.Join(parent, "cgroup.subtree_control")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	enabled := strings.Fields(string(data))
+	var vec []string
+	if limit.Memory != 0 && !containsString(enabled, "memory") {
+		vec = append(vec, "+memory")
+	}
+	if limit.CpuQuota != 0 && !containsString(enabled, "cpu") {
+		vec = append(vec, "+cpu")
+	}
+	if len(vec) == 0 {
+		return nil
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(vec, " ")), 0644)
+}
+
+//删除cgroup,还有进程时(例如调用setsid脱离了进程组)先通过cgroup.kill终止
+func removeCgroup(dir string) {
+	if err := syscall.Rmdir(dir); err == nil || err != syscall.EBUSY {
+		return
+	}
+	ioutil.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0644)
+	deadline := time.Now().Add(killWaitTime)
+	for time.Now().Before(deadline) {
+		if err := syscall.Rmdir(dir); err != syscall.EBUSY {
+			return
+		}
+		time.Sleep(processCheckInterval)
+	}
+}
+
+//创建进程时直接加入cgroup
+func applyCgroup(attr *syscall.SysProcAttr, fd int) {
+	if fd > 0 {
+		attr.UseCgroupFD = true
+		attr.CgroupFD = fd
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+import (
+	"syscall"
+)
+
+//rlimit和cgroup只支持linux
+const sandboxSupported = false
+
+func sandboxExec(binPath string, args []string) error {
+	return ErrSandboxNotSupported
+}
+
+func createCgroup(root string, name string, limit *ResourceLimit) (int, func(), error) {
+	return 0, nil, ErrSandboxNotSupported
+}
+
+func applyCgroup(attr *syscall.SysProcAttr, fd int) {
+}
@@ -0,0 +1,268 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//脚本执行的附加参数
+type ExecOption struct {
+	Env   []string //追加到worker环境变量之后,格式为KEY=VALUE
+	Dir   string   //工作目录,为空表示使用worker的工作目录
+	Stdin []byte   //标准输入内容
+	//资源限制和运行用户,参考prepareSandbox
+	Limit      *ResourceLimit
+	Credential *syscall.Credential
+	CgroupFD   int //任务cgroup目录的文件描述符,0表示不使用cgroup
+	//结果中每个输出流保存的最大字节数,以及完整输出的写入位置
+	OutputLimit int64
+	Stdout      io.Writer
+	Stderr      io.Writer
+	//脚本写入进度的管道,作为文件描述符3传给脚本
+	Progress *os.File
+}
+
+//脚本进程的执行结果
+type ExecResult struct {
+	ExitCode  int
+	Signal    string //进程被信号终止时的信号名称
+	Stdout    string
+	Stderr    string
+	StartTime time.Time
+	EndTime   time.Time
+	//完整输出在LogStore中的引用
+	StdoutRef string
+	StderrRef string
+}
+
+func outputWriter(buf *cappedBuffer, w io.Writer) io.Writer {
+	if w == nil {
+		return buf
+	}
+	return io.MultiWriter(buf, w)
+}
+
+func (r *ExecResult) setProcessState(state *os.ProcessState) {
+	if state == nil {
+		return
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		r.ExitCode = -1
+		r.Signal = status.Signal().String()
+		return
+	}
+	r.ExitCode = state.ExitCode()
+}
+
+//根据成功策略判断执行是否成功,失败时返回失败原因
+func (r *ExecResult) Check(policy string, codes []int) error {
+	if len(r.Signal) != 0 {
+		return NewError(fmt.Sprintf("killed by signal: %s", r.Signal))
+	}
+	stderr := strings.TrimRight(r.Stderr, "\n")
+	if !containsCode(codes, r.ExitCode) {
+		if len(stderr) != 0 {
+			return NewError(stderr)
+		}
+		return NewError(fmt.Sprintf("exit code: %d", r.ExitCode))
+	}
+	if policy == SuccessPolicyStderr && len(stderr) != 0 {
+		return NewError(stderr)
+	}
+	return nil
+}
+
+func containsCode(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+//任务的成功策略,任务未设置时使用worker的配置,默认只有退出码0表示成功
+func (w *Worker) successPolicy(req *TaskRequest) (string, []int, error) {
+	var err error
+	policy := req.SuccessPolicy
+	if len(policy) == 0 {
+		policy = w.cfg.SuccessPolicy
+	}
+	if len(policy) == 0 {
+		policy = SuccessPolicyExitCode
+	}
+	if policy != SuccessPolicyExitCode && policy != SuccessPolicyStderr {
+		return "", nil, ErrInvalidSuccessPolicy
+	}
+	codes := w.cfg.SuccessCodes
+	if len(req.SuccessCodes) != 0 {
+		codes, err = ParseSuccessCodes(req.SuccessCodes)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	if len(codes) == 0 {
+		codes = []int{0}
+	}
+	return policy, codes, nil
+}
+
+//解析空格分隔的退出码列表
+func ParseSuccessCodes(s string) ([]int, error) {
+	var codes []int
+	for _, str := range strings.Fields(s) {
+		code, err := strconv.Atoi(str)
+		if err != nil || code < 0 || code > 255 {
+			return nil, ErrInvalidSuccessPolicy
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+//解析可执行文件路径,不能超出bin_path
+//配置了可执行文件清单时,只能执行清单中的文件,并在执行前校验sha256
+func (w *Worker) resolveBin(binName string) (string, error) {
+	if !ValidBinName(binName) {
+		return "", ErrPathNotAllowed
+	}
+	binPath, err := resolveUnder(w.cfg.BinPath, binName)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(binPath)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", ErrPathNotAllowed
+	}
+	if w.manifest == nil {
+		return binPath, nil
+	}
+	sum, ok, err := w.manifest.Lookup(binName)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrBinNotAllowed
+	}
+	if len(sum) != 0 {
+		actual, err := fileSHA256(binPath)
+		if err != nil {
+			return "", err
+		}
+		if actual != sum {
+			return "", ErrChecksumMismatch
+		}
+	}
+	return binPath, nil
+}
+
+//把相对路径解析到root目录下,解析结果(包括符号链接)不能超出root
+func resolveUnder(root string, name string) (string, error) {
+	if strings.IndexByte(name, 0) >= 0 {
+		return "", ErrPathNotAllowed
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	full := filepath.Join(root, filepath.FromSlash(path.Clean("/"+name)))
+	if !isUnder(root, full) {
+		return "", ErrPathNotAllowed
+	}
+	//符号链接可能指向root之外
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	realFull, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrFileNotExist
+		}
+		return "", err
+	}
+	if !isUnder(realRoot, realFull) {
+		return "", ErrPathNotAllowed
+	}
+	return full, nil
+}
+
+func isUnder(root string, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+//校验环境变量名,并按照worker配置的黑白名单过滤
+func (w *Worker) checkEnv(env map[string]string) ([]string, error) {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		if !validEnvName(name) || strings.IndexByte(env[name], 0) >= 0 {
+			return nil, ErrInvalidEnv
+		}
+		if !envAllowed(name, w.cfg.EnvAllow, w.cfg.EnvDeny) {
+			return nil, ErrEnvNotAllowed
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	vec := make([]string, 0, len(names))
+	for _, name := range names {
+		vec = append(vec, name+"="+env[name])
+	}
+	return vec, nil
+}
+
+//环境变量名只能包含字母,数字和下划线,且不能以数字开头
+func validEnvName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+//内置的环境变量黑名单,配置的env_deny在此基础上追加
+//包括动态链接,shell启动和ktse内部使用的变量,白名单不能放开
+var DefaultEnvDeny = []string{
+	"PATH", "LD_*", "DYLD_*", "IFS", "BASH_ENV", "ENV", "SHELLOPTS", "BASHOPTS", "PS4",
+	"GCONV_PATH", "MALLOC_*", "KTSE_*", TraceParentEnv,
+}
+
+//黑名单优先;白名单为空时允许所有不在黑名单中的变量
+func envAllowed(name string, allow []string, deny []string) bool {
+	if matchAny(name, DefaultEnvDeny) || matchAny(name, deny) {
+		return false
+	}
+	return len(allow) == 0 || matchAny(name, allow)
+}
+
+//支持通配符,例如LD_*
+func matchAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,303 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSuccessCodes(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want []int
+		err  bool
+	}{
+		{"", nil, false},
+		{"  ", nil, false},
+		{"0", []int{0}, false},
+		{"0 1  2", []int{0, 1, 2}, false},
+		{"255", []int{255}, false},
+		{"256", nil, true},
+		{"-1", nil, true},
+		{"0,1", nil, true},
+		{"0-2", nil, true},
+		{"abc", nil, true},
+	} {
+		got, err := ParseSuccessCodes(c.s)
+		if (err != nil) != c.err {
+			t.Errorf("ParseSuccessCodes(%q) error = %v", c.s, err)
+			continue
+		}
+		if err != nil && err != ErrInvalidSuccessPolicy {
+			t.Errorf("ParseSuccessCodes(%q) error = %v, want ErrInvalidSuccessPolicy", c.s, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ParseSuccessCodes(%q) = %v, want %v", c.s, got, c.want)
+		}
+	}
+}
+
+func TestExecResultCheck(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		result ExecResult
+		policy string
+		codes  []int
+		err    string
+	}{
+		{"exit 0", ExecResult{ExitCode: 0}, SuccessPolicyExitCode, []int{0}, ""},
+		{"exit 1", ExecResult{ExitCode: 1}, SuccessPolicyExitCode, []int{0}, "exit code: 1"},
+		{"exit 1 with stderr", ExecResult{ExitCode: 1, Stderr: "no such file\n\n"}, SuccessPolicyExitCode, []int{0}, "no such file"},
+		{"accepted code", ExecResult{ExitCode: 3, Stderr: "partial"}, SuccessPolicyExitCode, []int{0, 3}, ""},
+		{"code 0 not accepted", ExecResult{ExitCode: 0}, SuccessPolicyExitCode, []int{1}, "exit code: 0"},
+		//信号优先于退出码
+		{"signal", ExecResult{ExitCode: -1, Signal: "killed"}, SuccessPolicyExitCode, []int{0}, "killed by signal: killed"},
+		//stderr策略下有输出时失败
+		{"stderr policy", ExecResult{ExitCode: 0, Stderr: "warning\n"}, SuccessPolicyStderr, []int{0}, "warning"},
+		{"stderr policy newline only", ExecResult{ExitCode: 0, Stderr: "\n"}, SuccessPolicyStderr, []int{0}, ""},
+		{"stderr policy clean", ExecResult{ExitCode: 0, Stdout: "ok"}, SuccessPolicyStderr, []int{0}, ""},
+		{"exit_code policy ignores stderr", ExecResult{ExitCode: 0, Stderr: "warning"}, SuccessPolicyExitCode, []int{0}, ""},
+	} {
+		err := c.result.Check(c.policy, c.codes)
+		var got string
+		if err != nil {
+			got = err.Error()
+		}
+		if got != c.err {
+			t.Errorf("%s: Check() error = %q, want %q", c.name, got, c.err)
+		}
+	}
+}
+
+func TestWorkerSuccessPolicy(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		cfg    WorkerConfig
+		req    TaskRequest
+		policy string
+		codes  []int
+		err    error
+	}{
+		{"default", WorkerConfig{}, TaskRequest{}, SuccessPolicyExitCode, []int{0}, nil},
+		{"worker config", WorkerConfig{SuccessPolicy: SuccessPolicyStderr, SuccessCodes: []int{0, 2}}, TaskRequest{},
+			SuccessPolicyStderr, []int{0, 2}, nil},
+		{"task overrides worker", WorkerConfig{SuccessPolicy: SuccessPolicyStderr, SuccessCodes: []int{0, 2}},
+			TaskRequest{SuccessPolicy: SuccessPolicyExitCode, SuccessCodes: "1"}, SuccessPolicyExitCode, []int{1}, nil},
+		{"invalid policy", WorkerConfig{}, TaskRequest{SuccessPolicy: "stdout"}, "", nil, ErrInvalidSuccessPolicy},
+		{"invalid codes", WorkerConfig{}, TaskRequest{SuccessCodes: "300"}, "", nil, ErrInvalidSuccessPolicy},
+	} {
+		w := &Worker{cfg: &c.cfg}
+		policy, codes, err := w.successPolicy(&c.req)
+		if policy != c.policy || !reflect.DeepEqual(codes, c.codes) || err != c.err {
+			t.Errorf("%s: successPolicy() = %q, %v, %v, want %q, %v, %v", c.name, policy, codes, err, c.policy, c.codes, c.err)
+		}
+	}
+}
+
+//root下的bin目录和root外的文件,用于测试路径解析
+func makeBinDir(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "bin")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(root, "sub"), filepath.Join(root, "data"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string]string{
+		filepath.Join(root, "ok.sh"):       "#!/bin/sh\necho ok\n",
+		filepath.Join(root, "sub", "tool"): "#!/bin/sh\necho tool\n",
+		filepath.Join(outside, "evil"):     "#!/bin/sh\necho evil\n",
+	} {
+		if err := ioutil.WriteFile(name, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		filepath.Join(root, "link-in"):  "ok.sh",
+		filepath.Join(root, "link-out"): filepath.Join("..", "outside", "evil"),
+		filepath.Join(root, "link-abs"): filepath.Join(outside, "evil"),
+		filepath.Join(root, "link-dir"): outside,
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, outside
+}
+
+func TestResolveUnder(t *testing.T) {
+	root, _ := makeBinDir(t)
+	for _, c := range []struct {
+		name string
+		want string
+		err  error
+	}{
+		{"ok.sh", "ok.sh", nil},
+		{"sub/tool", "sub/tool", nil},
+		{"./sub/../ok.sh", "ok.sh", nil},
+		{"link-in", "link-in", nil},
+		//..不能越过root
+		{"../outside/evil", "", ErrFileNotExist},
+		{"sub/../../outside/evil", "", ErrFileNotExist},
+		{"/ok.sh", "ok.sh", nil},
+		{"missing", "", ErrFileNotExist},
+		//符号链接指向root之外
+		{"link-out", "", ErrPathNotAllowed},
+		{"link-abs", "", ErrPathNotAllowed},
+		{"link-dir/evil", "", ErrPathNotAllowed},
+		{"ok\x00.sh", "", ErrPathNotAllowed},
+	} {
+		got, err := resolveUnder(root, c.name)
+		if err != c.err {
+			t.Errorf("resolveUnder(%q) error = %v, want %v", c.name, err, c.err)
+			continue
+		}
+		if err == nil && got != filepath.Join(root, c.want) {
+			t.Errorf("resolveUnder(%q) = %q, want %q", c.name, got, filepath.Join(root, c.want))
+		}
+	}
+}
+
+func TestResolveBin(t *testing.T) {
+	root, _ := makeBinDir(t)
+	sum, err := fileSHA256(filepath.Join(root, "ok.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := filepath.Join(t.TempDir(), "manifest.yaml")
+	//大小写和空白不影响校验,sha256为空表示不校验
+	content := "ok.sh: \" " + strings.ToUpper(sum) + " \"\n" +
+		"./sub/tool: \"\"\n" +
+		"link-in: " + sum + "\n" +
+		"data: \"\"\n" +
+		"link-out: \"\"\n"
+	if err := ioutil.WriteFile(manifest, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := LoadBinManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		manifest *BinManifest
+		bin      string
+		err      error
+	}{
+		//没有清单时只检查路径
+		{nil, "ok.sh", nil},
+		{nil, "sub/tool", nil},
+		{nil, "../outside/evil", ErrPathNotAllowed},
+		{nil, "/ok.sh", ErrPathNotAllowed},
+		{nil, "..", ErrPathNotAllowed},
+		{nil, "", ErrPathNotAllowed},
+		{nil, "data", ErrPathNotAllowed},
+		{nil, "link-out", ErrPathNotAllowed},
+		{nil, "missing", ErrFileNotExist},
+		{m, "ok.sh", nil},
+		{m, "sub/tool", nil},
+		{m, "link-in", nil},
+		{m, "data", ErrPathNotAllowed},
+		{m, "link-out", ErrPathNotAllowed},
+		//清单中的名字按path.Clean比较
+		{m, "sub/./tool", nil},
+		{m, "link-abs", ErrPathNotAllowed},
+		{m, "sub/../sub/tool", nil},
+	} {
+		w := &Worker{cfg: &WorkerConfig{BinPath: root}, manifest: c.manifest}
+		got, err := w.resolveBin(c.bin)
+		if err != c.err {
+			t.Errorf("resolveBin(%q) manifest %t error = %v, want %v", c.bin, c.manifest != nil, err, c.err)
+			continue
+		}
+		if err == nil && got != filepath.Join(root, c.bin) {
+			t.Errorf("resolveBin(%q) = %q", c.bin, got)
+		}
+	}
+
+	//不在清单中
+	w := &Worker{cfg: &WorkerConfig{BinPath: root}, manifest: m}
+	if err := ioutil.WriteFile(filepath.Join(root, "new.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.resolveBin("new.sh"); err != ErrBinNotAllowed {
+		t.Errorf("resolveBin(%q) error = %v, want ErrBinNotAllowed", "new.sh", err)
+	}
+	//文件被修改后校验失败
+	if err := ioutil.WriteFile(filepath.Join(root, "ok.sh"), []byte("#!/bin/sh\necho changed\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, bin := range []string{"ok.sh", "link-in"} {
+		if _, err := w.resolveBin(bin); err != ErrChecksumMismatch {
+			t.Errorf("resolveBin(%q) after change error = %v, want ErrChecksumMismatch", bin, err)
+		}
+	}
+}
+
+func TestCheckEnv(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		allow []string
+		deny  []string
+		env   map[string]string
+		want  []string
+		err   error
+	}{
+		{"empty", nil, nil, nil, []string{}, nil},
+		//按变量名排序
+		{"sorted", nil, nil, map[string]string{"B": "2", "A": "1", "_x1": "a=b c"}, []string{"A=1", "B=2", "_x1=a=b c"}, nil},
+		{"empty value", nil, nil, map[string]string{"A": ""}, []string{"A="}, nil},
+		{"invalid name", nil, nil, map[string]string{"1A": "x"}, nil, ErrInvalidEnv},
+		{"name with dash", nil, nil, map[string]string{"A-B": "x"}, nil, ErrInvalidEnv},
+		{"name with equal", nil, nil, map[string]string{"A=B": "x"}, nil, ErrInvalidEnv},
+		{"empty name", nil, nil, map[string]string{"": "x"}, nil, ErrInvalidEnv},
+		{"nul in value", nil, nil, map[string]string{"A": "x\x00y"}, nil, ErrInvalidEnv},
+		//白名单支持通配符
+		{"allowed", []string{"APP_*", "LANG"}, nil, map[string]string{"APP_MODE": "x", "LANG": "C"}, []string{"APP_MODE=x", "LANG=C"}, nil},
+		{"not allowed", []string{"APP_*"}, nil, map[string]string{"APP_MODE": "x", "HOME": "/"}, nil, ErrEnvNotAllowed},
+		{"wildcard is not prefix", []string{"APP_*"}, nil, map[string]string{"MYAPP_MODE": "x"}, nil, ErrEnvNotAllowed},
+		{"deny", nil, []string{"SECRET_*"}, map[string]string{"SECRET_KEY": "x"}, nil, ErrEnvNotAllowed},
+		{"deny wins", []string{"APP_*"}, []string{"APP_SECRET"}, map[string]string{"APP_SECRET": "x"}, nil, ErrEnvNotAllowed},
+		//名字区分大小写
+		{"case sensitive", nil, nil, map[string]string{"path": "/tmp", "ld_preload": "x"}, []string{"ld_preload=x", "path=/tmp"}, nil},
+	} {
+		w := &Worker{cfg: &WorkerConfig{EnvAllow: c.allow, EnvDeny: c.deny}}
+		got, err := w.checkEnv(c.env)
+		if err != c.err {
+			t.Errorf("%s: checkEnv() error = %v, want %v", c.name, err, c.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: checkEnv() = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+//内置黑名单中的变量即使在白名单中也不能设置
+func TestDefaultEnvDeny(t *testing.T) {
+	names := []string{
+		"PATH", "LD_PRELOAD", "LD_LIBRARY_PATH", "LD_AUDIT", "DYLD_INSERT_LIBRARIES", "IFS", "BASH_ENV", "ENV",
+		"SHELLOPTS", "BASHOPTS", "PS4", "GCONV_PATH", "MALLOC_CHECK_", "KTSE_TASK_UUID", TraceParentEnv,
+	}
+	for _, allow := range [][]string{nil, {"*"}, names} {
+		w := &Worker{cfg: &WorkerConfig{EnvAllow: allow}}
+		for _, name := range names {
+			if _, err := w.checkEnv(map[string]string{name: "x"}); err != ErrEnvNotAllowed {
+				t.Errorf("checkEnv(%s) with allow %q error = %v, want ErrEnvNotAllowed", name, allow, err)
+			}
+		}
+	}
+	for _, pattern := range DefaultEnvDeny {
+		if envAllowed(pattern, nil, nil) {
+			t.Errorf("envAllowed(%q) = true", pattern)
+		}
+	}
+	w := &Worker{cfg: &WorkerConfig{EnvAllow: []string{"*"}}}
+	if _, err := w.checkEnv(map[string]string{"HOME": "/", "LANG": "C", "PATHS": "x"}); err != nil {
+		t.Errorf("checkEnv() error = %v", err)
+	}
+}
@@ -0,0 +1,451 @@
+package core
+
+import (
+	"fmt"
+	"github.com/phillihq/ktse/logger"
+	"gopkg.in/redis.v3"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	statsKeyPrefix = "ktse_stats"
+	//统计的时间粒度
+	StatsMinute = "minute"
+	StatsHour   = "hour"
+	StatsDay    = "day"
+	//一次查询最多返回的时间点数
+	MaxStatsPoints = 1440
+	//统计维度
+	StatsByTaskType = "task_type"
+	StatsByQueue    = "queue"
+	StatsByBinName  = "bin_name"
+	statsFieldSep   = "|"
+	//任务的最终结果
+	StatsFirstTrySuccess = "first_try_success"
+	StatsRetrySuccess    = "retry_success"
+	StatsFinalFailure    = "final_failure"
+	//按天的成功/失败任务数的保存时间
+	taskCountKeepTime = 30 * 24 * time.Hour
+	//集群模式下结果(r_<uuid>)中表示该次执行已经统计的字段
+	resultCountedField = "counted"
+)
+
+//每次执行写入所有粒度,相当于写入时汇总
+var statsResolutions = []struct {
+	name string
+	keep time.Duration
+}{
+	{StatsMinute, 2 * 24 * time.Hour},
+	{StatsHour, 35 * 24 * time.Hour},
+	{StatsDay, 400 * 24 * time.Hour},
+}
+
+//执行时长的分桶上限(毫秒),用于估算p95,最后一个桶没有上限
+var statsDurationBuckets = []int64{10, 50, 100, 500, 1000, 5000, 10000, 30000, 60000, 300000, 900000, 3600000}
+
+//累加hash中的多个字段并设置过期时间,ARGV[1]为过期秒数,之后为字段和增量
+const statsIncrScript = `
+for i = 2, #ARGV, 2 do
+	redis.call('HINCRBY', KEYS[1], ARGV[i], ARGV[i+1])
+end
+redis.call('EXPIRE', KEYS[1], ARGV[1])
+return 1
+`
+
+//集群模式下写入结果(hash)并设置过期时间,ARGV[1]为过期秒数,ARGV[2]为counted字段,之后为字段和值
+//返回1表示该次执行还没有统计
+const resultWriteScript = `
+redis.call('HMSET', KEYS[1], unpack(ARGV, 3))
+redis.call('EXPIRE', KEYS[1], ARGV[1])
+return redis.call('HSETNX', KEYS[1], ARGV[2], '1')
+`
+
+//统计的查询条件,From和To为unix时间戳(秒),GroupBy为空表示合计所有维度
+type StatsQuery struct {
+	Resolution string
+	From       int64
+	To         int64
+	GroupBy    []string
+	TaskType   string
+	Queue      string
+	BinName    string
+}
+
+//一个时间点的统计,时长单位为毫秒
+type StatsPoint struct {
+	Time     int64 `json:"time"`
+	Success  int64 `json:"success"`
+	Failure  int64 `json:"failure"`
+	Canceled int64 `json:"canceled"`
+	Retries  int64 `json:"retries"`
+	//任务的最终结果,被取消的任务算作最终失败
+	FirstTrySuccess int64   `json:"first_try_success"`
+	RetrySuccess    int64   `json:"retry_success"`
+	FinalFailure    int64   `json:"final_failure"`
+	AvgDuration     float64 `json:"avg_duration"`
+	P95Duration     float64 `json:"p95_duration"`
+	sum             int64
+	buckets         []int64
+}
+
+//一组维度的时间序列,只包含有执行记录的时间点
+type StatsSeries struct {
+	TaskType string        `json:"task_type,omitempty"`
+	Queue    string        `json:"queue,omitempty"`
+	BinName  string        `json:"bin_name,omitempty"`
+	Points   []*StatsPoint `json:"points"`
+}
+
+type Stats struct {
+	Resolution string         `json:"resolution"`
+	From       int64          `json:"from"`
+	To         int64          `json:"to"`
+	Series     []*StatsSeries `json:"series"`
+}
+
+func StatsKey(resolution string, bucket int64) string {
+	return fmt.Sprintf("%s:%s:%d", statsKeyPrefix, resolution, bucket)
+}
+
+//时间点所在区间的开始时间,天按本地时间的零点对齐
+func statsBucket(resolution string, t time.Time) int64 {
+	switch resolution {
+	case StatsMinute:
+		return t.Unix() / 60 * 60
+	case StatsHour:
+		return t.Unix() / 3600 * 3600
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local).Unix()
+}
+
+func nextStatsBucket(resolution string, bucket int64) int64 {
+	switch resolution {
+	case StatsMinute:
+		return bucket + 60
+	case StatsHour:
+		return bucket + 3600
+	}
+	return time.Unix(bucket, 0).AddDate(0, 0, 1).Unix()
+}
+
+//默认查询最近的时间范围
+func defaultStatsRange(resolution string) time.Duration {
+	switch resolution {
+	case StatsMinute:
+		return time.Hour
+	case StatsHour:
+		return 24 * time.Hour
+	}
+	return 30 * 24 * time.Hour
+}
+
+func statsDurationBucket(duration int64) int {
+	for i, bound := range statsDurationBuckets {
+		if duration <= bound {
+			return i
+		}
+	}
+	return len(statsDurationBuckets)
+}
+
+//字段格式为<task_type>|<queue>|<bin_name>|<指标>,bin_name和处理函数任务的queue中可能有分隔符
+func statsField(taskType string, queue string, binName string, metric string) string {
+	return strings.Join([]string{taskType, queue, binName, metric}, statsFieldSep)
+}
+
+func parseStatsField(field string) (taskType string, queue string, binName string, metric string, ok bool) {
+	vec := strings.Split(field, statsFieldSep)
+	if len(vec) < 4 {
+		return "", "", "", "", false
+	}
+	taskType, metric = vec[0], vec[len(vec)-1]
+	rest := strings.Join(vec[1:len(vec)-1], statsFieldSep)
+	//处理函数任务的队列为前缀加上名称,名称在queue和bin_name中各出现一次
+	if taskType == taskTypeName(HandlerTask) && strings.HasPrefix(rest, HandlerQueuePrefix) {
+		n := (len(rest) - len(HandlerQueuePrefix) - len(statsFieldSep)) / 2
+		if n >= 0 && rest[len(HandlerQueuePrefix):len(HandlerQueuePrefix)+n] == rest[len(rest)-n:] {
+			return taskType, rest[:len(HandlerQueuePrefix)+n], rest[len(rest)-n:], metric, true
+		}
+	}
+	return taskType, vec[1], strings.Join(vec[2:len(vec)-1], statsFieldSep), metric, true
+}
+
+//每次执行需要累加的字段,重试指除第一次执行之外的执行,包括手动重新执行
+func attemptStatsArgs(result *TaskResult) []string {
+	taskType := taskTypeName(result.TaskType)
+	queue := result.Queue()
+	binName := metricBinName(&result.TaskRequest)
+	duration := result.ExecEndTime - result.ExecStartTime
+	if duration < 0 {
+		duration = 0
+	}
+	fields := []string{
+		statsField(taskType, queue, binName, taskOutcome(result)), "1",
+		statsField(taskType, queue, binName, "dur_sum"), strconv.FormatInt(duration, 10),
+		statsField(taskType, queue, binName, fmt.Sprintf("dur_%d", statsDurationBucket(duration))), "1",
+	}
+	if !result.FirstAttempt() {
+		fields = append(fields, statsField(taskType, queue, binName, "retries"), "1")
+	}
+	return fields
+}
+
+//任务结束时累加的字段
+func taskStatsArgs(req *TaskRequest, final string) []string {
+	return []string{statsField(taskTypeName(req.TaskType), req.Queue(), metricBinName(req), final), "1"}
+}
+
+//任务的最终结果,还会重试时返回空:成功都是最终结果,失败在最后一次执行或者被取消时是最终结果
+func taskFinal(result *TaskResult) string {
+	if result.IsSuccess == 1 {
+		if result.FirstAttempt() {
+			return StatsFirstTrySuccess
+		}
+		return StatsRetrySuccess
+	}
+	if result.Canceled || result.IsLastAttempt() {
+		return StatsFinalFailure
+	}
+	return ""
+}
+
+//统计命令,worker在事务中执行,broker直接执行
+type statsCmdable interface {
+	Eval(script string, keys []string, args []string) *redis.Cmd
+	Incr(key string) *redis.IntCmd
+	Expire(key string, expiration time.Duration) *redis.BoolCmd
+}
+
+//累加所有粒度的统计和按天的成功/失败任务数,end为执行结束时间
+func writeTaskCounts(c statsCmdable, end time.Time, args []string, final string) []redis.Cmder {
+	var cmds []redis.Cmder
+	for _, res := range statsResolutions {
+		key := StatsKey(res.name, statsBucket(res.name, end))
+		argv := append([]string{strconv.FormatInt(int64(res.keep/time.Second), 10)}, args...)
+		cmds = append(cmds, c.Eval(statsIncrScript, []string{key}, argv))
+	}
+	var countKey string
+	switch final {
+	case StatsFirstTrySuccess, StatsRetrySuccess:
+		countKey = fmt.Sprintf(SuccessTaskKey, end.Format(TimeFormat))
+	case StatsFinalFailure:
+		countKey = fmt.Sprintf(FailTaskKey, end.Format(TimeFormat))
+	}
+	if len(countKey) != 0 {
+		//保存一个月
+		cmds = append(cmds, c.Incr(countKey), c.Expire(countKey, taskCountKeepTime))
+	}
+	return cmds
+}
+
+//一次执行的统计,在写入结果的事务中执行
+func countTaskResult(c statsCmdable, result *TaskResult) []redis.Cmder {
+	args := attemptStatsArgs(result)
+	final := taskFinal(result)
+	if len(final) != 0 {
+		args = append(args, taskStatsArgs(&result.TaskRequest, final)...)
+	}
+	return writeTaskCounts(c, time.Unix(0, result.ExecEndTime*int64(time.Millisecond)), args, final)
+}
+
+//broker不再重试失败的任务时记录最终失败,worker认为还会重试所以没有记录
+func (b *Broker) countFinalFailure(req *TaskRequest) error {
+	var cmds []redis.Cmder
+	args := taskStatsArgs(req, StatsFinalFailure)
+	if b.IsCluster() {
+		cmds = writeTaskCounts(b.redisClusterClient, time.Now(), args, StatsFinalFailure)
+	} else {
+		cmds = writeTaskCounts(b.redisClient, time.Now(), args, StatsFinalFailure)
+	}
+	err := firstCmdErr(cmds)
+	if err != nil {
+		observeRedisError("broker", "count", err)
+		logger.GetLogger().Errorln("Broker", "countFinalFailure", err.Error(), 0, "uuid", req.Uuid)
+	}
+	return err
+}
+
+func validStatsResolution(resolution string) bool {
+	for _, res := range statsResolutions {
+		if res.name == resolution {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *StatsPoint) add(metric string, value int64) {
+	switch metric {
+	case OutcomeSuccess:
+		p.Success += value
+	case OutcomeFailure:
+		p.Failure += value
+	case OutcomeCanceled:
+		p.Canceled += value
+	case "retries":
+		p.Retries += value
+	case StatsFirstTrySuccess:
+		p.FirstTrySuccess += value
+	case StatsRetrySuccess:
+		p.RetrySuccess += value
+	case StatsFinalFailure:
+		p.FinalFailure += value
+	case "dur_sum":
+		p.sum += value
+	default:
+		i, err := strconv.Atoi(strings.TrimPrefix(metric, "dur_"))
+		if err != nil || i < 0 || i > len(statsDurationBuckets) {
+			return
+		}
+		if p.buckets == nil {
+			p.buckets = make([]int64, len(statsDurationBuckets)+1)
+		}
+		p.buckets[i] += value
+	}
+}
+
+//根据分桶计数估算分位数,在桶内线性插值,落在最后一个桶时返回最大的上限
+func (p *StatsPoint) quantile(q float64) float64 {
+	var total int64
+	for _, n := range p.buckets {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var count int64
+	for i, n := range p.buckets {
+		if float64(count+n) < rank || n == 0 {
+			count += n
+			continue
+		}
+		if i == len(statsDurationBuckets) {
+			return float64(statsDurationBuckets[i-1])
+		}
+		var lower int64
+		if i > 0 {
+			lower = statsDurationBuckets[i-1]
+		}
+		return float64(lower) + float64(statsDurationBuckets[i]-lower)*(rank-float64(count))/float64(n)
+	}
+	return float64(statsDurationBuckets[len(statsDurationBuckets)-1])
+}
+
+func (p *StatsPoint) finish() {
+	if count := p.Success + p.Failure + p.Canceled; count > 0 {
+		p.AvgDuration = math.Round(float64(p.sum)/float64(count)*100) / 100
+	}
+	p.P95Duration = math.Round(p.quantile(0.95)*100) / 100
+}
+
+//查询时间范围内的统计,按GroupBy中的维度分组
+func (b *Broker) HandleStats(q *StatsQuery) (*Stats, error) {
+	if len(q.Resolution) == 0 {
+		q.Resolution = StatsHour
+	}
+	if !validStatsResolution(q.Resolution) {
+		return nil, ErrInvalidArgument
+	}
+	group := map[string]bool{}
+	for _, dim := range q.GroupBy {
+		if dim != StatsByTaskType && dim != StatsByQueue && dim != StatsByBinName {
+			return nil, ErrInvalidArgument
+		}
+		group[dim] = true
+	}
+	if q.To == 0 {
+		q.To = time.Now().Unix()
+	}
+	if q.From == 0 {
+		q.From = q.To - int64(defaultStatsRange(q.Resolution)/time.Second)
+	}
+	if q.From > q.To {
+		return nil, ErrInvalidArgument
+	}
+
+	var buckets []int64
+	for bucket := statsBucket(q.Resolution, time.Unix(q.From, 0)); bucket <= q.To; bucket = nextStatsBucket(q.Resolution, bucket) {
+		if len(buckets) == MaxStatsPoints {
+			return nil, ErrStatsRangeTooLarge
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	series := map[string]*StatsSeries{}
+	for _, bucket := range buckets {
+		key := StatsKey(q.Resolution, bucket)
+		var fields map[string]string
+		var err error
+		if b.IsCluster() {
+			fields, err = b.redisClusterClient.HGetAllMap(key).Result()
+		} else {
+			fields, err = b.redisClient.HGetAllMap(key).Result()
+		}
+		if err != nil {
+			observeRedisError("broker", "hgetall", err)
+			logger.GetLogger().Errorln("Broker", "HandleStats", err.Error(), 0, "key", key)
+			return nil, err
+		}
+		points := map[string]*StatsPoint{}
+		for field, value := range fields {
+			taskType, queue, binName, metric, ok := parseStatsField(field)
+			if !ok {
+				continue
+			}
+			if (len(q.TaskType) != 0 && taskType != q.TaskType) || (len(q.Queue) != 0 && queue != q.Queue) ||
+				(len(q.BinName) != 0 && binName != q.BinName) {
+				continue
+			}
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			s := &StatsSeries{}
+			if group[StatsByTaskType] {
+				s.TaskType = taskType
+			}
+			if group[StatsByQueue] {
+				s.Queue = queue
+			}
+			if group[StatsByBinName] {
+				s.BinName = binName
+			}
+			id := statsField(s.TaskType, s.Queue, s.BinName, "")
+			if _, ok := series[id]; !ok {
+				s.Points = []*StatsPoint{}
+				series[id] = s
+			}
+			point, ok := points[id]
+			if !ok {
+				point = &StatsPoint{Time: bucket}
+				points[id] = point
+				series[id].Points = append(series[id].Points, point)
+			}
+			point.add(metric, n)
+		}
+		for _, point := range points {
+			point.finish()
+		}
+	}
+
+	stats := &Stats{Resolution: q.Resolution, From: buckets[0], To: q.To, Series: []*StatsSeries{}}
+	for _, s := range series {
+		stats.Series = append(stats.Series, s)
+	}
+	sort.Slice(stats.Series, func(i, j int) bool {
+		a, b := stats.Series[i], stats.Series[j]
+		if a.TaskType != b.TaskType {
+			return a.TaskType < b.TaskType
+		}
+		if a.Queue != b.Queue {
+			return a.Queue < b.Queue
+		}
+		return a.BinName < b.BinName
+	})
+	return stats, nil
+}
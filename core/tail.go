@@ -0,0 +1,276 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/phillihq/ktse/logger"
+	"gopkg.in/redis.v3"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultLiveLogLines = 1000 //每个任务在redis中保留的实时输出行数
+	liveLogLineSize     = 4096 //单行最大字节数,超过的部分被丢弃
+	liveLogFlushTime    = time.Millisecond * 200
+	liveLogPollTime     = time.Millisecond * 500 //broker推送实时输出时轮询redis的间隔
+	liveLogPingTime     = time.Second * 15       //没有输出时发送心跳的间隔
+	//score = index*liveLogSeqBase + seq,重试时序号继续增长
+	liveLogSeqBase = 1000000000
+)
+
+//实时输出的一行
+type LogLine struct {
+	Seq    int64  `json:"seq"`
+	Time   int64  `json:"time"` //毫秒时间戳
+	Stream string `json:"stream"`
+	Line   string `json:"line"`
+}
+
+//实时输出在redis中的key(sorted set)
+func LiveLogKey(uuid string) string {
+	return fmt.Sprintf("l_%s", uuid)
+}
+
+//把脚本输出按行批量写入redis
+type logStreamer struct {
+	w       *Worker
+	key     string
+	base    int64
+	maxLine int64
+	sync.Mutex
+	seq     int64
+	pending []redis.Z
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+//开始记录任务的实时输出,返回nil表示没有开启实时输出
+func (w *Worker) newLogStreamer(req *TaskRequest) *logStreamer {
+	maxLine := w.cfg.LiveLogLines
+	if maxLine == 0 {
+		maxLine = DefaultLiveLogLines
+	}
+	if maxLine < 0 {
+		return nil
+	}
+	s := &logStreamer{
+		w:       w,
+		key:     LiveLogKey(req.Uuid),
+		base:    int64(req.Index) * liveLogSeqBase,
+		maxLine: maxLine,
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+//返回按行写入的io.Writer,stream为stdout或stderr
+func (s *logStreamer) Writer(stream string) io.Writer {
+	return &lineWriter{s: s, stream: stream}
+}
+
+func (s *logStreamer) add(stream string, line []byte) {
+	if len(line) > liveLogLineSize {
+		line = line[:liveLogLineSize]
+	}
+	s.Lock()
+	s.seq++
+	buf, _ := json.Marshal(&LogLine{
+		Seq:    s.base + s.seq,
+		Time:   time.Now().UnixNano() / int64(time.Millisecond),
+		Stream: stream,
+		Line:   string(line),
+	})
+	s.pending = append(s.pending, redis.Z{Score: float64(s.base + s.seq), Member: string(buf)})
+	s.Unlock()
+}
+
+func (s *logStreamer) run() {
+	defer close(s.done)
+	for {
+		select {
+		case <-time.After(liveLogFlushTime):
+			s.flush()
+		case <-s.quit:
+			s.flush()
+			return
+		}
+	}
+}
+
+//写入redis,只保留最后maxLine行,并设置和结果相同的过期时间
+func (s *logStreamer) flush() {
+	s.Lock()
+	vec := s.pending
+	s.pending = nil
+	s.Unlock()
+	if len(vec) == 0 {
+		return
+	}
+	var err error
+	expire := time.Second * time.Duration(s.w.cfg.ResultKeepTime)
+	if s.w.IsCluster() {
+		err = s.w.redisClusterClient.ZAdd(s.key, vec...).Err()
+		if err == nil {
+			err = s.w.redisClusterClient.ZRemRangeByRank(s.key, 0, -s.maxLine-1).Err()
+		}
+		if err == nil {
+			err = s.w.redisClusterClient.Expire(s.key, expire).Err()
+		}
+	} else {
+		err = s.w.redisClient.ZAdd(s.key, vec...).Err()
+		if err == nil {
+			err = s.w.redisClient.ZRemRangeByRank(s.key, 0, -s.maxLine-1).Err()
+		}
+		if err == nil {
+			err = s.w.redisClient.Expire(s.key, expire).Err()
+		}
+	}
+	if err != nil {
+		logger.GetLogger().Errorln("Worker", "logStreamer", "flush error", 0, "key", s.key, "err", err.Error())
+	}
+}
+
+//写入剩余的输出,需要在进程退出后调用
+func (s *logStreamer) Close(writers ...io.Writer) {
+	for _, w := range writers {
+		if lw, ok := w.(*lineWriter); ok {
+			lw.flushLine()
+		}
+	}
+	close(s.quit)
+	<-s.done
+}
+
+//按行切分输出
+type lineWriter struct {
+	s      *logStreamer
+	stream string
+	buf    []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) != 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			//不完整的行过长时直接输出
+			if len(lw.buf)+len(p) > liveLogLineSize {
+				lw.buf = append(lw.buf, p...)
+				lw.flushLine()
+			} else {
+				lw.buf = append(lw.buf, p...)
+			}
+			break
+		}
+		lw.buf = append(lw.buf, p[:i]...)
+		lw.s.add(lw.stream, lw.buf)
+		lw.buf = lw.buf[:0]
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+//写入没有换行符结尾的输出
+func (lw *lineWriter) flushLine() {
+	if len(lw.buf) == 0 {
+		return
+	}
+	lw.s.add(lw.stream, lw.buf)
+	lw.buf = lw.buf[:0]
+}
+
+//w为nil时只写入line
+func teeWriter(w io.Writer, line io.Writer) io.Writer {
+	if w == nil {
+		return line
+	}
+	return io.MultiWriter(w, line)
+}
+
+//读取序号大于after的实时输出
+func (b *Broker) GetLiveLogs(uuid string, after int64) ([]*LogLine, error) {
+	opt := redis.ZRangeByScore{
+		Min: "(" + strconv.FormatInt(after, 10),
+		Max: "+inf",
+	}
+	var vec []string
+	var err error
+	if b.IsCluster() {
+		vec, err = b.redisClusterClient.ZRangeByScore(LiveLogKey(uuid), opt).Result()
+	} else {
+		vec, err = b.redisClient.ZRangeByScore(LiveLogKey(uuid), opt).Result()
+	}
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	lines := make([]*LogLine, 0, len(vec))
+	for _, str := range vec {
+		line := new(LogLine)
+		if err = json.Unmarshal([]byte(str), line); err != nil {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+//任务是否已经结束:成功,不再重试的失败或者取消,失败后等待重试的任务没有结束
+//优先使用任务索引中的状态,没有索引的任务根据结果判断
+func (b *Broker) IsTaskFinished(uuid string) (bool, error) {
+	info, err := b.getTaskInfo(uuid)
+	if err != nil {
+		return false, err
+	}
+	if info != nil {
+		return isFinalState(info.State), nil
+	}
+	key := fmt.Sprintf("r_%s", uuid)
+	fields := append(append([]string{}, TaskRequestFields...), "is_success")
+	var result []interface{}
+	if b.IsCluster() {
+		result, err = b.redisClusterClient.HMGet(key, fields...).Result()
+	} else {
+		result, err = b.redisClient.HMGet(key, fields...).Result()
+	}
+	if err != nil {
+		return false, err
+	}
+	if result[0] == nil {
+		return false, nil
+	}
+	if hashString(result[len(TaskRequestFields)]) == "1" {
+		return true, nil
+	}
+	request, err := parseTaskRequest(result[:len(TaskRequestFields)])
+	if err != nil {
+		return false, err
+	}
+	return request.IsLastAttempt() || b.isTaskCanceled(uuid), nil
+}
+
+func isFinalState(state string) bool {
+	return state == TaskStateSuccess || state == TaskStateFailure || state == TaskStateCanceled
+}
+
+//任务的请求,结果,进度或索引是否存在
+func (b *Broker) taskExists(uuid string) (bool, error) {
+	for _, key := range []string{fmt.Sprintf("t_%s", uuid), fmt.Sprintf("r_%s", uuid), ProgressKey(uuid), TaskInfoKey(uuid)} {
+		var exist bool
+		var err error
+		if b.IsCluster() {
+			exist, err = b.redisClusterClient.Exists(key).Result()
+		} else {
+			exist, err = b.redisClient.Exists(key).Result()
+		}
+		if err != nil || exist {
+			return exist, err
+		}
+	}
+	return false, nil
+}
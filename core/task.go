@@ -1,5 +1,13 @@
 package core
 
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
 //任务类型
 const (
 	ScriptTask    = 1
@@ -7,18 +15,75 @@ const (
 	RpcTaskPOST   = 3
 	RpcTaskPUT    = 4
 	RpcTaskDELETE = 5
+	RpcTaskPATCH  = 6
+	RpcTaskHEAD   = 7
+	GrpcTask      = 8
+	HandlerTask   = 9 //worker中注册的处理函数,bin_name为处理函数名称
+)
+
+//脚本任务成功的判断策略
+const (
+	SuccessPolicyExitCode = "exit_code" //退出码在success_codes中即成功,默认只接受0
+	SuccessPolicyStderr   = "stderr"    //兼容旧逻辑,在退出码的基础上stderr有输出也算失败
 )
 
+//任务请求在redis hash中保存的字段,顺序与parseTaskRequest的解析顺序一致
+var TaskRequestFields = []string{
+	"uuid",
+	"bin_name",
+	"args",
+	"start_time",
+	"time_interval",
+	"index",
+	"max_run_time",
+	"task_type",
+	"arg_list",
+	"env",
+	"cwd",
+	"stdin",
+	"success_policy",
+	"success_codes",
+	"limit",
+	"callback_url",
+	"rpc",
+	"grpc",
+	"tags",
+	"traceparent",
+	"attempt",
+}
+
 //任务请求对象
 type TaskRequest struct {
-	Uuid         string `json:"uuid"`
-	BinName      string `json:"bin_name"`
-	Args         string `json:"args"` //空格分隔各个参数
-	StartTime    int64  `json:"start_time,string"`
-	TimeInterval string `json:"time_interval"` //空格分隔各个参数
-	Index        int    `json:"index,string"`
-	MaxRunTime   int64  `json:"max_run_time,string"`
-	TaskType     int    `json:"task_type,string"`
+	Uuid         string   `json:"uuid"`
+	BinName      string   `json:"bin_name"`
+	Args         string   `json:"args"` //空格分隔各个参数,支持shell引号规则
+	StartTime    int64    `json:"start_time,string"`
+	TimeInterval string   `json:"time_interval"` //空格分隔各个参数
+	Index        int      `json:"index,string"`
+	MaxRunTime   int64    `json:"max_run_time,string"`
+	TaskType     int      `json:"task_type,string"`
+	ArgList      []string `json:"arg_list"` //脚本任务的参数列表,nil表示未提供
+	//脚本任务的环境变量,工作目录(相对于bin_path)和标准输入
+	Env   map[string]string `json:"env"`
+	Cwd   string            `json:"cwd"`
+	Stdin string            `json:"stdin"`
+	//脚本任务的成功策略和可接受的退出码(空格分隔),为空时使用worker的配置
+	SuccessPolicy string `json:"success_policy"`
+	SuccessCodes  string `json:"success_codes"`
+	//脚本任务的资源限制,不能超过worker配置的上限
+	Limit *ResourceLimit `json:"limit"`
+	//任务结束(成功或不再重试)后回调的地址
+	CallbackUrl string `json:"callback_url"`
+	//RPC任务的请求头,查询参数,认证,请求体编码和TLS选项
+	Rpc *RpcOption `json:"rpc"`
+	//gRPC任务的方法名,元数据,接口定义和TLS选项
+	Grpc *GrpcOption `json:"grpc"`
+	//任务标签,用于查询任务列表
+	Tags []string `json:"tags"`
+	//提交任务时的W3C trace上下文,执行和重试的span都在同一个trace中
+	TraceParent string `json:"traceparent"`
+	//手动重新执行之前已经执行的次数,重新执行时index从0开始
+	Attempt int `json:"attempt,string"`
 }
 
 //任务结果对象
@@ -26,11 +91,330 @@ type TaskResult struct {
 	TaskRequest
 	IsSuccess int64  `json:"is_success"`
 	Result    string `json:"result"`
+	WorkerId  string `json:"worker_id"`
+	//执行开始和结束时间(毫秒时间戳),执行时长(毫秒)
+	ExecStartTime int64 `json:"exec_start_time"`
+	ExecEndTime   int64 `json:"exec_end_time"`
+	Duration      int64 `json:"duration"`
+	//脚本任务的进程结果
+	ExitCode int    `json:"exit_code"`
+	Signal   string `json:"signal"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	//完整输出的引用,配置了log_store时有效
+	StdoutRef string `json:"stdout_ref"`
+	StderrRef string `json:"stderr_ref"`
+	//任务最后一次上报的进度,没有上报时为nil
+	Progress *Progress `json:"progress"`
+	//RPC任务的响应状态码,响应头和(可能被截断的)响应体
+	HttpStatus  int         `json:"http_status"`
+	HttpHeaders http.Header `json:"http_headers"`
+	HttpBody    string      `json:"http_body"`
+	//gRPC任务的状态码名称和状态信息
+	GrpcCode    string `json:"grpc_code"`
+	GrpcMessage string `json:"grpc_message"`
+	//任务被取消,不再重试
+	Canceled bool `json:"-"`
 }
 
 //任务回执
 type Reply struct {
-	IsResultExist int    `json:"is_result_exist"`
-	IsSuccess     int    `json:"is_success"`
-	Result        string `json:"message"`
-}
\ No newline at end of file
+	IsResultExist int         `json:"is_result_exist"`
+	IsSuccess     int         `json:"is_success"`
+	Result        string      `json:"message"`
+	WorkerId      string      `json:"worker_id,omitempty"`
+	ExecStartTime int64       `json:"exec_start_time,omitempty"`
+	ExecEndTime   int64       `json:"exec_end_time,omitempty"`
+	Duration      int64       `json:"duration,omitempty"`
+	ExitCode      *int        `json:"exit_code,omitempty"` //只有脚本任务有退出码
+	Signal        string      `json:"signal,omitempty"`
+	Stdout        string      `json:"stdout,omitempty"`
+	Stderr        string      `json:"stderr,omitempty"`
+	StdoutRef     string      `json:"stdout_ref,omitempty"`
+	StderrRef     string      `json:"stderr_ref,omitempty"`
+	Progress      *Progress   `json:"progress,omitempty"`
+	HttpStatus    int         `json:"http_status,omitempty"`
+	HttpHeaders   http.Header `json:"http_headers,omitempty"`
+	HttpBody      string      `json:"http_body,omitempty"`
+	GrpcCode      string      `json:"grpc_code,omitempty"`
+	GrpcMessage   string      `json:"grpc_message,omitempty"`
+	Retrying      bool        `json:"retrying,omitempty"` //失败后还会重试,不是最终结果
+}
+
+//任务结果在redis hash中保存的字段(不包括请求字段),顺序与parseReply的解析顺序一致
+var TaskResultFields = []string{
+	"is_success",
+	"result",
+	"worker_id",
+	"exec_start_time",
+	"exec_end_time",
+	"duration",
+	"exit_code",
+	"signal",
+	"stdout",
+	"stderr",
+	"stdout_ref",
+	"stderr_ref",
+	"progress",
+	"progress_message",
+	"progress_time",
+	"http_status",
+	"http_headers",
+	"http_body",
+	"grpc_code",
+	"grpc_message",
+}
+
+//保存脚本进程的执行结果
+func (r *TaskResult) SetExecResult(er *ExecResult) {
+	r.ExitCode = er.ExitCode
+	r.Signal = er.Signal
+	r.Stdout = er.Stdout
+	r.Stderr = er.Stderr
+	r.StdoutRef = er.StdoutRef
+	r.StderrRef = er.StderrRef
+	if !er.StartTime.IsZero() && !er.EndTime.IsZero() {
+		r.ExecStartTime = er.StartTime.UnixNano() / int64(time.Millisecond)
+		r.ExecEndTime = er.EndTime.UnixNano() / int64(time.Millisecond)
+		r.Duration = r.ExecEndTime - r.ExecStartTime
+	}
+}
+
+//保存RPC调用的响应
+func (r *TaskResult) SetRpcResponse(resp *RpcResponse) {
+	r.HttpStatus = resp.StatusCode
+	r.HttpHeaders = resp.Header
+	r.HttpBody = resp.Body
+}
+
+//保存gRPC调用的状态
+func (r *TaskResult) SetGrpcResponse(resp *GrpcResponse) {
+	r.GrpcCode = resp.Code.String()
+	r.GrpcMessage = resp.Message
+}
+
+//转换成HMSET使用的field/value序列,包括请求字段和结果字段
+func (r *TaskResult) resultPairs() []string {
+	var exitCode string
+	if r.TaskType == ScriptTask {
+		exitCode = strconv.Itoa(r.ExitCode)
+	}
+	var progress, progressMessage, progressTime string
+	var httpStatus, httpHeaders string
+	if r.HttpStatus != 0 {
+		httpStatus = strconv.Itoa(r.HttpStatus)
+		buf, _ := json.Marshal(r.HttpHeaders)
+		httpHeaders = string(buf)
+	}
+	if r.Progress != nil {
+		progress = strconv.Itoa(r.Progress.Percent)
+		progressMessage = r.Progress.Message
+		progressTime = strconv.FormatInt(r.Progress.UpdateTime, 10)
+	}
+	return append(r.redisPairs(),
+		"is_success", strconv.FormatInt(r.IsSuccess, 10),
+		"result", r.Result,
+		"worker_id", r.WorkerId,
+		"exec_start_time", strconv.FormatInt(r.ExecStartTime, 10),
+		"exec_end_time", strconv.FormatInt(r.ExecEndTime, 10),
+		"duration", strconv.FormatInt(r.Duration, 10),
+		"exit_code", exitCode,
+		"signal", r.Signal,
+		"stdout", r.Stdout,
+		"stderr", r.Stderr,
+		"stdout_ref", r.StdoutRef,
+		"stderr_ref", r.StderrRef,
+		"progress", progress,
+		"progress_message", progressMessage,
+		"progress_time", progressTime,
+		"http_status", httpStatus,
+		"http_headers", httpHeaders,
+		"http_body", r.HttpBody,
+		"grpc_code", r.GrpcCode,
+		"grpc_message", r.GrpcMessage,
+	)
+}
+
+//根据HMGET(TaskResultFields)的结果构造任务回执
+func parseReply(result []interface{}) (*Reply, error) {
+	if len(result) != len(TaskResultFields) {
+		return nil, ErrInvalidArgument
+	}
+	isSuccess, err := strconv.Atoi(hashString(result[0]))
+	if err != nil {
+		return nil, err
+	}
+	reply := &Reply{
+		IsResultExist: ResultIsExist,
+		IsSuccess:     isSuccess,
+		Result:        hashString(result[1]),
+		WorkerId:      hashString(result[2]),
+		Signal:        hashString(result[7]),
+		Stdout:        hashString(result[8]),
+		Stderr:        hashString(result[9]),
+		StdoutRef:     hashString(result[10]),
+		StderrRef:     hashString(result[11]),
+	}
+	//旧版本worker写入的结果没有以下字段
+	reply.ExecStartTime, _ = strconv.ParseInt(hashString(result[3]), 10, 64)
+	reply.ExecEndTime, _ = strconv.ParseInt(hashString(result[4]), 10, 64)
+	reply.Duration, _ = strconv.ParseInt(hashString(result[5]), 10, 64)
+	if exitCode, err := strconv.Atoi(hashString(result[6])); err == nil {
+		reply.ExitCode = &exitCode
+	}
+	reply.Progress = parseProgress(result[12:15])
+	reply.HttpStatus, _ = strconv.Atoi(hashString(result[15]))
+	if headers := hashString(result[16]); len(headers) != 0 {
+		json.Unmarshal([]byte(headers), &reply.HttpHeaders)
+	}
+	reply.HttpBody = hashString(result[17])
+	reply.GrpcCode = hashString(result[18])
+	reply.GrpcMessage = hashString(result[19])
+	return reply, nil
+}
+
+//处理函数name的任务队列
+func HandlerQueue(name string) string {
+	return HandlerQueuePrefix + name
+}
+
+//任务所在的队列,处理函数任务在各自的队列中,其他任务在request_uuid_set中
+func (r *TaskRequest) Queue() string {
+	if r.TaskType == HandlerTask {
+		return HandlerQueue(r.BinName)
+	}
+	return RequestUuidSet
+}
+
+//转换成HMSET使用的field/value序列,与TaskRequestFields一一对应
+func (r *TaskRequest) redisPairs() []string {
+	var argList string
+	if r.ArgList != nil {
+		buf, _ := json.Marshal(r.ArgList)
+		argList = string(buf)
+	}
+	var limit, rpc, grpc string
+	if r.Limit != nil {
+		buf, _ := json.Marshal(r.Limit)
+		limit = string(buf)
+	}
+	if r.Rpc != nil {
+		buf, _ := json.Marshal(r.Rpc)
+		rpc = string(buf)
+	}
+	if r.Grpc != nil {
+		buf, _ := json.Marshal(r.Grpc)
+		grpc = string(buf)
+	}
+	var env string
+	if len(r.Env) != 0 {
+		buf, _ := json.Marshal(r.Env)
+		env = string(buf)
+	}
+	return []string{
+		"uuid", r.Uuid,
+		"bin_name", r.BinName,
+		"args", r.Args,
+		"start_time", strconv.FormatInt(r.StartTime, 10),
+		"time_interval", r.TimeInterval,
+		"index", strconv.Itoa(r.Index),
+		"max_run_time", strconv.FormatInt(r.MaxRunTime, 10),
+		"task_type", strconv.Itoa(r.TaskType),
+		"arg_list", argList,
+		"env", env,
+		"cwd", r.Cwd,
+		"stdin", r.Stdin,
+		"success_policy", r.SuccessPolicy,
+		"success_codes", r.SuccessCodes,
+		"limit", limit,
+		"callback_url", r.CallbackUrl,
+		"rpc", rpc,
+		"grpc", grpc,
+		"tags", strings.Join(r.Tags, " "),
+		"traceparent", r.TraceParent,
+		"attempt", strconv.Itoa(r.Attempt),
+	}
+}
+
+//是否是任务的第一次执行,手动重新执行后不再是
+func (r *TaskRequest) FirstAttempt() bool {
+	return r.Index == 0 && r.Attempt == 0
+}
+
+//根据HMGET(TaskRequestFields)的结果构造任务请求
+func parseTaskRequest(args []interface{}) (*TaskRequest, error) {
+	var err error
+	if len(args) != TaskRequestItemCount {
+		return nil, ErrInvalidArgument
+	}
+	request := new(TaskRequest)
+	request.Uuid = hashString(args[0])
+	request.BinName = hashString(args[1])
+	request.Args = hashString(args[2])
+	request.StartTime, err = strconv.ParseInt(hashString(args[3]), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	request.TimeInterval = hashString(args[4])
+	request.Index, err = strconv.Atoi(hashString(args[5]))
+	if err != nil {
+		return nil, err
+	}
+	request.MaxRunTime, err = strconv.ParseInt(hashString(args[6]), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	request.TaskType, err = strconv.Atoi(hashString(args[7]))
+	if err != nil {
+		return nil, err
+	}
+	//升级前提交的任务没有arg_list字段
+	if argList := hashString(args[8]); len(argList) != 0 {
+		request.ArgList, err = ParseArgList(argList)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if env := hashString(args[9]); len(env) != 0 {
+		if err = json.Unmarshal([]byte(env), &request.Env); err != nil {
+			return nil, ErrInvalidEnv
+		}
+	}
+	request.Cwd = hashString(args[10])
+	request.Stdin = hashString(args[11])
+	request.SuccessPolicy = hashString(args[12])
+	request.SuccessCodes = hashString(args[13])
+	if limit := hashString(args[14]); len(limit) != 0 {
+		request.Limit = new(ResourceLimit)
+		if err = json.Unmarshal([]byte(limit), request.Limit); err != nil {
+			return nil, ErrInvalidLimit
+		}
+	}
+	request.CallbackUrl = hashString(args[15])
+	if rpc := hashString(args[16]); len(rpc) != 0 {
+		request.Rpc = new(RpcOption)
+		if err = json.Unmarshal([]byte(rpc), request.Rpc); err != nil {
+			return nil, ErrInvalidRpcOption
+		}
+	}
+	if grpc := hashString(args[17]); len(grpc) != 0 {
+		request.Grpc = new(GrpcOption)
+		if err = json.Unmarshal([]byte(grpc), request.Grpc); err != nil {
+			return nil, ErrInvalidGrpcOption
+		}
+	}
+	//升级前提交的任务没有tags字段
+	if tags := hashString(args[18]); len(tags) != 0 {
+		request.Tags = strings.Split(tags, " ")
+	}
+	request.TraceParent = hashString(args[19])
+	//升级前提交的任务没有attempt字段
+	request.Attempt, _ = strconv.Atoi(hashString(args[20]))
+	return request, nil
+}
+
+//HMGET返回的字段不存在时为nil
+func hashString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
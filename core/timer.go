@@ -21,9 +21,10 @@ type Timer struct {
 	near [TIME_NEAR]*list.List
 	t    [4][TIME_LEVEL]*list.List
 	sync.Mutex
-	time uint32
-	tick time.Duration
-	quit chan struct{}
+	time    uint32
+	tick    time.Duration
+	quit    chan struct{}
+	pending int
 }
 
 type Node struct {
@@ -81,10 +82,46 @@ func (t *Timer) NewTimer(d time.Duration, fn interface{}, arg interface{}) *Node
 	n.expire = uint32(d/t.tick) + t.time
 	t.Lock()
 	t.addNode(n)
+	t.pending++
 	t.Unlock()
 	return n
 }
 
+//number of nodes not dispatched yet
+func (t *Timer) Pending() int {
+	t.Lock()
+	defer t.Unlock()
+	return t.pending
+}
+
+//a node not dispatched yet and the time left before it fires
+type TimerEntry struct {
+	Arg    interface{}
+	Remain time.Duration
+}
+
+//snapshot of the nodes not dispatched yet
+func (t *Timer) Entries() []TimerEntry {
+	t.Lock()
+	defer t.Unlock()
+	var entries []TimerEntry
+	collect := func(l *list.List) {
+		for e := l.Front(); e != nil; e = e.Next() {
+			n := e.Value.(*Node)
+			entries = append(entries, TimerEntry{Arg: n.arg, Remain: time.Duration(n.expire-t.time) * t.tick})
+		}
+	}
+	for i := 0; i < TIME_NEAR; i++ {
+		collect(t.near[i])
+	}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < TIME_LEVEL; j++ {
+			collect(t.t[i][j])
+		}
+	}
+	return entries
+}
+
 func (t *Timer) String() string {
 	return fmt.Sprintf("Timer:time:%d, tick:%s", t.time, t.tick)
 }
@@ -144,6 +181,7 @@ func (t *Timer) execute() {
 	idx := t.time & TIME_NEAR_MASK
 	vec := t.near[idx]
 	if vec.Len() > 0 {
+		t.pending -= vec.Len()
 		front := vec.Front()
 		vec.Init()
 		t.Unlock()
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"context"
+	"github.com/labstack/echo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strings"
+)
+
+const (
+	tracerName = "github.com/phillihq/ktse/core"
+	//W3C trace上下文的请求头,也是任务hash中的字段名
+	TraceParentHeader = "traceparent"
+	//脚本任务中的trace上下文环境变量
+	TraceParentEnv = "TRACEPARENT"
+)
+
+var (
+	//没有配置导出地址时使用全局的空实现,trace上下文仍然会透传
+	tracer     = otel.Tracer(tracerName)
+	propagator = propagation.TraceContext{}
+)
+
+//通过OTLP/HTTP导出trace,endpoint可以是host:port(不使用TLS)或完整的url,返回关闭函数
+func InitTracer(endpoint string, service string, instance string) (func(context.Context) error, error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(endpoint)}
+	if !strings.Contains(endpoint, "://") {
+		opts = []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure()}
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	res := resource.NewSchemaless(
+		attribute.String("service.name", service),
+		attribute.String("service.instance.id", instance),
+	)
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func taskSpanAttributes(req *TaskRequest) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("ktse.task.uuid", req.Uuid),
+		attribute.String("ktse.task.type", taskTypeName(req.TaskType)),
+		attribute.String("ktse.task.bin_name", metricBinName(req)),
+		attribute.Int("ktse.task.index", req.Index),
+	}
+}
+
+//以任务保存的trace上下文为父span开始新的span
+func startTaskSpan(ctx context.Context, req *TaskRequest, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if len(req.TraceParent) != 0 {
+		ctx = propagator.Extract(ctx, propagation.MapCarrier{TraceParentHeader: req.TraceParent})
+	}
+	opts = append(opts, trace.WithAttributes(taskSpanAttributes(req)...))
+	return tracer.Start(ctx, name, opts...)
+}
+
+//根据HMGET(TaskRequestFields)的结果开始span,请求无法解析时没有父span
+func startTaskArgsSpan(ctx context.Context, args []interface{}, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	req, err := parseTaskRequest(args)
+	if err != nil {
+		req = new(TaskRequest)
+	}
+	return startTaskSpan(ctx, req, name, opts...)
+}
+
+//ctx中的trace上下文,没有时返回空
+func TraceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier[TraceParentHeader]
+}
+
+//把trace上下文写入请求头,用于RPC任务和客户端的请求
+func InjectTraceHeader(ctx context.Context, header http.Header) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+func spanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+//结束执行任务的span,任务失败时设置为错误状态
+func endTaskSpan(span trace.Span, result *TaskResult, err error) {
+	if result != nil {
+		span.SetAttributes(attribute.String("ktse.task.outcome", taskOutcome(result)))
+		if result.IsSuccess == 0 {
+			span.SetStatus(codes.Error, result.Result)
+		}
+	}
+	spanError(span, err)
+	span.End()
+}
+
+//为API请求创建span,接受客户端传入的traceparent请求头
+func (b *Broker) traceMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Path() == MetricsPath {
+				return next(c)
+			}
+			route := c.Path()
+			if len(route) == 0 {
+				route = "unmatched"
+			}
+			method := c.Request().Method()
+			ctx := propagator.Extract(c.Context(), c.Request().Header())
+			ctx, span := tracer.Start(ctx, method+" "+route, trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(attribute.String("http.request.method", method), attribute.String("http.route", route)))
+			defer span.End()
+			c.SetContext(ctx)
+			err := next(c)
+			code := c.Response().Status()
+			if err != nil {
+				code = http.StatusInternalServerError
+				if he, ok := err.(*echo.HTTPError); ok {
+					code = he.Code
+				}
+				spanError(span, err)
+			}
+			span.SetAttributes(attribute.Int("http.response.status_code", code))
+			if code >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(code))
+			}
+			return err
+		}
+	}
+}
@@ -1,28 +1,55 @@
 package core
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"github.com/labstack/echo"
 	mw "github.com/labstack/echo/middleware"
 	"github.com/pborman/uuid"
 	"github.com/phillihq/ktse/logger"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 //注册中间件
 func (b *Broker) RegisterMiddleware() {
 	b.web.Use(mw.Logger())
 	b.web.Use(mw.Recover())
+	b.web.Use(b.metricsMiddleware())
+	b.web.Use(b.traceMiddleware())
 }
 
 //注册Rest地址
 func (b *Broker) RegisterURL() {
 	b.web.Post("/api/task/script", echo.HandlerFunc(b.CreateScriptTaskRequest))
 	b.web.Post("/api/task/rpc", echo.HandlerFunc(b.CreateRpcTaskRequest))
+	b.web.Post("/api/task/grpc", echo.HandlerFunc(b.CreateGrpcTaskRequest))
+	b.web.Post("/api/task/handler", echo.HandlerFunc(b.CreateHandlerTaskRequest))
 	b.web.Get("/api/task/result", echo.HandlerFunc(b.GetTaskResult))
+	b.web.Get("/api/task/status", echo.HandlerFunc(b.GetTaskStatus))
+	b.web.Get("/api/task/events", echo.HandlerFunc(b.GetTaskEvents))
+	b.web.Get("/api/task/callback", echo.HandlerFunc(b.GetTaskCallback))
+	b.web.Get("/api/tasks", echo.HandlerFunc(b.ListTasks))
+	b.web.Get("/api/tasks/scheduled", echo.HandlerFunc(b.ListScheduledTasks))
+	b.web.Get("/api/workers", echo.HandlerFunc(b.GetWorkers))
+	b.web.Get("/api/archive", echo.HandlerFunc(b.QueryArchive))
+	b.web.Get("/api/task/request", echo.HandlerFunc(b.GetTaskRequest))
+	b.web.Post("/api/task/cancel", echo.HandlerFunc(b.CancelTask))
+	b.web.Post("/api/task/retry", echo.HandlerFunc(b.RetryTask))
+	b.web.Post("/api/task/purge", echo.HandlerFunc(b.PurgeTask))
+	b.web.Post("/api/task/progress", echo.HandlerFunc(b.ReportTaskProgress))
+	b.web.Get("/api/task/log", echo.HandlerFunc(b.GetTaskLog))
+	b.web.Get("/api/task/:uuid/logs", echo.HandlerFunc(b.GetLiveTaskLog))
+	b.web.Get("/api/stats", echo.HandlerFunc(b.GetStats))
 	b.web.Get("/api/task/count/undo", echo.HandlerFunc(b.UndoTaskCount))
+	b.web.Get("/api/task/count/queues", echo.HandlerFunc(b.QueueTaskCount))
 	b.web.Get("/api/task/result/failure/:date", echo.HandlerFunc(b.FailTaskCount))
 	b.web.Get("/api/task/result/success/:date", echo.HandlerFunc(b.SuccessTaskCount))
+	b.web.Get(MetricsPath, echo.HandlerFunc(b.Metrics))
 }
 
 //提交脚本任务请求
@@ -31,34 +58,103 @@ func (b *Broker) CreateScriptTaskRequest(c echo.Context) error {
 	maxRunTime, _ := strconv.ParseInt(c.Query("max_run_time"), 10, 64)
 	args := struct {
 		BinName      string `json:"bin_name"`
-		Args         string `json:"args"` //空格分隔各个参数
+		Args         string `json:"args"`     //空格分隔各个参数,支持shell引号规则
+		ArgList      string `json:"arg_list"` //JSON数组形式的参数列表
 		StartTime    int64  `json:"start_time,string"`
 		TimeInterval string `json:"time_interval"` //空格分隔各个参数
 		MaxRunTime   int64  `json:"max_run_time,string"`
+		Env          string `json:"env"` //JSON对象形式的环境变量
+		Cwd          string `json:"cwd"`
+		Stdin        string `json:"stdin"`
+		StdinBase64  string `json:"stdin_base64"`
+		//成功策略(exit_code或stderr)和可接受的退出码(空格分隔)
+		SuccessPolicy string `json:"success_policy"`
+		SuccessCodes  string `json:"success_codes"`
+		Limit         string `json:"limit"` //JSON对象形式的资源限制
+		CallbackUrl   string `json:"callback_url"`
+		Tags          string `json:"tags"` //空格分隔各个标签
 	}{
-		BinName:      c.Query("bin_name"),
-		Args:         c.Query("args"),
-		StartTime:    startTime,
-		TimeInterval: c.Query("time_interval"),
-		MaxRunTime:   maxRunTime,
+		BinName:       c.Query("bin_name"),
+		Args:          c.Query("args"),
+		ArgList:       c.Query("arg_list"),
+		StartTime:     startTime,
+		TimeInterval:  c.Query("time_interval"),
+		MaxRunTime:    maxRunTime,
+		Env:           c.Query("env"),
+		Cwd:           c.Query("cwd"),
+		Stdin:         c.Query("stdin"),
+		StdinBase64:   c.Query("stdin_base64"),
+		SuccessPolicy: c.Query("success_policy"),
+		SuccessCodes:  c.Query("success_codes"),
+		Limit:         c.Query("limit"),
+		CallbackUrl:   c.Query("callback_url"),
+		Tags:          c.Query("tags"),
 	}
 
 	taskRequest := new(TaskRequest)
 	taskRequest.Uuid = uuid.New()
-	//判断脚本路径
-	if len(args.BinName) == 0 {
-		return c.JSON(http.StatusForbidden, ErrInvalidArgument)
-	}
 	taskRequest.BinName = args.BinName
-	taskRequest.Args = args.Args
+	//解析参数,arg_list和args只能提供一个,只提供args时由CheckTaskRequest拆分
+	var err error
+	if len(args.ArgList) != 0 {
+		if len(args.Args) != 0 {
+			return c.JSON(http.StatusForbidden, ErrInvalidArgs.Error())
+		}
+		taskRequest.ArgList, err = ParseArgList(args.ArgList)
+		if err != nil {
+			return c.JSON(http.StatusForbidden, err.Error())
+		}
+		taskRequest.Args = QuoteArgs(taskRequest.ArgList)
+	} else {
+		taskRequest.Args = args.Args
+	}
 	taskRequest.StartTime = args.StartTime
 	taskRequest.Index = 0
+	taskRequest.Attempt = 0
 	taskRequest.TimeInterval = args.TimeInterval
 	taskRequest.MaxRunTime = args.MaxRunTime
 	taskRequest.TaskType = ScriptTask
 
+	//环境变量,工作目录和标准输入
+	if len(args.Env) != 0 {
+		if err = json.Unmarshal([]byte(args.Env), &taskRequest.Env); err != nil {
+			return c.JSON(http.StatusForbidden, ErrInvalidEnv.Error())
+		}
+	}
+	taskRequest.Cwd = args.Cwd
+	if len(args.StdinBase64) != 0 {
+		if len(args.Stdin) != 0 {
+			return c.JSON(http.StatusForbidden, ErrInvalidArgument.Error())
+		}
+		stdin, err := base64.StdEncoding.DecodeString(args.StdinBase64)
+		if err != nil {
+			return c.JSON(http.StatusForbidden, ErrInvalidArgument.Error())
+		}
+		taskRequest.Stdin = string(stdin)
+	} else {
+		taskRequest.Stdin = args.Stdin
+	}
+
+	taskRequest.SuccessPolicy = args.SuccessPolicy
+	taskRequest.SuccessCodes = args.SuccessCodes
+
+	if len(args.Limit) != 0 {
+		taskRequest.Limit = new(ResourceLimit)
+		if err = json.Unmarshal([]byte(args.Limit), taskRequest.Limit); err != nil {
+			return c.JSON(http.StatusForbidden, ErrInvalidLimit.Error())
+		}
+	}
+	taskRequest.CallbackUrl = args.CallbackUrl
+	if taskRequest.Tags, err = ParseTags(args.Tags); err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	if err = b.CheckTaskRequest(taskRequest); err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+
 	//交给broker处理请求
-	err := b.HandleRequest(taskRequest)
+	taskRequest.TraceParent = TraceParent(c.Context())
+	err = b.HandleRequest(taskRequest)
 	if err != nil {
 		return c.JSON(http.StatusForbidden, err.Error())
 	}
@@ -67,6 +163,15 @@ func (b *Broker) CreateScriptTaskRequest(c echo.Context) error {
 		"uuid", taskRequest.Uuid,
 		"bin_name", taskRequest.BinName,
 		"args", taskRequest.Args,
+		"arg_list", taskRequest.ArgList,
+		"env", taskRequest.Env,
+		"cwd", taskRequest.Cwd,
+		"stdin_len", len(taskRequest.Stdin),
+		"success_policy", taskRequest.SuccessPolicy,
+		"success_codes", taskRequest.SuccessCodes,
+		"limit", taskRequest.Limit,
+		"callback_url", taskRequest.CallbackUrl,
+		"tags", taskRequest.Tags,
 		"start_time", taskRequest.StartTime,
 		"time_interval", taskRequest.TimeInterval,
 		"index", taskRequest.Index,
@@ -88,46 +193,251 @@ func (b *Broker) CreateRpcTaskRequest(c echo.Context) error {
 		StartTime    int64  `json:"start_time,string"`
 		TimeInterval string `json:"time_interval"` //空格分隔各个参数
 		MaxRunTime   int64  `json:"max_run_time,string"`
+		CallbackUrl  string `json:"callback_url"`
+		Tags         string `json:"tags"` //空格分隔各个标签
+		//JSON对象形式的请求头和查询参数
+		Headers string `json:"headers"`
+		Query   string `json:"query"`
+		//认证信息和TLS配置在worker配置中的名称
+		Auth        string `json:"auth"`
+		BodyType    string `json:"body_type"`
+		ContentType string `json:"content_type"`
+		Tls         string `json:"tls"`
+		SkipVerify  string `json:"skip_verify"`
+		//成功的状态码和响应体需要满足的条件
+		SuccessStatus string `json:"success_status"`
+		BodyRegex     string `json:"body_regex"`
+		JsonPath      string `json:"json_path"`
+		JsonValue     string `json:"json_value"`
+	}{
+		Method:        c.Query("method"),
+		URL:           c.Query("url"),
+		Args:          c.Query("args"),
+		StartTime:     startTime,
+		TimeInterval:  c.Query("time_interval"),
+		MaxRunTime:    maxRunTime,
+		CallbackUrl:   c.Query("callback_url"),
+		Tags:          c.Query("tags"),
+		Headers:       c.Query("headers"),
+		Query:         c.Query("query"),
+		Auth:          c.Query("auth"),
+		BodyType:      c.Query("body_type"),
+		ContentType:   c.Query("content_type"),
+		Tls:           c.Query("tls"),
+		SkipVerify:    c.Query("skip_verify"),
+		SuccessStatus: c.Query("success_status"),
+		BodyRegex:     c.Query("body_regex"),
+		JsonPath:      c.Query("json_path"),
+		JsonValue:     c.Query("json_value"),
+	}
+
+	taskRequest := new(TaskRequest)
+	taskRequest.Uuid = uuid.New()
+	taskRequest.BinName = args.URL
+	taskRequest.Args = args.Args
+	taskRequest.StartTime = args.StartTime
+	taskRequest.TimeInterval = args.TimeInterval
+	taskRequest.Index = 0
+	taskRequest.Attempt = 0
+	taskRequest.MaxRunTime = args.MaxRunTime
+	taskRequest.CallbackUrl = args.CallbackUrl
+	tags, err := ParseTags(args.Tags)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	taskRequest.Tags = tags
+	//不支持的请求方法为0,由CheckTaskRequest拒绝
+	taskRequest.TaskType = RpcTaskType(args.Method)
+
+	rpc := &RpcOption{
+		Auth:          args.Auth,
+		BodyType:      args.BodyType,
+		ContentType:   args.ContentType,
+		Tls:           args.Tls,
+		SkipVerify:    args.SkipVerify == "1" || args.SkipVerify == "true",
+		SuccessStatus: args.SuccessStatus,
+		BodyRegex:     args.BodyRegex,
+		JsonPath:      args.JsonPath,
+		JsonValue:     args.JsonValue,
+	}
+	if len(args.Headers) != 0 {
+		if err := json.Unmarshal([]byte(args.Headers), &rpc.Headers); err != nil {
+			return c.JSON(http.StatusForbidden, ErrInvalidRpcOption.Error())
+		}
+	}
+	if len(args.Query) != 0 {
+		if err := json.Unmarshal([]byte(args.Query), &rpc.Query); err != nil {
+			return c.JSON(http.StatusForbidden, ErrInvalidRpcOption.Error())
+		}
+	}
+	//没有附加参数的任务保持原来的格式
+	if !rpc.IsEmpty() {
+		taskRequest.Rpc = rpc
+	}
+	if err = b.CheckTaskRequest(taskRequest); err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+
+	taskRequest.TraceParent = TraceParent(c.Context())
+	err = b.HandleRequest(taskRequest)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	logger.GetLogger().Infoln("Broker", "CreateRpcTaskRequest", "ok", 0,
+		"uuid", taskRequest.Uuid,
+		"bin_name", taskRequest.BinName,
+		"args", taskRequest.Args,
+		"start_time", taskRequest.StartTime,
+		"time_interval", taskRequest.TimeInterval,
+		"index", taskRequest.Index,
+		"max_run_time", taskRequest.MaxRunTime,
+		"task_type", taskRequest.TaskType,
+		"callback_url", taskRequest.CallbackUrl,
+		"tags", taskRequest.Tags,
+		"rpc", taskRequest.Rpc,
+	)
+	return c.JSON(http.StatusOK, taskRequest.Uuid)
+}
+
+//提交gRPC方式的任务请求
+func (b *Broker) CreateGrpcTaskRequest(c echo.Context) error {
+	startTime, _ := strconv.ParseInt(c.Query("start_time"), 10, 64)
+	maxRunTime, _ := strconv.ParseInt(c.Query("max_run_time"), 10, 64)
+	args := struct {
+		Target       string `json:"target"`
+		Method       string `json:"method"` //完整方法名,例如package.Service/Method
+		Args         string `json:"args"`   //JSON格式的请求消息
+		StartTime    int64  `json:"start_time,string"`
+		TimeInterval string `json:"time_interval"` //空格分隔各个参数
+		MaxRunTime   int64  `json:"max_run_time,string"`
+		CallbackUrl  string `json:"callback_url"`
+		Tags         string `json:"tags"` //空格分隔各个标签
+		//JSON对象形式的元数据
+		Metadata string `json:"metadata"`
+		//接口定义和TLS配置在worker配置中的名称
+		Descriptor   string `json:"descriptor"`
+		Tls          string `json:"tls"`
+		SkipVerify   string `json:"skip_verify"`
+		SuccessCodes string `json:"success_codes"`
 	}{
+		Target:       c.Query("target"),
 		Method:       c.Query("method"),
-		URL:          c.Query("url"),
 		Args:         c.Query("args"),
 		StartTime:    startTime,
 		TimeInterval: c.Query("time_interval"),
 		MaxRunTime:   maxRunTime,
+		CallbackUrl:  c.Query("callback_url"),
+		Tags:         c.Query("tags"),
+		Metadata:     c.Query("metadata"),
+		Descriptor:   c.Query("descriptor"),
+		Tls:          c.Query("tls"),
+		SkipVerify:   c.Query("skip_verify"),
+		SuccessCodes: c.Query("success_codes"),
 	}
 
 	taskRequest := new(TaskRequest)
 	taskRequest.Uuid = uuid.New()
-	if len(args.URL) == 0 {
-		return c.JSON(http.StatusForbidden, ErrInvalidArgument)
+	taskRequest.BinName = args.Target
+	taskRequest.Args = args.Args
+	taskRequest.StartTime = args.StartTime
+	taskRequest.TimeInterval = args.TimeInterval
+	taskRequest.Index = 0
+	taskRequest.Attempt = 0
+	taskRequest.MaxRunTime = args.MaxRunTime
+	taskRequest.TaskType = GrpcTask
+	taskRequest.CallbackUrl = args.CallbackUrl
+	tags, err := ParseTags(args.Tags)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
 	}
+	taskRequest.Tags = tags
 
-	taskRequest.BinName = args.URL
+	opt := &GrpcOption{
+		Method:       args.Method,
+		Descriptor:   args.Descriptor,
+		Tls:          args.Tls,
+		SkipVerify:   args.SkipVerify == "1" || args.SkipVerify == "true",
+		SuccessCodes: args.SuccessCodes,
+	}
+	if len(args.Metadata) != 0 {
+		if err := json.Unmarshal([]byte(args.Metadata), &opt.Metadata); err != nil {
+			return c.JSON(http.StatusForbidden, ErrInvalidGrpcOption.Error())
+		}
+	}
+	taskRequest.Grpc = opt
+	if err = b.CheckTaskRequest(taskRequest); err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+
+	taskRequest.TraceParent = TraceParent(c.Context())
+	err = b.HandleRequest(taskRequest)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	logger.GetLogger().Infoln("Broker", "CreateGrpcTaskRequest", "ok", 0,
+		"uuid", taskRequest.Uuid,
+		"bin_name", taskRequest.BinName,
+		"args", taskRequest.Args,
+		"start_time", taskRequest.StartTime,
+		"time_interval", taskRequest.TimeInterval,
+		"index", taskRequest.Index,
+		"max_run_time", taskRequest.MaxRunTime,
+		"task_type", taskRequest.TaskType,
+		"callback_url", taskRequest.CallbackUrl,
+		"tags", taskRequest.Tags,
+		"grpc", taskRequest.Grpc,
+	)
+	return c.JSON(http.StatusOK, taskRequest.Uuid)
+}
+
+//提交处理函数任务请求,由注册了该处理函数的worker执行
+func (b *Broker) CreateHandlerTaskRequest(c echo.Context) error {
+	startTime, _ := strconv.ParseInt(c.Query("start_time"), 10, 64)
+	maxRunTime, _ := strconv.ParseInt(c.Query("max_run_time"), 10, 64)
+	args := struct {
+		Name         string `json:"name"`
+		Args         string `json:"args"` //传给处理函数的payload
+		StartTime    int64  `json:"start_time,string"`
+		TimeInterval string `json:"time_interval"` //空格分隔各个参数
+		MaxRunTime   int64  `json:"max_run_time,string"`
+		CallbackUrl  string `json:"callback_url"`
+		Tags         string `json:"tags"` //空格分隔各个标签
+	}{
+		Name:         c.Query("name"),
+		Args:         c.Query("args"),
+		StartTime:    startTime,
+		TimeInterval: c.Query("time_interval"),
+		MaxRunTime:   maxRunTime,
+		CallbackUrl:  c.Query("callback_url"),
+		Tags:         c.Query("tags"),
+	}
+
+	taskRequest := new(TaskRequest)
+	taskRequest.Uuid = uuid.New()
+	taskRequest.BinName = args.Name
 	taskRequest.Args = args.Args
 	taskRequest.StartTime = args.StartTime
 	taskRequest.TimeInterval = args.TimeInterval
 	taskRequest.Index = 0
+	taskRequest.Attempt = 0
 	taskRequest.MaxRunTime = args.MaxRunTime
-
-	switch args.Method {
-	case "GET":
-		taskRequest.TaskType = RpcTaskGET
-	case "POST":
-		taskRequest.TaskType = RpcTaskPOST
-	case "PUT":
-		taskRequest.TaskType = RpcTaskPUT
-	case "DELETE":
-		taskRequest.TaskType = RpcTaskDELETE
-	default:
-		return c.JSON(http.StatusForbidden, ErrInvalidArgument.Error())
+	taskRequest.TaskType = HandlerTask
+	taskRequest.CallbackUrl = args.CallbackUrl
+	tags, err := ParseTags(args.Tags)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	taskRequest.Tags = tags
+	if err = b.CheckTaskRequest(taskRequest); err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
 	}
 
-	err := b.HandleRequest(taskRequest)
+	taskRequest.TraceParent = TraceParent(c.Context())
+	err = b.HandleRequest(taskRequest)
 	if err != nil {
 		return c.JSON(http.StatusForbidden, err.Error())
 	}
-	logger.GetLogger().Infoln("Broker", "CreateRpcTaskRequest", "ok", 0,
+	logger.GetLogger().Infoln("Broker", "CreateHandlerTaskRequest", "ok", 0,
 		"uuid", taskRequest.Uuid,
 		"bin_name", taskRequest.BinName,
 		"args", taskRequest.Args,
@@ -136,6 +446,8 @@ func (b *Broker) CreateRpcTaskRequest(c echo.Context) error {
 		"index", taskRequest.Index,
 		"max_run_time", taskRequest.MaxRunTime,
 		"task_type", taskRequest.TaskType,
+		"callback_url", taskRequest.CallbackUrl,
+		"tags", taskRequest.Tags,
 	)
 	return c.JSON(http.StatusOK, taskRequest.Uuid)
 }
@@ -147,13 +459,393 @@ func (b *Broker) GetTaskResult(c echo.Context) error {
 	if len(uuid) == 0 {
 		return c.JSON(http.StatusForbidden, ErrInvalidArgument.Error())
 	}
-	reply, err := b.HandleTaskResult(uuid)
+	//wait大于0时等待结果写入,单位为秒
+	wait, _ := strconv.ParseInt(c.Query("wait"), 10, 64)
+	if wait > MaxResultWaitTime {
+		wait = MaxResultWaitTime
+	}
+	reply, err := b.WaitTaskResult(uuid, time.Second*time.Duration(wait))
 	if err != nil {
 		return c.JSON(http.StatusForbidden, err.Error())
 	}
 	return c.JSON(http.StatusOK, reply)
 }
 
+//以Server-Sent Events推送一组任务的结束事件,所有任务结束后关闭连接
+func (b *Broker) GetTaskEvents(c echo.Context) error {
+	uuids, err := ParseUuidList(c.Query("uuids"))
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	flusher, ok := c.Response().(http.Flusher)
+	if !ok {
+		return c.JSON(http.StatusForbidden, ErrStreamNotSupported.Error())
+	}
+	var closed <-chan bool
+	if notifier, ok := c.Response().(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+	ch := b.notifier.Watch(uuids...)
+	defer b.notifier.Unwatch(ch, uuids...)
+
+	header := c.Response().Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	c.Response().WriteHeader(http.StatusOK)
+
+	pending := make(map[string]bool, len(uuids))
+	for _, uuid := range uuids {
+		pending[uuid] = true
+	}
+	//检查任务是否结束,结束时推送结果
+	check := func(uuid string) error {
+		reply, err := b.HandleTaskResult(uuid)
+		if err == ErrResultNotExist {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if reply.Retrying {
+			return nil
+		}
+		delete(pending, uuid)
+		data, _ := json.Marshal(&TaskStatus{Uuid: uuid, Status: TaskStatusFinished,
+			WorkerId: reply.WorkerId, Progress: reply.Progress, Result: reply})
+		fmt.Fprintf(c.Response(), "id: %s\nevent: result\ndata: %s\n\n", uuid, data)
+		return nil
+	}
+	checkAll := func() error {
+		for uuid := range pending {
+			if err := check(uuid); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err = checkAll()
+	for err == nil && len(pending) != 0 {
+		flusher.Flush()
+		select {
+		case uuid := <-ch:
+			if len(uuid) == 0 {
+				err = checkAll()
+			} else if pending[uuid] {
+				err = check(uuid)
+			}
+		case <-time.After(liveLogPingTime):
+			fmt.Fprint(c.Response(), ": ping\n\n")
+		case <-closed:
+			return nil
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(c.Response(), "event: error\ndata: %s\n\n", err.Error())
+	} else {
+		fmt.Fprint(c.Response(), "event: end\ndata: \n\n")
+	}
+	flusher.Flush()
+	return nil
+}
+
+//获取任务回调的投递记录(根据UUID)
+func (b *Broker) GetTaskCallback(c echo.Context) error {
+	uuid := c.Query("uuid")
+	if len(uuid) == 0 {
+		return c.JSON(http.StatusForbidden, ErrInvalidArgument.Error())
+	}
+	status, err := b.HandleTaskCallback(uuid)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+//获取任务状态和进度(根据UUID)
+func (b *Broker) GetTaskStatus(c echo.Context) error {
+	uuid := c.Query("uuid")
+	if len(uuid) == 0 {
+		return c.JSON(http.StatusForbidden, ErrInvalidArgument.Error())
+	}
+	status, err := b.HandleTaskStatus(uuid)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+//取消任务
+func (b *Broker) CancelTask(c echo.Context) error {
+	if err := b.CheckAdminToken(c.Request().Header().Get(AdminTokenHeader)); err != nil {
+		return c.JSON(http.StatusUnauthorized, err.Error())
+	}
+	uuid := c.Query("uuid")
+	if err := b.HandleTaskCancel(uuid); err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	logger.GetLogger().Infoln("Broker", "CancelTask", "ok", 0, "uuid", uuid)
+	return c.JSON(http.StatusOK, uuid)
+}
+
+//查询任务列表,时间参数为unix时间戳(秒)
+func (b *Broker) ListTasks(c echo.Context) error {
+	query := &TaskQuery{
+		State:    c.Query("state"),
+		Queue:    c.Query("queue"),
+		TaskType: c.Query("task_type"),
+		BinName:  c.Query("bin_name"),
+		Cursor:   c.Query("cursor"),
+	}
+	var err error
+	if query.Tags, err = ParseTags(c.Query("tags")); err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	if limit := c.Query("limit"); len(limit) != 0 {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return c.JSON(http.StatusForbidden, ErrInvalidArgument.Error())
+		}
+	}
+	times := []struct {
+		name  string
+		value *int64
+	}{
+		{"submitted_after", &query.SubmittedAfter},
+		{"submitted_before", &query.SubmittedBefore},
+		{"finished_after", &query.FinishedAfter},
+		{"finished_before", &query.FinishedBefore},
+	}
+	for _, t := range times {
+		if s := c.Query(t.name); len(s) != 0 {
+			sec, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return c.JSON(http.StatusForbidden, ErrInvalidArgument.Error())
+			}
+			*t.value = sec * 1000
+		}
+	}
+	list, err := b.SearchTasks(query)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+//查询当前broker中等待加入队列的定时任务和重试任务
+func (b *Broker) ListScheduledTasks(c echo.Context) error {
+	var limit int
+	var err error
+	if s := c.Query("limit"); len(s) != 0 {
+		if limit, err = strconv.Atoi(s); err != nil {
+			return c.JSON(http.StatusForbidden, ErrInvalidArgument.Error())
+		}
+	}
+	tasks, err := b.ScheduledTasks(limit)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, tasks)
+}
+
+//查询在线的worker
+func (b *Broker) GetWorkers(c echo.Context) error {
+	workers, err := b.ListWorkers()
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, workers)
+}
+
+//查询任务执行的归档记录,日期格式为yyyymmdd
+func (b *Broker) QueryArchive(c echo.Context) error {
+	if err := b.CheckAdminToken(c.Request().Header().Get(AdminTokenHeader)); err != nil {
+		return c.JSON(http.StatusUnauthorized, err.Error())
+	}
+	query := &ArchiveQuery{
+		Uuid:    c.Query("uuid"),
+		BinName: c.Query("bin_name"),
+		Outcome: c.Query("outcome"),
+		Tag:     c.Query("tag"),
+	}
+	var err error
+	if limit := c.Query("limit"); len(limit) != 0 {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return c.JSON(http.StatusForbidden, ErrInvalidArgument.Error())
+		}
+	}
+	for _, d := range []struct {
+		name  string
+		value *time.Time
+	}{{"from", &query.From}, {"to", &query.To}} {
+		if s := c.Query(d.name); len(s) != 0 {
+			if *d.value, err = time.ParseInLocation(logDateFormat, s, time.Local); err != nil {
+				return c.JSON(http.StatusForbidden, ErrInvalidArgument.Error())
+			}
+		}
+	}
+	records, err := b.HandleArchiveQuery(query)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, records)
+}
+
+//获取任务的请求参数(根据UUID)
+func (b *Broker) GetTaskRequest(c echo.Context) error {
+	if err := b.CheckAdminToken(c.Request().Header().Get(AdminTokenHeader)); err != nil {
+		return c.JSON(http.StatusUnauthorized, err.Error())
+	}
+	uuid := c.Query("uuid")
+	if len(uuid) == 0 {
+		return c.JSON(http.StatusForbidden, ErrInvalidArgument.Error())
+	}
+	request, err := b.HandleTaskRequest(uuid)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	request.Redact()
+	return c.JSON(http.StatusOK, request)
+}
+
+//重新执行失败的任务
+func (b *Broker) RetryTask(c echo.Context) error {
+	if err := b.CheckAdminToken(c.Request().Header().Get(AdminTokenHeader)); err != nil {
+		return c.JSON(http.StatusUnauthorized, err.Error())
+	}
+	uuid := c.Query("uuid")
+	if err := b.HandleTaskRetry(uuid); err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	logger.GetLogger().Infoln("Broker", "RetryTask", "ok", 0, "uuid", uuid)
+	return c.JSON(http.StatusOK, uuid)
+}
+
+//删除任务的所有数据
+func (b *Broker) PurgeTask(c echo.Context) error {
+	if err := b.CheckAdminToken(c.Request().Header().Get(AdminTokenHeader)); err != nil {
+		return c.JSON(http.StatusUnauthorized, err.Error())
+	}
+	uuid := c.Query("uuid")
+	if err := b.HandleTaskPurge(uuid); err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	logger.GetLogger().Infoln("Broker", "PurgeTask", "ok", 0, "uuid", uuid)
+	return c.JSON(http.StatusOK, uuid)
+}
+
+//RPC任务的服务端上报进度,uuid从请求头X-Ktse-Task-Uuid中获取,没有该请求头时使用uuid参数
+func (b *Broker) ReportTaskProgress(c echo.Context) error {
+	uuid := c.Request().Header().Get(TaskUuidHeader)
+	if len(uuid) == 0 {
+		uuid = c.Query("uuid")
+	}
+	percent, err := strconv.Atoi(c.Query("percent"))
+	if err != nil {
+		return c.JSON(http.StatusForbidden, ErrInvalidArgument.Error())
+	}
+	progress := &Progress{Percent: percent, Message: c.Query("message")}
+	if err = b.HandleTaskProgress(uuid, progress); err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, progress)
+}
+
+//获取任务的完整输出(根据UUID),stream为stdout或stderr,默认为stdout
+func (b *Broker) GetTaskLog(c echo.Context) error {
+	uuid := c.Query("uuid")
+	stream := c.Query("stream")
+	if len(stream) == 0 {
+		stream = "stdout"
+	}
+	r, err := b.HandleTaskLog(uuid, stream)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	defer r.Close()
+	c.Response().Header().Set("Content-Type", "text/plain; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+	_, err = io.Copy(c.Response(), r)
+	return err
+}
+
+//获取任务运行时的输出,follow=1时以Server-Sent Events持续推送直到任务结束
+func (b *Broker) GetLiveTaskLog(c echo.Context) error {
+	uuid := c.Param("uuid")
+	after, _ := strconv.ParseInt(c.Query("after"), 10, 64)
+	if id := c.Request().Header().Get("Last-Event-ID"); len(id) != 0 {
+		after, _ = strconv.ParseInt(id, 10, 64)
+	}
+	exist, err := b.taskExists(uuid)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	if !exist {
+		return c.JSON(http.StatusNotFound, ErrTaskNotExist.Error())
+	}
+	if c.Query("follow") != "1" {
+		lines, err := b.GetLiveLogs(uuid, after)
+		if err != nil {
+			return c.JSON(http.StatusForbidden, err.Error())
+		}
+		return c.JSON(http.StatusOK, lines)
+	}
+
+	flusher, ok := c.Response().(http.Flusher)
+	if !ok {
+		return c.JSON(http.StatusForbidden, ErrStreamNotSupported.Error())
+	}
+	var closed <-chan bool
+	if notifier, ok := c.Response().(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+	header := c.Response().Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	c.Response().WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	lastWrite := time.Now()
+	for {
+		//先判断是否结束再读取,保证结束前写入的输出都被推送
+		finished, err := b.IsTaskFinished(uuid)
+		if err != nil {
+			fmt.Fprintf(c.Response(), "event: error\ndata: %s\n\n", err.Error())
+			flusher.Flush()
+			return nil
+		}
+		lines, err := b.GetLiveLogs(uuid, after)
+		if err != nil {
+			fmt.Fprintf(c.Response(), "event: error\ndata: %s\n\n", err.Error())
+			flusher.Flush()
+			return nil
+		}
+		for _, line := range lines {
+			data, _ := json.Marshal(line)
+			fmt.Fprintf(c.Response(), "id: %d\nevent: %s\ndata: %s\n\n", line.Seq, line.Stream, data)
+			after = line.Seq
+			lastWrite = time.Now()
+		}
+		if finished {
+			fmt.Fprintf(c.Response(), "event: end\ndata: %s\n\n", uuid)
+			flusher.Flush()
+			return nil
+		}
+		//没有新输出时发送注释,保持连接
+		if time.Since(lastWrite) > liveLogPingTime {
+			fmt.Fprint(c.Response(), ": ping\n\n")
+			lastWrite = time.Now()
+		}
+		flusher.Flush()
+		select {
+		case <-closed:
+			return nil
+		case <-time.After(liveLogPollTime):
+		}
+	}
+}
+
 //获取未执行的任务数量
 func (b *Broker) UndoTaskCount(c echo.Context) error {
 	count, err := b.GetUndoTaskCount()
@@ -163,6 +855,44 @@ func (b *Broker) UndoTaskCount(c echo.Context) error {
 	return c.JSON(http.StatusOK, count)
 }
 
+//获取每个队列中未执行的任务数量
+func (b *Broker) QueueTaskCount(c echo.Context) error {
+	counts, err := b.GetQueueCounts()
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, counts)
+}
+
+//按时间粒度和维度查询执行统计,from和to为unix时间戳(秒),group_by为逗号分隔的维度
+func (b *Broker) GetStats(c echo.Context) error {
+	query := &StatsQuery{
+		Resolution: c.Query("resolution"),
+		TaskType:   c.Query("task_type"),
+		Queue:      c.Query("queue"),
+		BinName:    c.Query("bin_name"),
+	}
+	var err error
+	for _, t := range []struct {
+		name  string
+		value *int64
+	}{{"from", &query.From}, {"to", &query.To}} {
+		if s := c.Query(t.name); len(s) != 0 {
+			if *t.value, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return c.JSON(http.StatusForbidden, ErrInvalidArgument.Error())
+			}
+		}
+	}
+	if groupBy := c.Query("group_by"); len(groupBy) != 0 {
+		query.GroupBy = strings.Split(groupBy, ",")
+	}
+	stats, err := b.HandleStats(query)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
 //获取失败的任务数量
 func (b *Broker) FailTaskCount(c echo.Context) error {
 	date := c.Param("date")
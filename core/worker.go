@@ -2,17 +2,25 @@ package core
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/phillihq/ktse/logger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/reflect/protoregistry"
 	"gopkg.in/redis.v3"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
-	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -24,12 +32,70 @@ type Worker struct {
 	redisClient        *redis.Client
 	redisClusterClient *redis.ClusterClient
 	cluster            bool
+	id                 string
+	ctx                context.Context
+	cancel             context.CancelFunc
+	manifest           *BinManifest
+	logStore           LogStore
+	archive            *Archive
+	rpcLock            sync.Mutex
+	rpcClients         map[string]*http.Client
+	grpcConns          map[string]*grpc.ClientConn
+	grpcDescriptors    map[string]*protoregistry.Files
+	handlerLock        sync.RWMutex
+	handlers           map[string]HandlerFunc
+	traceShutdown      func(context.Context) error
+	startTime          time.Time
+	stateLock          sync.Mutex
+	currentTask        string
 }
 
 func NewWorker(cfg *WorkerConfig, cluster bool) (*Worker, error) {
 	var err error
 	w := new(Worker)
 	w.cfg = cfg
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+
+	if len(cfg.BinManifest) != 0 {
+		w.manifest, err = LoadBinManifest(cfg.BinManifest)
+		if err != nil {
+			logger.GetLogger().Errorln("worker", "NewWorker", "load bin manifest fail", 0, "err", err.Error())
+			return nil, err
+		}
+	}
+
+	if len(cfg.LogStore) != 0 {
+		w.logStore, err = NewLogStore(cfg.LogStore)
+		if err != nil {
+			logger.GetLogger().Errorln("worker", "NewWorker", "create log store fail", 0, "err", err.Error())
+			return nil, err
+		}
+	}
+
+	w.id = cfg.WorkerId
+	if len(w.id) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		w.id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	if len(cfg.TraceEndpoint) != 0 {
+		w.traceShutdown, err = InitTracer(cfg.TraceEndpoint, "ktse-worker", w.id)
+		if err != nil {
+			logger.GetLogger().Errorln("worker", "NewWorker", "init tracer fail", 0, "err", err.Error())
+			return nil, err
+		}
+	}
+
+	if len(cfg.ArchivePath) != 0 {
+		w.archive, err = NewArchive(cfg.ArchivePath, w.id)
+		if err != nil {
+			logger.GetLogger().Errorln("worker", "NewWorker", "create archive fail", 0, "err", err.Error())
+			return nil, err
+		}
+	}
 
 	vec := strings.SplitN(cfg.RedisAddr, "/", 2)
 	if len(vec) == 2 {
@@ -73,22 +139,26 @@ func NewWorker(cfg *WorkerConfig, cluster bool) (*Worker, error) {
 func (w *Worker) Run() error {
 	var taskResult *TaskResult
 	w.running = true
-	for w.running {
-
-		var uuid string
-		var err error
-
-		if w.IsCluster() {
-			uuid, err = w.redisClusterClient.SPop(RequestUuidSet).Result()
-		} else {
-			uuid, err = w.redisClient.SPop(RequestUuidSet).Result()
-		}
+	w.startTime = time.Now()
+	go w.Heartbeat()
+	if w.logStore != nil && w.cfg.LogKeepTime > 0 {
+		go w.CleanLogStore()
+	}
+	if w.archive != nil {
+		go w.CleanArchive()
+	}
+	go w.RunCallback()
+	if len(w.cfg.MetricsAddr) != 0 {
+		go w.runMetrics()
+	}
+	for next := 0; w.running; next++ {
+		//每次读取时重新获取队列,Run之后注册的处理函数也会被读取
+		uuid, err := w.popRequest(w.queues(), next)
 		if err == redis.Nil {
 			time.Sleep(time.Second)
 			continue
 		}
 		if err != nil {
-			logger.GetLogger().Errorln("Worker", "run", "spop error", 0, "error", err.Error())
 			continue
 		}
 		reqKey := fmt.Sprintf("t_%s", uuid)
@@ -97,30 +167,13 @@ func (w *Worker) Run() error {
 		var request []interface{}
 
 		if w.IsCluster() {
-			request, err = w.redisClusterClient.HMGet(reqKey,
-				"uuid",
-				"bin_name",
-				"args",
-				"start_time",
-				"time_interval",
-				"index",
-				"max_run_time",
-				"task_type",
-			).Result()
+			request, err = w.redisClusterClient.HMGet(reqKey, TaskRequestFields...).Result()
 		} else {
-			request, err = w.redisClient.HMGet(reqKey,
-				"uuid",
-				"bin_name",
-				"args",
-				"start_time",
-				"time_interval",
-				"index",
-				"max_run_time",
-				"task_type",
-			).Result()
+			request, err = w.redisClient.HMGet(reqKey, TaskRequestFields...).Result()
 		}
 
 		if err != nil {
+			observeRedisError("worker", "hmget", err)
 			logger.GetLogger().Errorln("Worker", "run", err.Error(), 0, "req_key", reqKey)
 			continue
 		}
@@ -140,16 +193,19 @@ func (w *Worker) Run() error {
 		if err != nil {
 			logger.GetLogger().Errorln("Worker", "run", "delete result failed", 0, "req_key", reqKey)
 		}
-		//执行请求的任务
-		taskResult, err = w.DoTaskRequest(request)
+		//执行请求的任务,失败也会返回结果,统计在写入结果时进行
+		w.setCurrentTask(uuid)
+		ctx, span := startTaskArgsSpan(w.ctx, request, "Worker.Run",
+			trace.WithAttributes(attribute.String("ktse.worker.id", w.id)))
+		taskResult, err = w.DoTaskRequest(ctx, request)
 		if err != nil {
 			logger.GetLogger().Errorln("Worker", "run", "DoTaskRequest", 0, "err", err.Error(),
 				"req_key", reqKey, "bin_name", request[1], "task_type", request[7])
-		} else {
-			w.SetSuccessTaskCount(reqKey)
 		}
 
 		if taskResult != nil {
+			observeTaskResult(taskResult)
+			w.archiveResult(taskResult)
 			err = w.SetTaskResult(taskResult)
 			if err != nil {
 				logger.GetLogger().Errorln("Worker", "run", "DoScrpitTaskRequest", 0,
@@ -158,6 +214,8 @@ func (w *Worker) Run() error {
 			logger.GetLogger().Infoln("worker", "run", "do task success", 0, "req_key", reqKey,
 				"result", taskResult.Result)
 		}
+		endTaskSpan(span, taskResult, err)
+		w.setCurrentTask("")
 		if w.cfg.Peroid != 0 {
 			time.Sleep(time.Second * time.Duration(w.cfg.Peroid))
 		}
@@ -165,8 +223,84 @@ func (w *Worker) Run() error {
 	return nil
 }
 
+//读取的任务队列:request_uuid_set和注册了的处理函数的队列
+func (w *Worker) queues() []string {
+	w.handlerLock.RLock()
+	defer w.handlerLock.RUnlock()
+	var names []string
+	for name := range w.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	queues := []string{RequestUuidSet}
+	for _, name := range names {
+		queues = append(queues, HandlerQueue(name))
+	}
+	return queues
+}
+
+//从start开始轮流从各个队列中取出一个任务,所有队列都为空时返回redis.Nil
+func (w *Worker) popRequest(queues []string, start int) (string, error) {
+	for i := range queues {
+		queue := queues[(start+i)%len(queues)]
+		var uuid string
+		var err error
+		if w.IsCluster() {
+			uuid, err = w.redisClusterClient.SPop(queue).Result()
+		} else {
+			uuid, err = w.redisClient.SPop(queue).Result()
+		}
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			observeRedisError("worker", "spop", err)
+			logger.GetLogger().Errorln("Worker", "run", "spop error", 0, "set", queue, "error", err.Error())
+		}
+		return uuid, err
+	}
+	return "", redis.Nil
+}
+
+//定期删除过期的任务输出
+func (w *Worker) CleanLogStore() {
+	keep := time.Second * time.Duration(w.cfg.LogKeepTime)
+	for w.running {
+		if err := w.logStore.Clean(keep); err != nil {
+			logger.GetLogger().Errorln("Worker", "CleanLogStore", err.Error(), 0)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+//结果中每个输出流保存的最大字节数
+func (w *Worker) outputLimit() int64 {
+	if w.cfg.OutputLimit == 0 {
+		return DefaultOutputLimit
+	}
+	return w.cfg.OutputLimit
+}
+
 func (w *Worker) Close() {
 	w.running = false
+	//终止正在执行的任务
+	w.cancel()
+	w.rpcLock.Lock()
+	for _, conn := range w.grpcConns {
+		conn.Close()
+	}
+	//关闭RPC任务连接池中的空闲连接
+	for _, client := range w.rpcClients {
+		client.CloseIdleConnections()
+	}
+	w.rpcLock.Unlock()
+	if w.archive != nil {
+		w.archive.Close()
+	}
+	if w.traceShutdown != nil {
+		w.traceShutdown(context.Background())
+	}
+	w.removeHeartbeat()
 	w.redisClient.Close()
 	w.redisClusterClient.Close()
 }
@@ -176,44 +310,74 @@ func (w *Worker) IsCluster() bool {
 	return w.cluster
 }
 
-func (w *Worker) DoTaskRequest(args []interface{}) (*TaskResult, error) {
-	var err error
+func (w *Worker) DoTaskRequest(ctx context.Context, args []interface{}) (*TaskResult, error) {
 	var output string
-	req := new(TaskRequest)
 	ret := new(TaskResult)
 
-	req.Uuid = args[0].(string)
-	req.BinName = args[1].(string)
-	req.Args = args[2].(string)
-	req.StartTime, err = strconv.ParseInt(args[3].(string), 10, 64)
-	if err != nil {
-		return nil, err
-	}
-	req.TimeInterval = args[4].(string)
-	req.Index, err = strconv.Atoi(args[5].(string))
-	if err != nil {
-		return nil, err
-	}
-	req.MaxRunTime, err = strconv.ParseInt(args[6].(string), 10, 64)
-	if err != nil {
-		return nil, err
-	}
-	req.TaskType, err = strconv.Atoi(args[7].(string))
+	req, err := parseTaskRequest(args)
 	if err != nil {
 		return nil, err
 	}
 
+	ret.WorkerId = w.id
+	ret.ExecStartTime = time.Now().UnixNano() / int64(time.Millisecond)
+	//已经取消的任务不再执行
+	if w.IsTaskCanceled(req.Uuid) {
+		ret.TaskRequest = *req
+		ret.ExecEndTime = ret.ExecStartTime
+		ret.Canceled = true
+		ret.IsSuccess = int64(0)
+		ret.Result = ErrTaskCanceled.Error()
+		return ret, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go w.watchCancel(ctx, req.Uuid, cancel)
+	//创建进度,表示任务开始执行
+	w.StartProgress(req.Uuid)
+	w.setTaskState(req.Uuid, TaskStatusRunning, 0)
 	switch req.TaskType {
 	case ScriptTask:
 		//执行脚本请求
-		output, err = w.DoScriptTaskRequest(req)
-	case RpcTaskGET, RpcTaskPOST, RpcTaskPUT, RpcTaskDELETE:
+		var execResult *ExecResult
+		execResult, err = w.DoScriptTaskRequest(ctx, req)
+		if execResult != nil {
+			ret.SetExecResult(execResult)
+			output = strings.TrimRight(execResult.Stdout, "\n")
+		}
+	case RpcTaskGET, RpcTaskPOST, RpcTaskPUT, RpcTaskDELETE, RpcTaskPATCH, RpcTaskHEAD:
 		//执行RPC请求
-		output, err = w.DoRpcTaskRequest(req)
+		var resp *RpcResponse
+		resp, err = w.DoRpcTaskRequest(ctx, req)
+		if resp != nil {
+			ret.SetRpcResponse(resp)
+			output = resp.Body
+		}
+	case HandlerTask:
+		//执行注册的处理函数
+		output, err = w.DoHandlerTaskRequest(ctx, req)
+	case GrpcTask:
+		//执行gRPC请求
+		var resp *GrpcResponse
+		resp, err = w.DoGrpcTaskRequest(ctx, req)
+		if resp != nil {
+			ret.SetGrpcResponse(resp)
+			output = resp.Body
+		}
 	default:
 		err = ErrInvalidArgument
 		logger.GetLogger().Errorln("Worker", "DoTaskRequest", "task type error", 0, "task_type", req.TaskType)
 	}
+	//worker关闭时中断的任务仍然可以重试
+	ret.Canceled = err == ErrTaskCanceled && w.IsTaskCanceled(req.Uuid)
+	if ret.ExecEndTime == 0 {
+		ret.ExecEndTime = time.Now().UnixNano() / int64(time.Millisecond)
+		ret.Duration = ret.ExecEndTime - ret.ExecStartTime
+	}
+	//结果中保存最后一次上报的进度
+	if progress, err := w.GetProgress(req.Uuid); err == nil {
+		ret.Progress = progress
+	}
 
 	ret.TaskRequest = *req
 	if err != nil {
@@ -227,69 +391,205 @@ func (w *Worker) DoTaskRequest(args []interface{}) (*TaskResult, error) {
 	return ret, nil
 }
 
-//执行脚本请求
-func (w *Worker) DoScriptTaskRequest(req *TaskRequest) (string, error) {
-	var output string
+//执行脚本请求,根据成功策略判断执行结果
+func (w *Worker) DoScriptTaskRequest(ctx context.Context, req *TaskRequest) (*ExecResult, error) {
 	var err error
 	var maxRunTime int64
 
-	binPath := path.Clean(w.cfg.BinPath + "/" + req.BinName)
-	_, err = os.Stat(binPath)
-	if err != nil && os.IsNotExist(err) {
-		logger.GetLogger().Errorln("worker", "DoScrpitTaskRequest", "File not exist", 0,
+	binPath, err := w.resolveBin(req.BinName)
+	if err != nil {
+		logger.GetLogger().Errorln("worker", "DoScrpitTaskRequest", err.Error(), 0,
 			"key", fmt.Sprintf("t_%s", req.Uuid),
-			"bin_path", binPath,
+			"bin_name", req.BinName,
 		)
-		return "", ErrFileNotExist
+		return nil, err
 	}
 
-	if req.MaxRunTime == 0 {
-		maxRunTime = w.cfg.TaskRunTime
-	} else {
-		maxRunTime = req.MaxRunTime
+	maxRunTime = int64(w.taskRunTime(req) / time.Second)
+
+	policy, codes, err := w.successPolicy(req)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(req.Args) == 0 {
-		output, err = w.ExecBin(binPath, nil, maxRunTime)
-	} else {
-		argsVec := strings.Split(req.Args, " ")
-		output, err = w.ExecBin(binPath, argsVec, maxRunTime)
+	//优先使用参数列表,兼容只有args字符串的旧任务
+	argsVec := req.ArgList
+	if argsVec == nil && len(req.Args) != 0 {
+		argsVec, err = SplitArgs(req.Args)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return output, err
-}
+	opt := new(ExecOption)
+	opt.Env, err = w.checkEnv(req.Env)
+	if err != nil {
+		logger.GetLogger().Errorln("worker", "DoScrpitTaskRequest", err.Error(), 0,
+			"key", fmt.Sprintf("t_%s", req.Uuid),
+		)
+		return nil, err
+	}
+	if len(req.Cwd) != 0 {
+		opt.Dir, err = resolveUnder(w.cfg.BinPath, req.Cwd)
+		if err != nil {
+			logger.GetLogger().Errorln("worker", "DoScrpitTaskRequest", err.Error(), 0,
+				"key", fmt.Sprintf("t_%s", req.Uuid),
+				"cwd", req.Cwd,
+			)
+			return nil, err
+		}
+	}
+	opt.Stdin = []byte(req.Stdin)
+	cleanup, err := w.prepareSandbox(req, opt)
+	if err != nil {
+		return nil, err
+	}
+	//ExecBin返回时进程组已经全部退出
+	defer cleanup()
 
-//命令执行函数
-func (w *Worker) ExecBin(binPath string, args []string, maxRunTime int64) (string, error) {
-	var cmd *exec.Cmd
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	var err error
+	opt.OutputLimit = w.outputLimit()
+	var stdoutRef, stderrRef string
+	if w.logStore != nil {
+		var stdoutLog, stderrLog io.WriteCloser
+		//手动重新执行后按总的执行次数编号,不覆盖之前的输出
+		attempt := req.Attempt + req.Index
+		stdoutLog, stdoutRef, err = w.logStore.Create(req.Uuid, attempt, "stdout")
+		if err != nil {
+			return nil, err
+		}
+		defer stdoutLog.Close()
+		stderrLog, stderrRef, err = w.logStore.Create(req.Uuid, attempt, "stderr")
+		if err != nil {
+			return nil, err
+		}
+		defer stderrLog.Close()
+		opt.Stdout = stdoutLog
+		opt.Stderr = stderrLog
+	}
+	//运行时把输出按行写入redis,用于实时查看
+	if streamer := w.newLogStreamer(req); streamer != nil {
+		stdoutLine := streamer.Writer("stdout")
+		stderrLine := streamer.Writer("stderr")
+		defer streamer.Close(stdoutLine, stderrLine)
+		opt.Stdout = teeWriter(opt.Stdout, stdoutLine)
+		opt.Stderr = teeWriter(opt.Stderr, stderrLine)
+	}
 
-	if len(args) == 0 {
-		cmd = exec.Command(binPath)
-	} else {
-		cmd = exec.Command(binPath, args...)
+	//脚本通过文件描述符上报进度
+	progress, progressWriter, err := w.newProgressReader(req.Uuid)
+	if err != nil {
+		return nil, err
 	}
+	opt.Progress = progressWriter
 
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	cmd.Start()
-	err, _ = w.CmdRunWithTimeout(cmd, time.Duration(maxRunTime)*time.Second)
+	execResult, err := w.ExecBin(ctx, binPath, argsVec, opt, maxRunTime)
+	progressWriter.Close()
+	progress.Wait()
+	if execResult != nil {
+		execResult.StdoutRef = stdoutRef
+		execResult.StderrRef = stderrRef
+	}
 	if err != nil {
-		return "", err
+		return execResult, err
 	}
+	return execResult, execResult.Check(policy, codes)
+}
+
+//命令执行函数,进程启动后总是返回执行结果
+//进程运行在独立的进程组中,超时或取消时终止整个进程组
+func (w *Worker) ExecBin(ctx context.Context, binPath string, args []string, opt *ExecOption, maxRunTime int64) (*ExecResult, error) {
+	var cmd *exec.Cmd
+	var stdout *cappedBuffer
+	var stderr *cappedBuffer
+	var err error
 
-	if len(stderr.String()) != 0 {
-		errMsg := strings.TrimRight(stderr.String(), "\n")
-		return "", NewError(errMsg)
+	if opt == nil {
+		opt = new(ExecOption)
+	}
+	ctx, span := tracer.Start(ctx, "Worker.ExecBin", trace.WithAttributes(attribute.String("ktse.exec.path", binPath)))
+	defer span.End()
+	env := opt.Env
+	//脚本可以从环境变量中读取trace上下文
+	if tp := TraceParent(ctx); len(tp) != 0 {
+		env = append(env, TraceParentEnv+"="+tp)
 	}
-	return strings.TrimRight(stdout.String(), "\n"), nil
+	//通过worker自身作为包装进程设置rlimit
+	if opt.Limit.HasRlimit() {
+		if !sandboxInitialized {
+			return nil, ErrSandboxNotInit
+		}
+		self, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		limit, _ := json.Marshal(opt.Limit)
+		env = append(env, sandboxLimitEnv+"="+string(limit))
+		args = append([]string{sandboxArg, binPath}, args...)
+		binPath = self
+	}
+
+	cmd = exec.Command(binPath, args...)
+	if len(env) != 0 || opt.Progress != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Dir = opt.Dir
+	if len(opt.Stdin) != 0 {
+		cmd.Stdin = bytes.NewReader(opt.Stdin)
+	}
+	//结果中只保存限制长度的输出,完整输出写入opt.Stdout和opt.Stderr
+	stdout = newCappedBuffer(opt.OutputLimit)
+	stderr = newCappedBuffer(opt.OutputLimit)
+	cmd.Stdout = outputWriter(stdout, opt.Stdout)
+	cmd.Stderr = outputWriter(stderr, opt.Stderr)
+	if opt.Progress != nil {
+		cmd.ExtraFiles = []*os.File{opt.Progress}
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", ProgressFdEnv, progressFd))
+	}
+	//输出写入内存和日志而不是文件,cmd.Wait需要等待管道关闭,后台子进程会一直持有管道
+	cmd.WaitDelay = outputWaitDelay
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.SysProcAttr.Credential = opt.Credential
+	applyCgroup(cmd.SysProcAttr, opt.CgroupFD)
+
+	ret := new(ExecResult)
+	ret.StartTime = time.Now()
+	if err = cmd.Start(); err != nil {
+		logger.GetLogger().Errorln("worker", "ExecBin", "start error", 0, "path", binPath, "error", err.Error())
+		spanError(span, err)
+		return nil, err
+	}
+	err, killed := w.CmdRunWithTimeout(ctx, cmd, time.Duration(maxRunTime)*time.Second)
+	ret.EndTime = time.Now()
+	if killed {
+		spanError(span, err)
+		ret.ExitCode = -1
+		ret.Signal = syscall.SIGKILL.String()
+		//进程没有退出时输出缓冲区仍可能被写入,不再读取
+		if err != ErrProcessGroupAlive {
+			ret.setProcessState(cmd.ProcessState)
+			ret.Stdout = stdout.String()
+			ret.Stderr = stderr.String()
+		}
+		return ret, err
+	}
+	ret.setProcessState(cmd.ProcessState)
+	ret.Stdout = stdout.String()
+	ret.Stderr = stderr.String()
+	span.SetAttributes(attribute.Int("ktse.exec.exit_code", ret.ExitCode))
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return ret, err
+		}
+	}
+	return ret, nil
 }
 
-func (w *Worker) CmdRunWithTimeout(cmd *exec.Cmd, timeout time.Duration) (error, bool) {
+//等待命令执行结束,超时或取消时终止进程所在的进程组,返回值表示进程组是否被终止
+//命令正常退出后也会清理进程组中残留的子进程
+func (w *Worker) CmdRunWithTimeout(ctx context.Context, cmd *exec.Cmd, timeout time.Duration) (error, bool) {
 	var err error
+	var reason error
 
-	errCh := make(chan error)
+	errCh := make(chan error, 1)
 
 	go func() {
 		errCh <- cmd.Wait()
@@ -297,182 +597,209 @@ func (w *Worker) CmdRunWithTimeout(cmd *exec.Cmd, timeout time.Duration) (error,
 
 	select {
 	case <-time.After(timeout):
-		if err = cmd.Process.Kill(); err != nil {
-			logger.GetLogger().Errorln("worker", "CmdRunTimeout", "kill error", 0, "path", cmd.Path, "error", err.Error())
-		}
-		logger.GetLogger().Infoln("worker", "CmdRunWithTimeout", "kill process", 0, "path", cmd.Path, "error", ErrExecTimeout.Error())
-		go func() {
-			<-errCh
-		}()
-		return ErrExecTimeout, true
+		reason = ErrExecTimeout
+	case <-ctx.Done():
+		reason = ErrTaskCanceled
 	case err = <-errCh:
+		//正常退出但子进程仍持有输出管道,管道已经关闭,之后的输出不再保存
+		if err == exec.ErrWaitDelay {
+			err = nil
+		}
+		w.stopProcessGroup(cmd.Process.Pid, nil)
 		return err, false
 	}
-}
 
-//执行RPC任务请求
-func (w *Worker) DoRpcTaskRequest(req *TaskRequest) (string, error) {
-	var method string
-	switch req.TaskType {
-	case RpcTaskGET:
-		method = "GET"
-	case RpcTaskPOST:
-		method = "POST"
-	case RpcTaskPUT:
-		method = "PUT"
-	case RpcTaskDELETE:
-		method = "DELETE"
-	default:
-		method = "GET"
+	logger.GetLogger().Infoln("worker", "CmdRunWithTimeout", "kill process group", 0, "path", cmd.Path,
+		"pid", cmd.Process.Pid, "error", reason.Error())
+	if !w.stopProcessGroup(cmd.Process.Pid, errCh) {
+		return ErrProcessGroupAlive, true
 	}
+	return reason, true
+}
+
+//执行RPC请求,根据成功条件判断响应,收到响应时总是返回响应
+func (w *Worker) DoRpcTaskRequest(ctx context.Context, req *TaskRequest) (*RpcResponse, error) {
+	method := rpcMethod(req.TaskType)
 	url := req.BinName
 	args := req.Args
-	request, err := w.newHttpRequest(method, url, args)
+	request, err := w.newHttpRequest(method, url, args, req.Rpc)
 	if err != nil {
-		return "", err
+		logger.GetLogger().Errorln("worker", "DoRpcTaskRequest", err.Error(), 0,
+			"key", fmt.Sprintf("t_%s", req.Uuid), "url", url)
+		return nil, err
 	}
-	result, err := w.callRpc(request, time.Second*time.Duration(req.MaxRunTime))
-	return result, err
-}
-
-//调用HTTP请求
-func (w *Worker) callRpc(req *http.Request, maxRunTime time.Duration) (string, error) {
-	var timeout time.Duration
-	if w.cfg.TaskRunTime != 0 {
-		timeout = time.Duration(w.cfg.TaskRunTime) * time.Second
-	} else {
-		timeout = maxRunTime
+	ranges, err := w.rpcSuccessStatus(req.Rpc)
+	if err != nil {
+		return nil, err
 	}
-	//new a http client with timeout setting
-	client := &http.Client{
-		Timeout: timeout,
+	//服务端可以根据任务uuid调用broker上报进度
+	request.Header.Set(TaskUuidHeader, req.Uuid)
+	client, err := w.rpcClient(req.Rpc)
+	if err != nil {
+		logger.GetLogger().Errorln("worker", "DoRpcTaskRequest", err.Error(), 0,
+			"key", fmt.Sprintf("t_%s", req.Uuid), "tls", req.Rpc.Tls)
+		return nil, err
 	}
-	r, err := client.Do(req)
+	resp, err := w.callRpc(ctx, request, client, w.taskRunTime(req))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer r.Body.Close()
-	buf, err := ioutil.ReadAll(r.Body)
+	return resp, resp.Check(ranges, req.Rpc)
+}
+
+//调用HTTP请求,timeout包括读取响应体的时间,ctx取消时中断请求
+func (w *Worker) callRpc(ctx context.Context, req *http.Request, client *http.Client, timeout time.Duration) (*RpcResponse, error) {
+	ctx, span := tracer.Start(ctx, "Worker.callRpc", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.request.method", req.Method), attribute.String("server.address", req.URL.Host)))
+	defer span.End()
+	//被调用的服务可以继续同一个trace
+	InjectTraceHeader(ctx, req.Header)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	r, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		return "", err
+		err = rpcError(ctx, err)
+		spanError(span, err)
+		return nil, err
 	}
-	if r.StatusCode != http.StatusOK {
-		return "", NewError(string(buf))
+	span.SetAttributes(attribute.Int("http.response.status_code", r.StatusCode))
+	defer r.Body.Close()
+	raw, err := ioutil.ReadAll(io.LimitReader(r.Body, rpcBodyLimit))
+	if err != nil {
+		return nil, rpcError(ctx, err)
 	}
-
-	return string(buf), nil
+	//结果中只保存限制长度的响应体
+	body := newCappedBuffer(w.outputLimit())
+	body.Write(raw)
+	return &RpcResponse{StatusCode: r.StatusCode, Header: r.Header, Body: body.String(), raw: raw}, nil
 }
 
-//创建HTTP连接
-func (w *Worker) newHttpRequest(method string, url string, args string) (*http.Request, error) {
+//请求因为超时或任务取消被中断时,返回与脚本任务相同的错误
+func rpcError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return ErrExecTimeout
+	case context.Canceled:
+		return ErrTaskCanceled
+	}
+	return err
+}
 
-	var body io.Reader
-	if len(args) != 0 {
-		body = bytes.NewBuffer([]byte(args))
+//创建HTTP连接,opt为nil时以JSON发送args
+func (w *Worker) newHttpRequest(method string, url string, args string, opt *RpcOption) (*http.Request, error) {
+	if err := opt.Check(); err != nil {
+		return nil, err
+	}
+	body, contentType, err := rpcBody(args, opt)
+	if err != nil {
+		return nil, err
+	}
+	if opt != nil {
+		if url, err = rpcUrl(url, opt.Query); err != nil {
+			return nil, err
+		}
 	}
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
+	if opt == nil {
+		return req, nil
+	}
+	for name, value := range opt.Headers {
+		req.Header.Set(name, value)
+	}
+	if len(opt.Auth) != 0 {
+		if err = w.setRpcAuth(req, opt.Auth); err != nil {
+			return nil, err
+		}
+	}
 	return req, nil
 }
 
-//设置任务执行结果
+//设置任务执行结果,结果和统计在同一个事务中写入
 func (w *Worker) SetTaskResult(result *TaskResult) error {
 	key := fmt.Sprintf("r_%s", result.Uuid)
+	pairs := result.resultPairs()
+	keepTime := time.Second * time.Duration(w.cfg.ResultKeepTime)
 
+	var counts []redis.Cmder
 	var err error
 
 	if w.IsCluster() {
-		setCmd := w.redisClusterClient.HMSet(key,
-			"uuid", result.Uuid,
-			"bin_name", result.BinName,
-			"args", result.Args,
-			"start_time", strconv.FormatInt(result.StartTime, 10),
-			"time_interval", result.TimeInterval,
-			"index", strconv.Itoa(result.Index),
-			"max_run_time", strconv.FormatInt(result.MaxRunTime, 10),
-			"task_type", strconv.Itoa(result.TaskType),
-			"is_success", strconv.Itoa(int(result.IsSuccess)),
-			"result", result.Result,
-		)
-		err = setCmd.Err()
+		//集群模式下结果和统计的key不在同一个slot,不能使用事务:结果,过期时间和counted标记由一个脚本写入,
+		//之后再写入统计;标记保证每次执行最多统计一次(重试前broker会删除结果),写入结果后统计失败时不再统计
+		argv := append([]string{strconv.FormatInt(int64(keepTime/time.Second), 10), resultCountedField}, pairs...)
+		var counted interface{}
+		counted, err = w.redisClusterClient.Eval(resultWriteScript, []string{key}, argv).Result()
+		if n, _ := counted.(int64); err == nil && n == 1 {
+			counts = countTaskResult(w.redisClusterClient, result)
+		}
 	} else {
-		setCmd := w.redisClient.HMSet(key,
-			"uuid", result.Uuid,
-			"bin_name", result.BinName,
-			"args", result.Args,
-			"start_time", strconv.FormatInt(result.StartTime, 10),
-			"time_interval", result.TimeInterval,
-			"index", strconv.Itoa(result.Index),
-			"max_run_time", strconv.FormatInt(result.MaxRunTime, 10),
-			"task_type", strconv.Itoa(result.TaskType),
-			"is_success", strconv.Itoa(int(result.IsSuccess)),
-			"result", result.Result,
-		)
-		err = setCmd.Err()
+		multi := w.redisClient.Multi()
+		var cmds []redis.Cmder
+		cmds, err = multi.Exec(func() error {
+			multi.HMSet(key, pairs[0], pairs[1], pairs[2:]...)
+			multi.Expire(key, keepTime)
+			countTaskResult(multi, result)
+			return nil
+		})
+		multi.Close()
+		//事务中的命令各自返回错误,统计失败不影响结果
+		if len(cmds) > 2 {
+			counts = cmds[2:]
+			err = firstCmdErr(cmds[:2])
+		}
+	}
+	if countErr := firstCmdErr(counts); countErr != nil {
+		observeRedisError("worker", "count", countErr)
+		logger.GetLogger().Errorln("Worker", "SetTaskResult", "count result error", 0,
+			"key", key, "err", countErr.Error())
 	}
 	if err != nil {
+		observeRedisError("worker", "hmset", err)
 		return err
 	}
-	//如果任务是执行失败
-	if result.IsSuccess == int64(0) {
-		var err error
+	//失败后还会重试的任务状态为retrying,broker重新加入队列或者确定不再重试时修改
+	state := taskOutcome(result)
+	if len(taskFinal(result)) == 0 {
+		state = TaskStateRetrying
+	}
+	w.setTaskState(result.Uuid, state, result.ExecEndTime)
+	//失败后还会重试的任务交给broker处理,不再重试的任务已经统计为最终失败
+	if len(taskFinal(result)) == 0 {
 		if w.IsCluster() {
-			saddCmd := w.redisClusterClient.SAdd(FailResultUuidSet, result.Uuid)
-			err = saddCmd.Err()
+			err = w.redisClusterClient.SAdd(FailResultUuidSet, result.Uuid).Err()
 		} else {
-			saddCmd := w.redisClient.SAdd(FailResultUuidSet, result.Uuid)
-			err = saddCmd.Err()
+			err = w.redisClient.SAdd(FailResultUuidSet, result.Uuid).Err()
 		}
 		if err != nil {
+			observeRedisError("worker", "sadd", err)
 			return err
 		}
 	}
 
-	//设置结果的过期时间
-	if w.IsCluster() {
-		_, err = w.redisClusterClient.Expire(key, time.Second*time.Duration(w.cfg.ResultKeepTime)).Result()
-	} else {
-		_, err = w.redisClient.Expire(key, time.Second*time.Duration(w.cfg.ResultKeepTime)).Result()
+	//任务结束时通知等待结果的请求,发布失败不影响结果;还会重试的任务不通知
+	if len(taskFinal(result)) != 0 {
+		if err = w.PublishResult(result.Uuid); err != nil {
+			logger.GetLogger().Errorln("Worker", "SetTaskResult", "publish result error", 0,
+				"key", key, "err", err.Error())
+		}
 	}
-	if err != nil {
-		return err
+	//任务成功或者不再重试时投递回调
+	if len(result.CallbackUrl) != 0 && (result.IsSuccess == int64(1) || result.IsLastAttempt() || result.Canceled) {
+		if err = w.AddCallback(result); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-//设置成功的任务记录
-func (w *Worker) SetSuccessTaskCount(reqKey string) error {
-	successTaskKey := fmt.Sprintf(SuccessTaskKey, time.Now().Format(TimeFormat))
-
-	var count int64
-	var err error
-
-	if w.IsCluster() {
-		count, err = w.redisClusterClient.Incr(successTaskKey).Result()
-	} else {
-		count, err = w.redisClient.Incr(successTaskKey).Result()
-	}
-	if err != nil {
-		logger.GetLogger().Errorln("Worker", "SetSuccessTaskCount", "Incr", 0, "err", err.Error(),
-			"req_key", reqKey)
-		return err
-	}
-	//第一次设置该key
-	if count == 1 {
-		//保存一个月
-		expireTime := time.Second * time.Duration(60*60*24*30)
-
-		if w.IsCluster() {
-			_, err = w.redisClusterClient.Expire(successTaskKey, expireTime).Result()
-		} else {
-			_, err = w.redisClient.Expire(successTaskKey, expireTime).Result()
-		}
-		if err != nil {
-			logger.GetLogger().Errorln("Worker", "SetSuccessTaskCount", "Expire", 0, "err", err.Error(),
-				"req_key", reqKey)
+//第一个失败命令的错误
+func firstCmdErr(cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
 			return err
 		}
 	}
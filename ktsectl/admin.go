@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/phillihq/ktse/client"
+	"github.com/phillihq/ktse/core"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//在线的worker
+func runWorkers(ctx context.Context, c *client.Client, args []string) error {
+	workers, err := c.Workers(ctx)
+	if err != nil {
+		return err
+	}
+	if isJSON() {
+		return printJSON(workers)
+	}
+	var rows [][]string
+	for _, w := range workers {
+		rows = append(rows, []string{w.Id, w.Host, strconv.Itoa(w.Pid), strings.Join(w.Queues, " "),
+			w.CurrentTask, formatTime(w.StartTime), formatTime(w.Heartbeat)})
+	}
+	printTable([]string{"ID", "HOST", "PID", "QUEUES", "CURRENT_TASK", "STARTED", "HEARTBEAT"}, rows)
+	return nil
+}
+
+//broker中还没有加入队列的定时任务和等待重试的任务,取消使用cancel子命令
+func runScheduled(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("scheduled", flag.ExitOnError)
+	limit := fs.Int("limit", core.DefaultTaskListLimit, "max number of tasks")
+	fs.Parse(args)
+	tasks, err := c.Scheduled(ctx, *limit)
+	if err != nil {
+		return err
+	}
+	if isJSON() {
+		return printJSON(tasks)
+	}
+	var rows [][]string
+	for _, task := range tasks {
+		var retry string
+		if task.Index > 0 {
+			retry = strconv.Itoa(task.Index)
+		}
+		rows = append(rows, []string{task.Uuid, task.TaskType, task.BinName,
+			strings.Join(task.Tags, " "), retry, formatTime(task.RunTime)})
+	}
+	printTable([]string{"UUID", "TYPE", "BIN_NAME", "TAGS", "RETRY", "RUN_TIME"}, rows)
+	return nil
+}
+
+//已经失败并且不再重试的任务,可以用retry重新执行
+func runDead(ctx context.Context, c *client.Client, args []string) error {
+	return runList(ctx, c, append([]string{"-state", core.TaskStateFailure}, args...))
+}
+
+//任务的请求参数,敏感内容被隐藏
+func runInspect(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("missing uuid")
+	}
+	request, err := c.Request(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if isJSON() {
+		return printJSON(request)
+	}
+	var startTime string
+	if request.StartTime != 0 {
+		startTime = formatTime(request.StartTime * 1000)
+	}
+	var maxRunTime string
+	if request.MaxRunTime != 0 {
+		maxRunTime = (time.Duration(request.MaxRunTime) * time.Second).String()
+	}
+	var env string
+	if len(request.Env) != 0 {
+		buf, _ := json.Marshal(request.Env)
+		env = string(buf)
+	}
+	var option string
+	if request.Rpc != nil {
+		buf, _ := json.Marshal(request.Rpc)
+		option = string(buf)
+	} else if request.Grpc != nil {
+		buf, _ := json.Marshal(request.Grpc)
+		option = string(buf)
+	}
+	printFields([][2]string{
+		{"UUID", request.Uuid},
+		{"TYPE", requestType(request.TaskType)},
+		{"BIN_NAME", request.BinName},
+		{"ARGS", request.Args},
+		{"ENV", env},
+		{"CWD", request.Cwd},
+		{"OPTION", option},
+		{"TAGS", strings.Join(request.Tags, " ")},
+		{"START_TIME", startTime},
+		{"TIME_INTERVAL", request.TimeInterval},
+		{"MAX_RUN_TIME", maxRunTime},
+		{"CALLBACK_URL", request.CallbackUrl},
+		{"RETRIES", strconv.Itoa(request.Attempt + request.Index)},
+	})
+	return nil
+}
+
+//任务类型名称,RPC任务包括请求方法
+func requestType(taskType int) string {
+	switch taskType {
+	case core.ScriptTask:
+		return "script"
+	case core.GrpcTask:
+		return "grpc"
+	case core.HandlerTask:
+		return "handler"
+	}
+	for _, method := range []string{"GET", "POST", "PUT", "DELETE", "PATCH", "HEAD"} {
+		if core.RpcTaskType(method) == taskType {
+			return "rpc " + method
+		}
+	}
+	return strconv.Itoa(taskType)
+}
+
+//按原参数重新执行失败的任务
+func runRetry(ctx context.Context, c *client.Client, args []string) error {
+	return eachTask(args, "retried", func(uuid string) error {
+		return c.Retry(ctx, uuid)
+	})
+}
+
+//删除任务的所有数据
+func runPurge(ctx context.Context, c *client.Client, args []string) error {
+	return eachTask(args, "purged", func(uuid string) error {
+		return c.Purge(ctx, uuid)
+	})
+}
+
+//依次处理每个uuid,遇到错误时停止
+func eachTask(args []string, done string, fn func(uuid string) error) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing uuid")
+	}
+	for _, uuid := range args {
+		if err := fn(uuid); err != nil {
+			return fmt.Errorf("%s: %v", uuid, err)
+		}
+		if !isJSON() {
+			fmt.Printf("%s %s\n", uuid, done)
+		}
+	}
+	if isJSON() {
+		return printJSON(map[string][]string{done: args})
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/phillihq/ktse/client"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var brokerAddr *string = flag.String("broker", envDefault("KTSE_BROKER", "http://127.0.0.1:9595"), "broker address")
+var outputFlag *string = flag.String("o", "table", "output format: table or json")
+
+//broker不可用时直接访问的redis,为空表示不使用
+var redisAddr *string = flag.String("redis", os.Getenv("KTSE_REDIS"), "redis address used when broker is down")
+var clusterFlag *bool = flag.Bool("c", false, "connect to redis cluster")
+
+//broker配置了admin_token时取消,重新执行,删除任务和查看请求参数需要的令牌
+var adminToken *string = flag.String("admin_token", os.Getenv("KTSE_ADMIN_TOKEN"), "admin token sent in X-Ktse-Admin-Token")
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, c *client.Client, args []string) error
+}
+
+var commands = []command{
+	{"submit", "submit script|rpc|grpc|handler [flags]", runSubmit},
+	{"list", "list [-state s] [-type t] [-bin_name b] [-tags t] [-submitted_after t] [-finished_after t] [-limit n] [-cursor c] [-all]", runList},
+	{"status", "status <uuid>...", runStatus},
+	{"result", "result [-wait duration] <uuid>", runResult},
+	{"logs", "logs [-stream stdout|stderr] [-f] <uuid>", runLogs},
+	{"cancel", "cancel <uuid>...", runCancel},
+	{"callback", "callback <uuid>", runCallback},
+	{"backlog", "backlog", runBacklog},
+	{"stats", "stats [-date yyyy-mm-dd] [-days n]", runStats},
+	{"workers", "workers", runWorkers},
+	{"scheduled", "scheduled [-limit n]", runScheduled},
+	{"dead", "dead [list flags]", runDead},
+	{"inspect", "inspect <uuid>", runInspect},
+	{"retry", "retry <uuid>...", runRetry},
+	{"purge", "purge <uuid>...", runPurge},
+}
+
+func envDefault(name string, value string) string {
+	if v := os.Getenv(name); len(v) != 0 {
+		return v
+	}
+	return value
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: ktsectl [-broker addr] [-o table|json] [-admin_token token] [-redis addr [-c]] <command> [args]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n", cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nglobal flags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if *outputFlag != "table" && *outputFlag != "json" {
+		fmt.Fprintf(os.Stderr, "invalid output format: %s\n", *outputFlag)
+		os.Exit(2)
+	}
+
+	var run func(ctx context.Context, c *client.Client, args []string) error
+	for _, cmd := range commands {
+		if cmd.name == flag.Arg(0) {
+			run = cmd.run
+		}
+	}
+	if run == nil {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	var opts []client.Option
+	if len(*adminToken) != 0 {
+		opts = append(opts, client.WithAdminToken(*adminToken))
+	}
+	if len(*redisAddr) != 0 {
+		opts = append(opts, client.WithStore(*redisAddr, *clusterFlag))
+	}
+	c, err := client.New(*brokerAddr, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create client error:%v\n", err.Error())
+		os.Exit(1)
+	}
+	defer c.Close()
+
+	//Ctrl-C中断等待结果和跟踪输出
+	ctx, cancel := context.WithCancel(context.Background())
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sc
+		cancel()
+	}()
+
+	if err = run(ctx, c, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(0), err)
+		c.Close()
+		os.Exit(1)
+	}
+}
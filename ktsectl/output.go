@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/phillihq/ktse/core"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func isJSON() bool {
+	return *outputFlag == "json"
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printTable(header []string, rows [][]string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
+
+//两列的表格,值为空的行不输出
+func printFields(fields [][2]string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, field := range fields {
+		if len(field[1]) != 0 {
+			//多行的值缩进到第二列
+			value := strings.Replace(strings.TrimRight(field[1], "\n"), "\n", "\n\t", -1)
+			fmt.Fprintf(w, "%s\t%s\n", field[0], value)
+		}
+	}
+	w.Flush()
+}
+
+//毫秒时间戳
+func formatTime(ms int64) string {
+	if ms == 0 {
+		return ""
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).Format("2006-01-02 15:04:05.000")
+}
+
+func formatProgress(p *core.Progress) string {
+	if p == nil {
+		return ""
+	}
+	if len(p.Message) == 0 {
+		return fmt.Sprintf("%d%%", p.Percent)
+	}
+	return fmt.Sprintf("%d%% %s", p.Percent, p.Message)
+}
+
+func printReply(reply *core.Reply) error {
+	if isJSON() {
+		return printJSON(reply)
+	}
+	var exitCode string
+	if reply.ExitCode != nil {
+		exitCode = strconv.Itoa(*reply.ExitCode)
+	}
+	var httpStatus string
+	if reply.HttpStatus != 0 {
+		httpStatus = strconv.Itoa(reply.HttpStatus)
+	}
+	printFields([][2]string{
+		{"SUCCESS", strconv.FormatBool(reply.IsSuccess == 1)},
+		{"WORKER", reply.WorkerId},
+		{"START", formatTime(reply.ExecStartTime)},
+		{"END", formatTime(reply.ExecEndTime)},
+		{"DURATION", (time.Duration(reply.Duration) * time.Millisecond).String()},
+		{"EXIT_CODE", exitCode},
+		{"SIGNAL", reply.Signal},
+		{"HTTP_STATUS", httpStatus},
+		{"GRPC_CODE", reply.GrpcCode},
+		{"PROGRESS", formatProgress(reply.Progress)},
+		{"MESSAGE", reply.Result},
+		{"STDERR", reply.Stderr},
+	})
+	return nil
+}
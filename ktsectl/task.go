@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/phillihq/ktse/client"
+	"github.com/phillihq/ktse/core"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//所有提交命令共用的调度参数
+type scheduleFlags struct {
+	startTime    *int64
+	delay        *time.Duration
+	timeInterval *string
+	maxRunTime   *time.Duration
+	callbackUrl  *string
+	tags         *string
+	wait         *time.Duration
+}
+
+func newScheduleFlags(fs *flag.FlagSet) *scheduleFlags {
+	return &scheduleFlags{
+		startTime:    fs.Int64("start_time", 0, "start time (unix seconds)"),
+		delay:        fs.Duration("delay", 0, "start after delay, e.g. 10m"),
+		timeInterval: fs.String("time_interval", "", "retry intervals in seconds, space separated"),
+		maxRunTime:   fs.Duration("max_run_time", 0, "max run time, e.g. 30s"),
+		callbackUrl:  fs.String("callback_url", "", "callback url"),
+		tags:         fs.String("tags", "", "tags, space separated"),
+		wait:         fs.Duration("wait", 0, "wait for the result after submitting"),
+	}
+}
+
+func (f *scheduleFlags) schedule() client.Schedule {
+	s := client.Schedule{
+		TimeInterval: *f.timeInterval,
+		MaxRunTime:   *f.maxRunTime,
+		CallbackUrl:  *f.callbackUrl,
+		Tags:         strings.Fields(*f.tags),
+	}
+	if *f.startTime != 0 {
+		s.StartTime = time.Unix(*f.startTime, 0)
+	} else if *f.delay > 0 {
+		s.StartTime = time.Now().Add(*f.delay)
+	}
+	return s
+}
+
+//解析JSON对象形式的参数,为空时不修改v
+func parseObject(name string, s string, v interface{}) error {
+	if len(s) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(s), v); err != nil {
+		return fmt.Errorf("invalid -%s: %v", name, err)
+	}
+	return nil
+}
+
+func runSubmit(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing task type: script, rpc, grpc or handler")
+	}
+	fs := flag.NewFlagSet("submit "+args[0], flag.ExitOnError)
+	sf := newScheduleFlags(fs)
+	var submit func() (string, error)
+
+	switch args[0] {
+	case "script":
+		binName := fs.String("bin_name", "", "script path relative to bin_path")
+		argStr := fs.String("args", "", "arguments, shell quoting rules")
+		env := fs.String("env", "", "environment variables as a JSON object")
+		cwd := fs.String("cwd", "", "working directory relative to bin_path")
+		stdin := fs.String("stdin", "", "stdin content")
+		stdinFile := fs.String("stdin_file", "", "read stdin content from file, - for standard input")
+		successPolicy := fs.String("success_policy", "", "exit_code or stderr")
+		successCodes := fs.String("success_codes", "", "accepted exit codes, space separated")
+		limit := fs.String("limit", "", "resource limit as a JSON object")
+		fs.Parse(args[1:])
+		submit = func() (string, error) {
+			task := &client.ScriptTask{
+				Schedule:      sf.schedule(),
+				BinName:       *binName,
+				Cwd:           *cwd,
+				Stdin:         []byte(*stdin),
+				SuccessPolicy: *successPolicy,
+				SuccessCodes:  *successCodes,
+			}
+			var err error
+			if task.Args, err = core.SplitArgs(*argStr); err != nil {
+				return "", err
+			}
+			if err = parseObject("env", *env, &task.Env); err != nil {
+				return "", err
+			}
+			if len(*limit) != 0 {
+				task.Limit = new(core.ResourceLimit)
+				if err = parseObject("limit", *limit, task.Limit); err != nil {
+					return "", err
+				}
+			}
+			if len(*stdinFile) != 0 {
+				if *stdinFile == "-" {
+					task.Stdin, err = ioutil.ReadAll(os.Stdin)
+				} else {
+					task.Stdin, err = ioutil.ReadFile(*stdinFile)
+				}
+				if err != nil {
+					return "", err
+				}
+			}
+			return c.SubmitScript(ctx, task)
+		}
+	case "rpc":
+		method := fs.String("method", "GET", "GET, PUT, POST, DELETE, PATCH or HEAD")
+		url := fs.String("url", "", "request url")
+		body := fs.String("args", "", "request body")
+		headers := fs.String("headers", "", "request headers as a JSON object")
+		query := fs.String("query", "", "query parameters as a JSON object")
+		opt := new(core.RpcOption)
+		fs.StringVar(&opt.Auth, "auth", "", "name of rpc_secrets in worker config")
+		fs.StringVar(&opt.BodyType, "body_type", "", "json, form or raw")
+		fs.StringVar(&opt.ContentType, "content_type", "", "content type for raw body")
+		fs.StringVar(&opt.Tls, "tls", "", "name of rpc_tls in worker config")
+		fs.BoolVar(&opt.SkipVerify, "skip_verify", false, "skip server certificate verification")
+		fs.StringVar(&opt.SuccessStatus, "success_status", "", "accepted status codes, e.g. 200-299")
+		fs.StringVar(&opt.BodyRegex, "body_regex", "", "regexp the response body must match")
+		fs.StringVar(&opt.JsonPath, "json_path", "", "path that must exist in the JSON response")
+		fs.StringVar(&opt.JsonValue, "json_value", "", "value of json_path")
+		fs.Parse(args[1:])
+		submit = func() (string, error) {
+			if err := parseObject("headers", *headers, &opt.Headers); err != nil {
+				return "", err
+			}
+			if err := parseObject("query", *query, &opt.Query); err != nil {
+				return "", err
+			}
+			return c.SubmitRPC(ctx, &client.RPCTask{
+				Schedule: sf.schedule(),
+				Method:   *method,
+				Url:      *url,
+				Args:     *body,
+				Rpc:      opt,
+			})
+		}
+	case "grpc":
+		target := fs.String("target", "", "server address")
+		message := fs.String("args", "", "request message as JSON")
+		metadata := fs.String("metadata", "", "metadata as a JSON object")
+		opt := core.GrpcOption{}
+		fs.StringVar(&opt.Method, "method", "", "full method name, e.g. package.Service/Method")
+		fs.StringVar(&opt.Descriptor, "descriptor", "", "name of grpc_descriptors in worker config")
+		fs.StringVar(&opt.Tls, "tls", "", "name of rpc_tls in worker config")
+		fs.BoolVar(&opt.SkipVerify, "skip_verify", false, "skip server certificate verification")
+		fs.StringVar(&opt.SuccessCodes, "success_codes", "", "accepted status codes, e.g. \"OK NOT_FOUND\"")
+		fs.Parse(args[1:])
+		submit = func() (string, error) {
+			if err := parseObject("metadata", *metadata, &opt.Metadata); err != nil {
+				return "", err
+			}
+			return c.SubmitGRPC(ctx, &client.GRPCTask{
+				Schedule: sf.schedule(),
+				Target:   *target,
+				Args:     *message,
+				Grpc:     opt,
+			})
+		}
+	case "handler":
+		name := fs.String("name", "", "handler name")
+		payload := fs.String("args", "", "handler payload")
+		fs.Parse(args[1:])
+		submit = func() (string, error) {
+			return c.SubmitHandler(ctx, &client.HandlerTask{
+				Schedule: sf.schedule(),
+				Name:     *name,
+				Payload:  *payload,
+			})
+		}
+	default:
+		return fmt.Errorf("unknown task type: %s", args[0])
+	}
+
+	uuid, err := submit()
+	if err != nil {
+		return err
+	}
+	if *sf.wait <= 0 {
+		if isJSON() {
+			return printJSON(map[string]string{"uuid": uuid})
+		}
+		fmt.Println(uuid)
+		return nil
+	}
+	if !isJSON() {
+		fmt.Println(uuid)
+	}
+	return waitResult(ctx, c, uuid, *sf.wait)
+}
+
+func waitResult(ctx context.Context, c *client.Client, uuid string, wait time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	reply, err := c.Wait(ctx, uuid)
+	if err == context.DeadlineExceeded {
+		return client.ErrResultNotExist
+	}
+	if err != nil {
+		return err
+	}
+	return printReply(reply)
+}
+
+func runStatus(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing uuid")
+	}
+	var statuses []*core.TaskStatus
+	for _, uuid := range args {
+		status, err := c.Status(ctx, uuid)
+		if err != nil {
+			return fmt.Errorf("%s: %v", uuid, err)
+		}
+		statuses = append(statuses, status)
+	}
+	if isJSON() {
+		return printJSON(statuses)
+	}
+	var rows [][]string
+	for _, status := range statuses {
+		var success, message string
+		if status.Result != nil {
+			success = strconv.FormatBool(status.Result.IsSuccess == 1)
+			message = status.Result.Result
+			if len(message) > 60 {
+				message = message[:60] + "..."
+			}
+		}
+		rows = append(rows, []string{status.Uuid, status.Status, status.WorkerId,
+			formatProgress(status.Progress), success, message})
+	}
+	printTable([]string{"UUID", "STATUS", "WORKER", "PROGRESS", "SUCCESS", "MESSAGE"}, rows)
+	return nil
+}
+
+//时间参数可以是unix时间戳(秒)或者相对当前的时长,例如1h表示一小时前
+func parseSince(name string, s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return sec * 1000, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid -%s: %s", name, s)
+	}
+	return time.Now().Add(-d).UnixNano() / int64(time.Millisecond), nil
+}
+
+func runList(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	q := new(core.TaskQuery)
+	fs.StringVar(&q.State, "state", "", "scheduled, pending, running, retrying, success, failure or canceled")
+	fs.StringVar(&q.TaskType, "type", "", "script, rpc, grpc or handler")
+	fs.StringVar(&q.BinName, "bin_name", "", "script or handler name, rpc url, grpc target")
+	fs.StringVar(&q.Queue, "queue", "", "queue name")
+	fs.IntVar(&q.Limit, "limit", core.DefaultTaskListLimit, "page size")
+	fs.StringVar(&q.Cursor, "cursor", "", "cursor returned by the previous page")
+	tags := fs.String("tags", "", "tags, space separated, all must match")
+	all := fs.Bool("all", false, "fetch all pages")
+	times := []struct {
+		name  string
+		value *int64
+		flag  *string
+	}{
+		{name: "submitted_after", value: &q.SubmittedAfter},
+		{name: "submitted_before", value: &q.SubmittedBefore},
+		{name: "finished_after", value: &q.FinishedAfter},
+		{name: "finished_before", value: &q.FinishedBefore},
+	}
+	for i := range times {
+		times[i].flag = fs.String(times[i].name, "", "unix seconds or duration ago, e.g. 1h")
+	}
+	fs.Parse(args)
+	q.Tags = strings.Fields(*tags)
+	var err error
+	for _, t := range times {
+		if *t.value, err = parseSince(t.name, *t.flag); err != nil {
+			return err
+		}
+	}
+
+	list := &core.TaskList{Tasks: []*core.TaskInfo{}}
+	for {
+		page, err := c.List(ctx, q)
+		if err != nil {
+			return err
+		}
+		list.Tasks = append(list.Tasks, page.Tasks...)
+		list.NextCursor = page.NextCursor
+		if !*all || len(page.NextCursor) == 0 {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	if isJSON() {
+		return printJSON(list)
+	}
+	var rows [][]string
+	for _, task := range list.Tasks {
+		rows = append(rows, []string{task.Uuid, task.State, task.TaskType, task.BinName,
+			strings.Join(task.Tags, " "), formatTime(task.SubmitTime), formatTime(task.FinishTime)})
+	}
+	printTable([]string{"UUID", "STATE", "TYPE", "BIN_NAME", "TAGS", "SUBMITTED", "FINISHED"}, rows)
+	if len(list.NextCursor) != 0 {
+		fmt.Printf("\nnext: -cursor %s\n", list.NextCursor)
+	}
+	return nil
+}
+
+func runResult(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("result", flag.ExitOnError)
+	wait := fs.Duration("wait", 0, "wait for the result")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("missing uuid")
+	}
+	if *wait > 0 {
+		return waitResult(ctx, c, fs.Arg(0), *wait)
+	}
+	reply, err := c.Get(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return printReply(reply)
+}
+
+func runLogs(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	stream := fs.String("stream", "stdout", "stdout or stderr, ignored with -f")
+	follow := fs.Bool("f", false, "follow live output until the task finishes")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("missing uuid")
+	}
+	uuid := fs.Arg(0)
+	if !*follow {
+		r, err := c.Log(ctx, uuid, *stream)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(os.Stdout, r)
+		return err
+	}
+	return c.FollowLogs(ctx, uuid, 0, func(line *core.LogLine) error {
+		if isJSON() {
+			buf, _ := json.Marshal(line)
+			fmt.Println(string(buf))
+			return nil
+		}
+		out := os.Stdout
+		if line.Stream == "stderr" {
+			out = os.Stderr
+		}
+		fmt.Fprintln(out, line.Line)
+		return nil
+	})
+}
+
+func runCancel(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing uuid")
+	}
+	for _, uuid := range args {
+		if err := c.Cancel(ctx, uuid); err != nil {
+			return fmt.Errorf("%s: %v", uuid, err)
+		}
+		if !isJSON() {
+			fmt.Printf("%s canceled\n", uuid)
+		}
+	}
+	if isJSON() {
+		return printJSON(map[string][]string{"canceled": args})
+	}
+	return nil
+}
+
+func runCallback(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("missing uuid")
+	}
+	status, err := c.Callback(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if isJSON() {
+		return printJSON(status)
+	}
+	printFields([][2]string{
+		{"URL", status.Url},
+		{"STATUS", status.Status},
+		{"ATTEMPTS", strconv.Itoa(status.Attempts)},
+		{"LAST_TIME", formatTime(status.LastTime)},
+		{"LAST_ERROR", status.LastError},
+		{"NEXT_TIME", formatTime(status.NextTime)},
+	})
+	return nil
+}
+
+//每个队列中等待执行的任务数,处理函数任务在各自的队列中
+func runBacklog(ctx context.Context, c *client.Client, args []string) error {
+	counts, err := c.QueueCounts(ctx)
+	if err != nil {
+		return err
+	}
+	if isJSON() {
+		return printJSON(counts)
+	}
+	var queues []string
+	for queue := range counts {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	var rows [][]string
+	for _, queue := range queues {
+		rows = append(rows, []string{queue, strconv.FormatInt(counts[queue], 10)})
+	}
+	printTable([]string{"QUEUE", "PENDING"}, rows)
+	return nil
+}
+
+func runStats(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	date := fs.String("date", time.Now().Format(core.TimeFormat), "last day, yyyy-mm-dd")
+	days := fs.Int("days", 1, "number of days")
+	fs.Parse(args)
+	end, err := time.ParseInLocation(core.TimeFormat, *date, time.Local)
+	if err != nil {
+		return err
+	}
+	type dayStats struct {
+		Date    string `json:"date"`
+		Success int64  `json:"success"`
+		Failure int64  `json:"failure"`
+	}
+	var stats []dayStats
+	var undo int64
+	for i := *days - 1; i >= 0; i-- {
+		day := end.AddDate(0, 0, -i)
+		counts, err := c.Counts(ctx, day)
+		if err != nil {
+			return err
+		}
+		undo = counts.Undo
+		stats = append(stats, dayStats{day.Format(core.TimeFormat), counts.Success, counts.Failure})
+	}
+	if isJSON() {
+		return printJSON(map[string]interface{}{"undo": undo, "days": stats})
+	}
+	var rows [][]string
+	for _, s := range stats {
+		rows = append(rows, []string{s.Date, strconv.FormatInt(s.Success, 10), strconv.FormatInt(s.Failure, 10)})
+	}
+	printTable([]string{"DATE", "SUCCESS", "FAILURE"}, rows)
+	fmt.Printf("\npending: %d\n", undo)
+	return nil
+}
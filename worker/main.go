@@ -22,6 +22,9 @@ const (
 )
 
 func main() {
+	//作为脚本的包装进程启动时设置资源限制后直接执行脚本
+	core.SandboxInit()
+
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	flag.Parse()
 